@@ -5,17 +5,25 @@ import (
 	"fmt"
 	"github.com/jsiebens/faas-nomad/pkg/proxy"
 	"github.com/jsiebens/faas-nomad/pkg/resolver"
+	"github.com/jsiebens/faas-nomad/pkg/routing"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/async"
 	"github.com/jsiebens/faas-nomad/pkg/handlers"
+	"github.com/jsiebens/faas-nomad/pkg/metrics"
+	"github.com/jsiebens/faas-nomad/pkg/scaling"
 	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/tracing"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 	"github.com/jsiebens/faas-nomad/version"
 	fbootstrap "github.com/openfaas/faas-provider"
+	"github.com/openfaas/faas-provider/auth"
 	ftypes "github.com/openfaas/faas-provider/types"
 )
 
@@ -37,45 +45,249 @@ func main() {
 	log.SetPrefix("")
 	log.SetFlags(0)
 
+	if err := tracing.Setup(config.Tracing, logger); err != nil {
+		log.Fatal(err)
+	}
+
 	secrets, err := services.NewVaultSecrets(config.Vault)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	jobs, err := services.NewNomadJobs(config.Nomad)
+	jobs, err := services.NewNomadJobs(config.Nomad, config.Discovery)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logs, err := services.NewNomadLogs(config.Nomad)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	factory := services.NewJobFactory(config)
 
-	resolver, err := resolver.NewConsulResolver(config, logger)
+	var prometheus *metrics.Prometheus
+	if config.Metrics.Enabled {
+		prometheus = metrics.NewPrometheus(config)
+		jobs = prometheus.InstrumentJobs(jobs)
+		secrets = prometheus.InstrumentSecrets(secrets)
+	}
+
+	functions := services.NewFunctionsCache(config, jobs, 10*time.Second)
+
+	resolver, err := createResolver(config, functions, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if prometheus != nil {
+		resolver = prometheus.InstrumentResolver(resolver, config.Discovery.Provider)
+	}
+
+	outliers := proxy.NewOutlierDetector(config.Proxy)
+	splits := proxy.NewTrafficSplits()
+
+	idleScaler := scaling.NewIdleScaler(config, jobs, logger)
+	idleScaler.Start()
+
+	autoscaler := scaling.NewAutoscaler(config, jobs, logger)
+	autoscaler.Start()
+
+	invocations := metrics.NewInvocationCounter(config.Metrics, logger)
+	if err := invocations.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	observers := []proxy.Observer{idleScaler, autoscaler, invocations}
+	if prometheus != nil {
+		observers = append(observers, prometheus)
+	}
 
 	bootstrapHandlers := ftypes.FaaSHandlers{
-		FunctionProxy:        proxy.NewHandlerFunc(config.FaaS, resolver, logger),
-		FunctionReader:       handlers.MakeFunctionReader(config, jobs, logger),
-		DeployHandler:        handlers.MakeDeployHandler(config, factory, jobs, secrets, logger),
-		DeleteHandler:        handlers.MakeDeleteHandler(config, jobs, logger),
-		ReplicaReader:        handlers.MakeReplicaReader(config, jobs, resolver, logger),
+		FunctionProxy:        proxy.NewHandlerFunc(config, resolver, functions, jobs, secrets, outliers, splits, logger, observers...),
+		FunctionReader:       handlers.MakeFunctionReader(config, jobs, invocations, logger),
+		DeployHandler:        handlers.MakeDeployHandler(config, factory, jobs, functions, resolver, secrets, logger),
+		DeleteHandler:        handlers.MakeDeleteHandler(config, jobs, functions, resolver, splits, logger),
+		ReplicaReader:        handlers.MakeReplicaReader(config, jobs, resolver, autoscaler, invocations, logger),
 		ReplicaUpdater:       handlers.MakeReplicaUpdater(config, jobs, logger),
 		SecretHandler:        handlers.MakeSecretHandler(secrets, logger),
-		LogHandler:           unimplemented,
-		UpdateHandler:        handlers.MakeDeployHandler(config, factory, jobs, secrets, logger),
+		LogHandler:           handlers.MakeLogHandler(config, jobs, logs, logger),
+		UpdateHandler:        handlers.MakeDeployHandler(config, factory, jobs, functions, resolver, secrets, logger),
 		HealthHandler:        handlers.MakeHealthHandler(),
 		InfoHandler:          handlers.MakeInfoHandler(version.BuildVersion(), version.GitCommit),
 		ListNamespaceHandler: handlers.MakeListNamespaceHandler(config),
 	}
 
+	decorators := []handlerDecorator{withWriteTimeout(config.FaaS.WriteTimeout), tracing.InstrumentHandler}
+	if prometheus != nil {
+		decorators = append(decorators, prometheus.InstrumentHandler)
+	}
+
+	router := fbootstrap.Router()
+	registerHandler(router, config, decorators, "outliers", "/system/debug/outliers", handlers.MakeOutlierStatusHandler(outliers)).Methods(http.MethodGet)
+	registerHandler(router, config, decorators, "traffic_split", "/system/traffic-split/{name:["+fbootstrap.NameExpression+"]+}", handlers.MakeTrafficSplitHandler(config, splits, functions, logger)).
+		Methods(http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+
+	if config.Async.Enabled {
+		queue, err := async.NewQueue(config.Async, bootstrapHandlers.FunctionProxy, logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := queue.Start(); err != nil {
+			log.Fatal(err)
+		}
+
+		asyncFunction := handlers.MakeAsyncFunctionHandler(config, queue, functions, logger)
+		router.HandleFunc("/async-function/{name:["+fbootstrap.NameExpression+"]+}", asyncFunction)
+		router.HandleFunc("/async-function/{name:["+fbootstrap.NameExpression+"]+}/", asyncFunction)
+		router.HandleFunc("/async-function/{name:["+fbootstrap.NameExpression+"]+}/{params:.*}", asyncFunction)
+
+		registerHandler(router, config, decorators, "dead_letters", "/system/async/dead-letters", handlers.MakeDeadLetterReader(queue, logger)).Methods(http.MethodGet)
+		registerHandler(router, config, decorators, "dead_letters", "/system/async/dead-letters/{id}", handlers.MakeDeadLetterReader(queue, logger)).Methods(http.MethodGet)
+		registerHandler(router, config, decorators, "delete_dead_letter", "/system/async/dead-letters/{id}", handlers.MakeDeadLetterDeleteHandler(queue, logger)).Methods(http.MethodDelete)
+		registerHandler(router, config, decorators, "replay_dead_letter", "/system/async/dead-letters/{id}/replay", handlers.MakeDeadLetterReplayHandler(queue, logger)).Methods(http.MethodPost)
+	}
+
+	if config.Routing.Port > 0 {
+		routes := routing.NewRoutes(config, jobs, logger)
+		routes.Start()
+
+		registerHandler(router, config, decorators, "routes", "/system/routes", handlers.MakeRoutesHandler(routes)).Methods(http.MethodGet)
+
+		go serveRoutes(config, routing.NewHandler(routes, bootstrapHandlers.FunctionProxy), logger)
+	}
+
+	for _, decorate := range decorators {
+		decorateHandlers(&bootstrapHandlers, decorate)
+	}
+
+	if prometheus != nil {
+		router.Handle("/metrics", prometheus.Handler()).Methods(http.MethodGet)
+	}
+
 	logger.Info(fmt.Sprintf("Listening on TCP port: %d", *config.FaaS.TCPPort))
 
-	fbootstrap.Serve(&bootstrapHandlers, &config.FaaS)
+	// the listener has no write deadline, so the function invocations can be streamed; the proxy bounds the other
+	// invocations by the write timeout and the provider API handlers are wrapped by withWriteTimeout
+	faasConfig := config.FaaS
+	faasConfig.WriteTimeout = 0
+
+	fbootstrap.Serve(&bootstrapHandlers, &faasConfig)
+}
+
+// handlerDecorator wraps a provider API handler, e.g. to record metrics or traces.
+type handlerDecorator func(name string, handler http.HandlerFunc) http.HandlerFunc
+
+// withWriteTimeout bounds the provider API handlers by the write timeout, the listener having no write deadline.
+// The log handler bounds the log streams itself.
+func withWriteTimeout(timeout time.Duration) handlerDecorator {
+	return func(name string, handler http.HandlerFunc) http.HandlerFunc {
+		if timeout <= 0 || name == "logs" {
+			return handler
+		}
+		return http.TimeoutHandler(handler, timeout, "Timeout handling the request.").ServeHTTP
+	}
+}
+
+// registerHandler adds an additional handler to the provider API, wrapped by the decorators like the
+// provider API handlers and protected with basic auth when enabled.
+func registerHandler(router *mux.Router, config *types.ProviderConfig, decorators []handlerDecorator, name string, path string, handler http.HandlerFunc) *mux.Route {
+	for _, decorate := range decorators {
+		handler = decorate(name, handler)
+	}
+
+	if config.FaaS.EnableBasicAuth {
+		reader := auth.ReadBasicAuthFromDisk{
+			SecretMountPath: config.FaaS.SecretMountPath,
+		}
+
+		credentials, err := reader.Read()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		handler = auth.DecorateWithBasicAuth(handler, credentials)
+	}
+
+	return router.HandleFunc(path, handler)
 }
 
-func unimplemented(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
+// serveRoutes starts the additional listener dispatching the requests for the custom hostnames and path prefixes of the functions.
+// Like the provider API, the listener has no write timeout, so streamed responses are only bound by the idle timeout of
+// the proxy, the other responses being bound by the write timeout in the proxy.
+func serveRoutes(config *types.ProviderConfig, handler http.Handler, logger hclog.Logger) {
+	s := &http.Server{
+		Addr:           fmt.Sprintf(":%d", config.Routing.Port),
+		Handler:        handler,
+		ReadTimeout:    config.FaaS.ReadTimeout,
+		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
+	}
+
+	logger.Info(fmt.Sprintf("Routing functions on TCP port: %d", config.Routing.Port))
+
+	log.Fatal(s.ListenAndServe())
+}
+
+// decorateHandlers wraps the provider API handlers, e.g. to record metrics or traces.
+func decorateHandlers(h *ftypes.FaaSHandlers, decorate handlerDecorator) {
+	h.FunctionReader = decorate("function_reader", h.FunctionReader)
+	h.DeployHandler = decorate("deploy", h.DeployHandler)
+	h.DeleteHandler = decorate("delete", h.DeleteHandler)
+	h.ReplicaReader = decorate("replica_reader", h.ReplicaReader)
+	h.ReplicaUpdater = decorate("replica_updater", h.ReplicaUpdater)
+	h.SecretHandler = decorate("secrets", h.SecretHandler)
+	h.LogHandler = decorate("logs", h.LogHandler)
+	h.UpdateHandler = decorate("update", h.UpdateHandler)
+	h.HealthHandler = decorate("health", h.HealthHandler)
+	h.InfoHandler = decorate("info", h.InfoHandler)
+	h.ListNamespaceHandler = decorate("list_namespaces", h.ListNamespaceHandler)
+}
+
+// createResolver creates the resolver of the configured service discovery provider, and defaults the
+// locality of the provider to the one of the local agent.
+func createResolver(config *types.ProviderConfig, functions services.Functions, logger hclog.Logger) (resolver.ServiceResolver, error) {
+	switch config.Discovery.Provider {
+	case types.DiscoveryConsul:
+		consulResolver, err := resolver.NewConsulResolver(config, functionAnnotations(functions), logger)
+		if err != nil {
+			return nil, err
+		}
+		configureLocality(config, consulResolver.Local())
+		return consulResolver, nil
+	case types.DiscoveryNomad:
+		nomadResolver, err := resolver.NewNomadResolver(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		configureLocality(config, nomadResolver.Local())
+		return nomadResolver, nil
+	case types.DiscoveryFile:
+		return resolver.NewFileResolver(config, logger)
+	default:
+		return nil, fmt.Errorf("unsupported service discovery provider: %s", config.Discovery.Provider)
+	}
+}
+
+// functionAnnotations reads the annotations of the functions from their deployment details.
+func functionAnnotations(functions services.Functions) resolver.Annotations {
+	return func(functionName string) (map[string]string, error) {
+		status, err := functions.Get(functionName)
+		if err != nil || status.Annotations == nil {
+			return nil, err
+		}
+		return *status.Annotations, nil
+	}
+}
+
+// configureLocality defaults the datacenter and zone of the provider to the ones of the local agent. The endpoints
+// report the Nomad datacenter of the function instances, so the Nomad datacenter of the provider is preferred when
+// it runs as a Nomad job.
+func configureLocality(config *types.ProviderConfig, local resolver.Endpoint) {
+	if config.Proxy.LocalityDatacenter == "" {
+		config.Proxy.LocalityDatacenter = ftypes.ParseString(os.Getenv("NOMAD_DC"), local.Datacenter)
+	}
+	if config.Proxy.LocalityZone == "" {
+		config.Proxy.LocalityZone = local.NodeMeta[config.Proxy.LocalityZoneKey]
+	}
 }
 
 func setupLogging(config types.LogConfig) hclog.Logger {
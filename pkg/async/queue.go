@@ -0,0 +1,394 @@
+// Package async provides asynchronous function invocations without an external message broker.
+//
+// Invocations accepted on `/async-function/` are persisted in a bolt database on the local disk,
+// and dispatched through the function proxy by a pool of workers per function. Failed invocations
+// are retried with an exponential backoff, and moved to the dead letters once all attempts are used.
+// The invocations are delivered at least once: a request interrupted by a restart is sent again.
+package async
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	CallbackURLHeader = "X-Callback-Url"
+	CallIDHeader      = "X-Call-Id"
+
+	// the response body recorded on a failed attempt is truncated to this size
+	maxErrorLength = 1024
+)
+
+type Queue struct {
+	config types.AsyncConfig
+	store  *Store
+	invoke http.Handler
+	client *http.Client
+	log    hclog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	pools map[string]*workerPool
+}
+
+// NewQueue opens the queue stored in the configured file. The invocations are sent to the given
+// function proxy handler.
+func NewQueue(config types.AsyncConfig, invoke http.Handler, logger hclog.Logger) (*Queue, error) {
+	store, err := OpenStore(config.File)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Queue{
+		config: config,
+		store:  store,
+		invoke: invoke,
+		client: &http.Client{Timeout: config.CallbackTimeout},
+		log:    logger.Named("async"),
+		ctx:    ctx,
+		cancel: cancel,
+		pools:  map[string]*workerPool{},
+	}, nil
+}
+
+// Start schedules the pending invocations left behind by a previous run.
+func (q *Queue) Start() error {
+	pending, err := q.store.Pending()
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		q.log.Info("Resuming pending invocations", "count", len(pending))
+	}
+
+	for _, m := range pending {
+		q.schedule(m)
+	}
+
+	return nil
+}
+
+// Stop waits for the running invocations to return and closes the store. Pending invocations
+// are resumed on the next start.
+func (q *Queue) Stop() error {
+	q.cancel()
+	q.wg.Wait()
+	return q.store.Close()
+}
+
+// Enqueue persists a new invocation and schedules it.
+func (q *Queue) Enqueue(m *Message) error {
+	m.QueuedAt = time.Now()
+	if err := q.store.Add(m); err != nil {
+		return err
+	}
+	q.schedule(*m)
+	return nil
+}
+
+// DeadLetters returns the invocations which failed all their attempts, optionally only for one function.
+func (q *Queue) DeadLetters(function string) ([]Message, error) {
+	messages, err := q.store.DeadLetters()
+	if err != nil || function == "" {
+		return messages, err
+	}
+
+	result := []Message{}
+	for _, m := range messages {
+		if m.Function == function {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func (q *Queue) DeadLetter(id string) (*Message, error) {
+	return q.store.DeadLetter(id)
+}
+
+// Replay schedules a dead letter again, with a fresh set of attempts.
+func (q *Queue) Replay(id string) (*Message, error) {
+	m, err := q.store.Revive(id)
+	if err != nil {
+		return nil, err
+	}
+	q.schedule(*m)
+	return m, nil
+}
+
+func (q *Queue) Discard(id string) error {
+	return q.store.Discard(id)
+}
+
+// schedule hands the message over to the workers of the function, once its next attempt is due.
+func (q *Queue) schedule(m Message) {
+	pool := q.pool(m.Function)
+
+	if delay := time.Until(m.NextAttempt); delay > 0 {
+		time.AfterFunc(delay, func() { pool.push(m.ID) })
+		return
+	}
+
+	pool.push(m.ID)
+}
+
+// pool returns the workers of the function, starting them on first use.
+func (q *Queue) pool(function string) *workerPool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pool, ok := q.pools[function]
+	if ok {
+		return pool
+	}
+
+	pool = &workerPool{notify: make(chan struct{}, 1)}
+	q.pools[function] = pool
+
+	workers := q.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.wg.Done()
+			for {
+				id, ok := pool.pop()
+				if !ok {
+					select {
+					case <-pool.notify:
+						continue
+					case <-q.ctx.Done():
+						return
+					}
+				}
+				q.process(id)
+			}
+		}()
+	}
+
+	return pool
+}
+
+// process sends one attempt of the invocation to the function proxy, and either retries it later,
+// moves it to the dead letters or completes it. The outcome of a completed or dead invocation is
+// posted to its callback URL.
+func (q *Queue) process(id string) {
+	m, err := q.store.Get(id)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		q.log.Error("Error reading invocation", "id", id, "error", err.Error())
+		return
+	}
+
+	start := time.Now()
+	response := q.dispatch(m)
+	duration := time.Since(start)
+
+	if q.ctx.Err() != nil {
+		// interrupted by a shutdown, the attempt is not counted
+		return
+	}
+
+	m.Attempts++
+
+	if retryable(response.status()) {
+		m.LastStatus = response.status()
+		m.LastError = truncate(response.body.String(), maxErrorLength)
+
+		if m.Attempts < q.config.MaxAttempts {
+			m.NextAttempt = time.Now().Add(q.backoff(m.Attempts))
+			if err := q.store.Update(m); err != nil {
+				q.log.Error("Error recording failed invocation", "function", m.Function, "id", m.ID, "error", err.Error())
+			}
+			q.log.Debug("Invocation failed, retrying", "function", m.Function, "id", m.ID, "status", m.LastStatus, "attempts", m.Attempts, "next_attempt", m.NextAttempt)
+			q.schedule(*m)
+			return
+		}
+
+		if err := q.store.Bury(m); err != nil {
+			q.log.Error("Error moving invocation to the dead letters", "function", m.Function, "id", m.ID, "error", err.Error())
+			return
+		}
+		q.log.Warn("Invocation failed, moved to the dead letters", "function", m.Function, "id", m.ID, "status", m.LastStatus, "attempts", m.Attempts)
+	} else {
+		if err := q.store.Remove(m.ID); err != nil {
+			q.log.Error("Error removing completed invocation", "function", m.Function, "id", m.ID, "error", err.Error())
+		}
+		q.log.Trace("Invocation completed", "function", m.Function, "id", m.ID, "status", response.status(), "attempts", m.Attempts)
+	}
+
+	q.callback(m, response, duration)
+}
+
+// dispatch sends the invocation to the function proxy, as if it was received on `/function/`.
+func (q *Queue) dispatch(m *Message) *responseBuffer {
+	path := "/function/" + m.Function
+	if m.Path != "" {
+		path = path + "/" + m.Path
+	}
+
+	req, err := http.NewRequestWithContext(q.ctx, m.Method, (&url.URL{Path: path, RawQuery: m.Query}).String(), bytes.NewReader(m.Body))
+	response := newResponseBuffer()
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		response.body.WriteString(err.Error())
+		return response
+	}
+
+	req.Header = m.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set(CallIDHeader, m.ID)
+	req = mux.SetURLVars(req, map[string]string{"name": m.Function, "params": m.Path})
+
+	q.invoke.ServeHTTP(response, req)
+
+	return response
+}
+
+// callback posts the response of the function to the callback URL of the invocation, if any.
+func (q *Queue) callback(m *Message, response *responseBuffer, duration time.Duration) {
+	if m.CallbackURL == "" {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(q.ctx, http.MethodPost, m.CallbackURL, bytes.NewReader(response.body.Bytes()))
+	if err != nil {
+		q.log.Error("Error creating callback request", "function", m.Function, "id", m.ID, "url", m.CallbackURL, "error", err.Error())
+		return
+	}
+
+	if contentType := response.Header().Get("Content-Type"); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(CallIDHeader, m.ID)
+	req.Header.Set("X-Function-Name", m.Function)
+	req.Header.Set("X-Function-Status", strconv.Itoa(response.status()))
+	req.Header.Set("X-Duration-Seconds", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64))
+
+	res, err := q.client.Do(req)
+	if err != nil {
+		q.log.Error("Error posting callback", "function", m.Function, "id", m.ID, "url", m.CallbackURL, "error", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		q.log.Warn("Callback rejected", "function", m.Function, "id", m.ID, "url", m.CallbackURL, "status", res.StatusCode)
+	}
+}
+
+// backoff returns the delay before the next attempt, doubling with every attempt up to the configured maximum.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.config.RetryBackoff << uint(attempts-1)
+	if delay <= 0 || (q.config.MaxRetryBackoff > 0 && delay > q.config.MaxRetryBackoff) {
+		return q.config.MaxRetryBackoff
+	}
+	return delay
+}
+
+// retryable reports whether a failed invocation may succeed later, e.g. once the function is scaled up.
+func retryable(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+// workerPool holds the ready invocations of a function, in arrival order.
+type workerPool struct {
+	mu     sync.Mutex
+	ready  []string
+	notify chan struct{}
+}
+
+func (p *workerPool) push(id string) {
+	p.mu.Lock()
+	p.ready = append(p.ready, id)
+	p.mu.Unlock()
+	p.wake()
+}
+
+func (p *workerPool) pop() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.ready) == 0 {
+		return "", false
+	}
+
+	id := p.ready[0]
+	p.ready = p.ready[1:]
+	if len(p.ready) > 0 {
+		// more work is waiting, let another idle worker pick it up
+		p.wake()
+	}
+	return id, true
+}
+
+func (p *workerPool) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// responseBuffer keeps the response written by the function proxy in memory.
+type responseBuffer struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}}
+}
+
+func (r *responseBuffer) Header() http.Header {
+	return r.header
+}
+
+func (r *responseBuffer) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
+
+func (r *responseBuffer) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseBuffer) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+	return r.statusCode
+}
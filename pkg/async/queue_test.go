@@ -0,0 +1,190 @@
+package async
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type callback struct {
+	header http.Header
+	body   string
+}
+
+func setupCallbackServer() (*httptest.Server, chan callback) {
+	callbacks := make(chan callback, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		callbacks <- callback{header: r.Header, body: string(body)}
+	}))
+	return server, callbacks
+}
+
+func setupQueue(t *testing.T, file string, invoke http.HandlerFunc) *Queue {
+	config := types.AsyncConfig{
+		File:            file,
+		Workers:         2,
+		MaxAttempts:     3,
+		RetryBackoff:    time.Millisecond,
+		MaxRetryBackoff: 10 * time.Millisecond,
+		CallbackTimeout: time.Second,
+	}
+
+	queue, err := NewQueue(config, invoke, hclog.NewNullLogger())
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Start())
+
+	return queue
+}
+
+func TestQueueDispatchesInvocationAndPostsCallback(t *testing.T) {
+	server, callbacks := setupCallbackServer()
+	defer server.Close()
+
+	queue := setupQueue(t, filepath.Join(t.TempDir(), "queue.db"), func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(mux.Vars(r)["name"] + ":" + mux.Vars(r)["params"] + ":" + r.URL.RawQuery + ":" + string(body)))
+	})
+	defer queue.Stop()
+
+	message := &Message{Function: "echo", Method: http.MethodPost, Path: "sub", Query: "a=b", Body: []byte("hello"), CallbackURL: server.URL}
+	assert.NoError(t, queue.Enqueue(message))
+
+	select {
+	case c := <-callbacks:
+		assert.Equal(t, "echo:sub:a=b:hello", c.body)
+		assert.Equal(t, message.ID, c.header.Get(CallIDHeader))
+		assert.Equal(t, "echo", c.header.Get("X-Function-Name"))
+		assert.Equal(t, "201", c.header.Get("X-Function-Status"))
+		assert.Equal(t, "text/plain", c.header.Get("Content-Type"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not received")
+	}
+
+	assert.Eventually(t, func() bool {
+		pending, _ := queue.store.Pending()
+		return len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueMovesFailingInvocationToDeadLettersAndReplaysIt(t *testing.T) {
+	server, callbacks := setupCallbackServer()
+	defer server.Close()
+
+	var healthy int32
+	var attempts int32
+	queue := setupQueue(t, filepath.Join(t.TempDir(), "queue.db"), func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("No endpoints available"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	defer queue.Stop()
+
+	message := &Message{Function: "echo", Method: http.MethodPost, CallbackURL: server.URL}
+	assert.NoError(t, queue.Enqueue(message))
+
+	c := <-callbacks
+	assert.Equal(t, "503", c.header.Get("X-Function-Status"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	dead, err := queue.DeadLetters("echo")
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, message.ID, dead[0].ID)
+		assert.Equal(t, 3, dead[0].Attempts)
+		assert.Equal(t, http.StatusServiceUnavailable, dead[0].LastStatus)
+		assert.Equal(t, "No endpoints available", dead[0].LastError)
+	}
+
+	dead, _ = queue.DeadLetters("other")
+	assert.Empty(t, dead)
+
+	atomic.StoreInt32(&healthy, 1)
+	_, err = queue.Replay(message.ID)
+	assert.NoError(t, err)
+
+	c = <-callbacks
+	assert.Equal(t, "200", c.header.Get("X-Function-Status"))
+
+	dead, _ = queue.DeadLetters("")
+	assert.Empty(t, dead)
+
+	_, err = queue.Replay(message.ID)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestQueueDoesNotRetryClientErrors(t *testing.T) {
+	var attempts int32
+	done := make(chan struct{})
+	queue := setupQueue(t, filepath.Join(t.TempDir(), "queue.db"), func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		close(done)
+	})
+	defer queue.Stop()
+
+	assert.NoError(t, queue.Enqueue(&Message{Function: "echo", Method: http.MethodPost}))
+	<-done
+
+	assert.Eventually(t, func() bool {
+		pending, _ := queue.store.Pending()
+		return len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	dead, _ := queue.DeadLetters("")
+	assert.Empty(t, dead)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestQueueResumesPendingInvocationsAfterRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queue.db")
+
+	store, err := OpenStore(file)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Add(&Message{Function: "echo", Method: http.MethodGet}))
+	assert.NoError(t, store.Add(&Message{Function: "echo", Method: http.MethodGet}))
+	assert.NoError(t, store.Close())
+
+	var mu sync.Mutex
+	var received []string
+	queue := setupQueue(t, file, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.Header.Get(CallIDHeader))
+	})
+	defer queue.Stop()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.ElementsMatch(t, []string{"0000000000000001", "0000000000000002"}, received)
+}
+
+func TestQueueBackoffIsCapped(t *testing.T) {
+	queue := &Queue{config: types.AsyncConfig{RetryBackoff: time.Second, MaxRetryBackoff: 5 * time.Second}}
+
+	assert.Equal(t, time.Second, queue.backoff(1))
+	assert.Equal(t, 2*time.Second, queue.backoff(2))
+	assert.Equal(t, 4*time.Second, queue.backoff(3))
+	assert.Equal(t, 5*time.Second, queue.backoff(4))
+	assert.Equal(t, 5*time.Second, queue.backoff(100))
+}
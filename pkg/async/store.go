@@ -0,0 +1,221 @@
+package async
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	pendingBucket    = []byte("pending")
+	deadLetterBucket = []byte("dead_letters")
+
+	ErrNotFound = errors.New("message not found")
+)
+
+// Message is an asynchronous invocation of a function, as accepted on `/async-function/`.
+type Message struct {
+	ID          string      `json:"id"`
+	Function    string      `json:"function"`
+	Method      string      `json:"method"`
+	Path        string      `json:"path,omitempty"`
+	Query       string      `json:"query,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	CallbackURL string      `json:"callbackUrl,omitempty"`
+	// Credentials names the headers holding the credentials of the caller, needed to invoke the function but
+	// kept out of the dead letters returned by the API.
+	Credentials []string `json:"credentials,omitempty"`
+
+	QueuedAt    time.Time `json:"queuedAt"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	LastStatus  int       `json:"lastStatus,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// WithoutCredentials returns a copy of the message without the headers holding the credentials of the caller.
+func (m Message) WithoutCredentials() Message {
+	m.Header = m.Header.Clone()
+	for _, name := range m.Credentials {
+		m.Header.Del(name)
+	}
+	return m
+}
+
+// Store persists the pending messages and the dead letters in a bolt database on the local disk,
+// so they survive a restart of the provider.
+//
+// The messages are stored as they were received, including the credentials of the callers needed to retry
+// and replay the invocations, so the file is only readable by the user of the provider.
+type Store struct {
+	db *bolt.DB
+}
+
+func OpenStore(file string) (*Store, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{pendingBucket, deadLetterBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add stores a new pending message, and assigns it an ID. The IDs are increasing, so the pending
+// messages are listed in arrival order.
+func (s *Store) Add(m *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		m.ID = fmt.Sprintf("%016x", seq)
+		return put(b, m)
+	})
+}
+
+// Update replaces a pending message, e.g. to record a failed attempt.
+func (s *Store) Update(m *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(pendingBucket), m)
+	})
+}
+
+// Get returns a pending message.
+func (s *Store) Get(id string) (*Message, error) {
+	return s.get(pendingBucket, id)
+}
+
+// Remove deletes a pending message once it is processed.
+func (s *Store) Remove(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).Delete([]byte(id))
+	})
+}
+
+// Pending returns all the pending messages, in arrival order.
+func (s *Store) Pending() ([]Message, error) {
+	return s.list(pendingBucket)
+}
+
+// Bury moves a pending message to the dead letters.
+func (s *Store) Bury(m *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(pendingBucket).Delete([]byte(m.ID)); err != nil {
+			return err
+		}
+		return put(tx.Bucket(deadLetterBucket), m)
+	})
+}
+
+// DeadLetters returns all the dead letters.
+func (s *Store) DeadLetters() ([]Message, error) {
+	return s.list(deadLetterBucket)
+}
+
+// DeadLetter returns a single dead letter.
+func (s *Store) DeadLetter(id string) (*Message, error) {
+	return s.get(deadLetterBucket, id)
+}
+
+// Revive moves a dead letter back to the pending messages, with a fresh set of attempts.
+func (s *Store) Revive(id string) (*Message, error) {
+	var m *Message
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadLetterBucket)
+
+		var err error
+		m, err = decode(dead.Get([]byte(id)))
+		if err != nil {
+			return err
+		}
+
+		m.Attempts = 0
+		m.NextAttempt = time.Time{}
+		m.LastStatus = 0
+		m.LastError = ""
+
+		if err := dead.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return put(tx.Bucket(pendingBucket), m)
+	})
+	return m, err
+}
+
+// Discard deletes a dead letter.
+func (s *Store) Discard(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLetterBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (s *Store) get(bucket []byte, id string) (*Message, error) {
+	var m *Message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = decode(tx.Bucket(bucket).Get([]byte(id)))
+		return err
+	})
+	return m, err
+}
+
+func (s *Store) list(bucket []byte) ([]Message, error) {
+	result := []Message{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			m, err := decode(v)
+			if err != nil {
+				return err
+			}
+			result = append(result, *m)
+			return nil
+		})
+	})
+	return result, err
+}
+
+func put(b *bolt.Bucket, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(m.ID), data)
+}
+
+func decode(data []byte) (*Message, error) {
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	m := &Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/async"
+	"github.com/jsiebens/faas-nomad/pkg/proxy"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+// MakeAsyncFunctionHandler accepts the invocations on `/async-function/`, and stores them in the queue.
+// The caller receives the ID of the invocation in the X-Call-Id header, and the result is posted
+// to the URL in the X-Callback-Url header, if any.
+func MakeAsyncFunctionHandler(config *types.ProviderConfig, queue *async.Queue, functions services.Functions, logger hclog.Logger) http.HandlerFunc {
+	log := logger.Named("async_function")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		functionName := strings.TrimSuffix(vars["name"], "."+config.Scheduling.Namespace)
+
+		fn, err := functions.Get(functionName)
+		if fn == nil || err != nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("function %s not found", functionName))
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			defer r.Body.Close()
+
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, config.Async.MaxBodySize+1))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if int64(len(body)) > config.Async.MaxBodySize {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", config.Async.MaxBodySize))
+				return
+			}
+		}
+
+		header := r.Header.Clone()
+		if header.Get("X-Forwarded-For") == "" {
+			header.Set("X-Forwarded-For", r.RemoteAddr)
+		}
+		if header.Get("X-Forwarded-Host") == "" && r.Host != "" {
+			header.Set("X-Forwarded-Host", r.Host)
+		}
+
+		message := &async.Message{
+			Function:    functionName,
+			Method:      r.Method,
+			Path:        vars["params"],
+			Query:       r.URL.RawQuery,
+			Header:      header,
+			Body:        body,
+			CallbackURL: r.Header.Get(async.CallbackURLHeader),
+			Credentials: proxy.CredentialHeaders(fn),
+		}
+
+		if err := queue.Enqueue(message); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			log.Error("Error queueing invocation", "function", functionName, "error", err.Error())
+			return
+		}
+
+		w.Header().Set(async.CallIDHeader, message.ID)
+		w.WriteHeader(http.StatusAccepted)
+
+		log.Trace("Invocation queued", "function", functionName, "id", message.ID)
+	}
+}
+
+// MakeDeadLetterReader lists the invocations which failed all their attempts, optionally filtered
+// with the `function` query parameter, or returns a single one by its ID. The headers holding the
+// credentials of the callers are left out.
+func MakeDeadLetterReader(queue *async.Queue, logger hclog.Logger) http.HandlerFunc {
+	log := logger.Named("dead_letter_reader")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		var err error
+
+		if id, ok := mux.Vars(r)["id"]; ok {
+			var message *async.Message
+			if message, err = queue.DeadLetter(id); err == nil {
+				result = message.WithoutCredentials()
+			}
+		} else {
+			var messages []async.Message
+			if messages, err = queue.DeadLetters(r.URL.Query().Get("function")); err == nil {
+				for i := range messages {
+					messages[i] = messages[i].WithoutCredentials()
+				}
+				result = messages
+			}
+		}
+
+		if err == async.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			log.Error("Error reading dead letters", "error", err.Error())
+			return
+		}
+
+		jsonOut, err := json.Marshal(result)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set(HeaderContentType, TypeApplicationJson)
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonOut)
+	}
+}
+
+// MakeDeadLetterReplayHandler queues a dead letter again, with a fresh set of attempts.
+func MakeDeadLetterReplayHandler(queue *async.Queue, logger hclog.Logger) http.HandlerFunc {
+	log := logger.Named("dead_letter_replay")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		message, err := queue.Replay(id)
+		if err == async.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			log.Error("Error replaying dead letter", "id", id, "error", err.Error())
+			return
+		}
+
+		w.Header().Set(async.CallIDHeader, message.ID)
+		w.WriteHeader(http.StatusAccepted)
+
+		log.Info("Dead letter replayed", "function", message.Function, "id", message.ID)
+	}
+}
+
+// MakeDeadLetterDeleteHandler discards a dead letter.
+func MakeDeadLetterDeleteHandler(queue *async.Queue, logger hclog.Logger) http.HandlerFunc {
+	log := logger.Named("dead_letter_delete")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		err := queue.Discard(id)
+		if err == async.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			log.Error("Error discarding dead letter", "id", id, "error", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
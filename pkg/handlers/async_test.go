@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/async"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAsyncFunctionHandler(t *testing.T, invoked chan *http.Request) (*services.MockFunctions, *async.Queue, http.HandlerFunc) {
+	config, _ := types.DefaultConfig()
+	config.Async.File = filepath.Join(t.TempDir(), "queue.db")
+	config.Async.MaxBodySize = 16
+
+	queue, err := async.NewQueue(config.Async, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoked <- r
+	}), hclog.NewNullLogger())
+	assert.NoError(t, err)
+	t.Cleanup(func() { queue.Stop() })
+
+	functions := &services.MockFunctions{}
+
+	return functions, queue, MakeAsyncFunctionHandler(config, queue, functions, hclog.NewNullLogger())
+}
+
+func TestAsyncFunctionHandlerQueuesInvocation(t *testing.T) {
+	invoked := make(chan *http.Request, 1)
+	functions, _, handler := setupAsyncFunctionHandler(t, invoked)
+	functions.On("Get", "echo").Return(&ftypes.FunctionStatus{Name: "echo"}, nil)
+
+	request := httptest.NewRequest(http.MethodPost, "/async-function/echo.default/sub?a=b", bytes.NewBufferString("hello"))
+	request.Header.Set("X-Callback-Url", "http://localhost:9999/callback")
+	request = mux.SetURLVars(request, map[string]string{"name": "echo.default", "params": "sub"})
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("X-Call-Id"))
+
+	r := <-invoked
+	assert.Equal(t, "echo", mux.Vars(r)["name"])
+	assert.Equal(t, "sub", mux.Vars(r)["params"])
+	assert.Equal(t, "a=b", r.URL.RawQuery)
+	assert.Equal(t, recorder.Header().Get("X-Call-Id"), r.Header.Get("X-Call-Id"))
+	assert.Equal(t, "192.0.2.1:1234", r.Header.Get("X-Forwarded-For"))
+}
+
+func TestAsyncFunctionHandlerReportsNotFoundForUnknownFunction(t *testing.T) {
+	functions, _, handler := setupAsyncFunctionHandler(t, make(chan *http.Request, 1))
+	functions.On("Get", "unknown").Return(nil, fmt.Errorf("job not found"))
+
+	request := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/async-function/unknown", nil), map[string]string{"name": "unknown"})
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAsyncFunctionHandlerRejectsLargeBodies(t *testing.T) {
+	functions, _, handler := setupAsyncFunctionHandler(t, make(chan *http.Request, 1))
+	functions.On("Get", "echo").Return(&ftypes.FunctionStatus{Name: "echo"}, nil)
+
+	request := httptest.NewRequest(http.MethodPost, "/async-function/echo", bytes.NewBufferString("this body is too large"))
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+}
+
+func TestDeadLetterHandlersReportNotFound(t *testing.T) {
+	_, queue, _ := setupAsyncFunctionHandler(t, make(chan *http.Request, 1))
+	vars := map[string]string{"id": "0000000000000001"}
+
+	recorder := httptest.NewRecorder()
+	MakeDeadLetterReader(queue, hclog.NewNullLogger())(recorder, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/system/async/dead-letters/1", nil), vars))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	MakeDeadLetterReplayHandler(queue, hclog.NewNullLogger())(recorder, mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/system/async/dead-letters/1/replay", nil), vars))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	MakeDeadLetterDeleteHandler(queue, hclog.NewNullLogger())(recorder, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/system/async/dead-letters/1", nil), vars))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestDeadLetterReaderListsDeadLetters(t *testing.T) {
+	_, queue, _ := setupAsyncFunctionHandler(t, make(chan *http.Request, 1))
+
+	recorder := httptest.NewRecorder()
+	MakeDeadLetterReader(queue, hclog.NewNullLogger())(recorder, httptest.NewRequest(http.MethodGet, "/system/async/dead-letters?function=echo", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var messages []async.Message
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+	assert.Empty(t, messages)
+}
+
+func TestDeadLetterReaderLeavesOutCredentials(t *testing.T) {
+	config, _ := types.DefaultConfig()
+	config.Async.File = filepath.Join(t.TempDir(), "queue.db")
+	config.Async.MaxAttempts = 1
+
+	queue, err := async.NewQueue(config.Async, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}), hclog.NewNullLogger())
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Start())
+	t.Cleanup(func() { queue.Stop() })
+
+	functions := &services.MockFunctions{}
+	functions.On("Get", "echo").Return(&ftypes.FunctionStatus{Name: "echo", Annotations: &map[string]string{"com.openfaas.auth.api_key.header": "X-Token"}}, nil)
+
+	request := httptest.NewRequest(http.MethodPost, "/async-function/echo", nil)
+	request.Header.Set("Authorization", "Bearer token")
+	request.Header.Set("X-Token", "key")
+	request.Header.Set("X-Request-Id", "1")
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+	recorder := httptest.NewRecorder()
+
+	MakeAsyncFunctionHandler(config, queue, functions, hclog.NewNullLogger())(recorder, request)
+	id := recorder.Header().Get("X-Call-Id")
+
+	assert.Eventually(t, func() bool {
+		_, err := queue.DeadLetter(id)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	recorder = httptest.NewRecorder()
+	MakeDeadLetterReader(queue, hclog.NewNullLogger())(recorder, httptest.NewRequest(http.MethodGet, "/system/async/dead-letters", nil))
+
+	var messages []async.Message
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &messages))
+	assert.Len(t, messages, 1)
+	assert.Empty(t, messages[0].Header.Get("Authorization"))
+	assert.Empty(t, messages[0].Header.Get("X-Token"))
+	assert.Equal(t, "1", messages[0].Header.Get("X-Request-Id"))
+
+	recorder = httptest.NewRecorder()
+	MakeDeadLetterReader(queue, hclog.NewNullLogger())(recorder, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/system/async/dead-letters/"+id, nil), map[string]string{"id": id}))
+
+	var message async.Message
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &message))
+	assert.Empty(t, message.Header.Get("Authorization"))
+
+	// the credentials are kept to replay the invocation
+	stored, _ := queue.DeadLetter(id)
+	assert.Equal(t, "Bearer token", stored.Header.Get("Authorization"))
+}
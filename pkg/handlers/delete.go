@@ -8,12 +8,14 @@ import (
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/proxy"
+	"github.com/jsiebens/faas-nomad/pkg/resolver"
 	"github.com/jsiebens/faas-nomad/pkg/services"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 	ftypes "github.com/openfaas/faas-provider/types"
 )
 
-func MakeDeleteHandler(config *types.ProviderConfig, jobs services.Jobs, logger hclog.Logger) func(w http.ResponseWriter, r *http.Request) {
+func MakeDeleteHandler(config *types.ProviderConfig, jobs services.Jobs, functions services.Functions, resolver resolver.ServiceResolver, splits *proxy.TrafficSplits, logger hclog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	log := logger.Named("delete_handler")
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -37,6 +39,10 @@ func MakeDeleteHandler(config *types.ProviderConfig, jobs services.Jobs, logger
 			return
 		}
 
+		functions.Invalidate(req.FunctionName)
+		resolver.Unwatch(req.FunctionName)
+		splits.Forget(req.FunctionName)
+
 		log.Debug("Function deregistered successfully", "function", jobName, "namespace", namespace)
 		w.WriteHeader(http.StatusOK)
 	}
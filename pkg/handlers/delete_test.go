@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/proxy"
 	"github.com/jsiebens/faas-nomad/pkg/services"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 	ftypes "github.com/openfaas/faas-provider/types"
@@ -26,7 +27,12 @@ func setupDeleteHandler(body []byte) (*services.MockJobs, http.HandlerFunc, *htt
 		JobPrefix: "faas-fn-",
 	}}
 
-	handler := MakeDeleteHandler(config, jobs, hclog.Default())
+	functions := &services.MockFunctions{}
+	functions.On("Invalidate", mock.Anything)
+	resolver := &services.MockResolver{}
+	resolver.On("Unwatch", mock.Anything)
+
+	handler := MakeDeleteHandler(config, jobs, functions, resolver, proxy.NewTrafficSplits(), hclog.Default())
 
 	return jobs, handler, request, response
 }
@@ -66,3 +72,54 @@ func TestDeleteHandlerDeregisterJob(t *testing.T) {
 	assert.Equal(t, http.StatusOK, recorder.Code)
 	jobs.AssertCalled(t, "Deregister", "faas-fn-func123", mock.Anything, mock.Anything)
 }
+
+func TestDeleteHandlerUnwatchesFunctionService(t *testing.T) {
+	req := ftypes.DeleteFunctionRequest{}
+	req.FunctionName = "func123"
+	data, _ := json.Marshal(req)
+
+	jobs := &services.MockJobs{}
+	functions := &services.MockFunctions{}
+	resolver := &services.MockResolver{}
+	config := &types.ProviderConfig{Scheduling: types.SchedulingConfig{JobPrefix: "faas-fn-"}}
+
+	jobs.On("Deregister", "faas-fn-func123", mock.Anything, mock.Anything).Return(nil, nil, nil)
+	functions.On("Invalidate", "func123")
+	resolver.On("Unwatch", "func123")
+
+	handler := MakeDeleteHandler(config, jobs, functions, resolver, proxy.NewTrafficSplits(), hclog.Default())
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("DELETE", "/system/functions", bytes.NewReader(data)))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	resolver.AssertCalled(t, "Unwatch", "func123")
+}
+
+func TestDeleteHandlerResetsTrafficSplit(t *testing.T) {
+	req := ftypes.DeleteFunctionRequest{}
+	req.FunctionName = "func123"
+	data, _ := json.Marshal(req)
+
+	jobs := &services.MockJobs{}
+	functions := &services.MockFunctions{}
+	resolver := &services.MockResolver{}
+	config := &types.ProviderConfig{Scheduling: types.SchedulingConfig{JobPrefix: "faas-fn-"}}
+
+	jobs.On("Deregister", "faas-fn-func123", mock.Anything, mock.Anything).Return(nil, nil, nil)
+	functions.On("Invalidate", "func123")
+	resolver.On("Unwatch", "func123")
+
+	splits := proxy.NewTrafficSplits()
+	assert.NoError(t, splits.Set("func123", map[string]int{"func123-v2": 50}))
+	assert.NoError(t, splits.Set("func000", map[string]int{"func123": 30}))
+
+	handler := MakeDeleteHandler(config, jobs, functions, resolver, splits, hclog.Default())
+	handler(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/system/functions", bytes.NewReader(data)))
+
+	_, ok := splits.Get("func123", nil)
+	assert.False(t, ok)
+
+	weights, _ := splits.Get("func000", nil)
+	assert.Equal(t, map[string]int{"func000": 70}, weights)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/resolver"
 	"github.com/jsiebens/faas-nomad/pkg/services"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 	ftypes "github.com/openfaas/faas-provider/types"
@@ -12,7 +13,7 @@ import (
 	"net/http"
 )
 
-func MakeDeployHandler(config *types.ProviderConfig, jobFactory services.JobFactory, jobs services.Jobs, secrets services.Secrets, logger hclog.Logger) func(w http.ResponseWriter, r *http.Request) {
+func MakeDeployHandler(config *types.ProviderConfig, jobFactory services.JobFactory, jobs services.Jobs, functions services.Functions, resolver resolver.ServiceResolver, secrets services.Secrets, logger hclog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	log := logger.Named("deploy_handler")
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -49,6 +50,9 @@ func MakeDeployHandler(config *types.ProviderConfig, jobFactory services.JobFact
 			return
 		}
 
+		functions.Invalidate(req.Service)
+		resolver.Watch(req.Service)
+
 		log.Debug("Function registered successfully", "function", *job.Name, "namespace", *job.Namespace)
 		w.WriteHeader(http.StatusOK)
 	}
@@ -26,7 +26,12 @@ func setupDeployHandler(body []byte) (*services.MockJobs, http.HandlerFunc, *htt
 
 	config, _ := types.DefaultConfig()
 	factory := services.NewJobFactory(config)
-	handler := MakeDeployHandler(config, factory, jobs, secrets, hclog.Default())
+	functions := &services.MockFunctions{}
+	functions.On("Invalidate", mock.Anything)
+	resolver := &services.MockResolver{}
+	resolver.On("Watch", mock.Anything)
+
+	handler := MakeDeployHandler(config, factory, jobs, functions, resolver, secrets, hclog.Default())
 
 	return jobs, handler, request, response
 }
@@ -74,6 +79,28 @@ func TestDeployHandlerReportsOKWhenJobIsRegistered(t *testing.T) {
 	assert.Equal(t, 1, *count)
 }
 
+func TestDeployHandlerDropsAnnotationsReportedByProvider(t *testing.T) {
+	req := ftypes.FunctionDeployment{}
+	req.Service = "Func123"
+	req.Annotations = &map[string]string{
+		"topic":                                 "orders",
+		"com.openfaas.invocation_count.2xx":     "10",
+		"com.openfaas.scale.autoscaler.desired": "3",
+	}
+	body, _ := json.Marshal(req)
+
+	jobs, deployHandler, request, recorder := setupDeployHandler(body)
+
+	jobs.On("RegisterOpts", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil, nil)
+
+	deployHandler(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	job := jobs.Calls[0].Arguments.Get(0).(*api.Job)
+	assert.Equal(t, map[string]string{"topic": "orders"}, job.Meta)
+}
+
 func TestDeployHandlerWithInitialScaleCount(t *testing.T) {
 	labels := map[string]string{
 		"com.openfaas.scale.min": "3",
@@ -151,3 +178,58 @@ func TestDeployHandlerWithConstraints(t *testing.T) {
 	assert.Equal(t, expectedConstraint1, *constraints[0])
 	assert.Equal(t, expectedConstraint2, *constraints[1])
 }
+
+func TestDeployHandlerInvalidatesFunctionDetails(t *testing.T) {
+	req := ftypes.FunctionDeployment{}
+	req.Service = "Func123"
+	body, _ := json.Marshal(req)
+
+	jobs := &services.MockJobs{}
+	functions := &services.MockFunctions{}
+	resolver := &services.MockResolver{}
+	config, _ := types.DefaultConfig()
+
+	jobs.On("RegisterOpts", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil, nil)
+	functions.On("Invalidate", "Func123")
+	resolver.On("Watch", "Func123")
+
+	handler := MakeDeployHandler(config, services.NewJobFactory(config), jobs, functions, resolver, &services.MockSecrets{}, hclog.Default())
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/system/functions", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	functions.AssertCalled(t, "Invalidate", "Func123")
+	resolver.AssertCalled(t, "Watch", "Func123")
+}
+
+func TestDeployHandlerWithNomadServiceDiscovery(t *testing.T) {
+	req := ftypes.FunctionDeployment{}
+	req.Service = "Func123"
+	body, _ := json.Marshal(req)
+
+	jobs := &services.MockJobs{}
+	functions := &services.MockFunctions{}
+	resolver := &services.MockResolver{}
+	config, _ := types.DefaultConfig()
+	config.Discovery.Provider = types.DiscoveryNomad
+
+	jobs.On("RegisterOpts", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil, nil)
+	functions.On("Invalidate", mock.Anything)
+	resolver.On("Watch", mock.Anything)
+
+	handler := MakeDeployHandler(config, services.NewJobFactory(config), jobs, functions, resolver, &services.MockSecrets{}, hclog.Default())
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/system/functions", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	job := jobs.Calls[0].Arguments.Get(0).(*api.Job)
+	check := job.TaskGroups[0].Services[0].Checks[0]
+
+	assert.Equal(t, "${NOMAD_DC}", job.TaskGroups[0].Services[0].Meta["nomad_datacenter"])
+	assert.Equal(t, "", check.InitialStatus)
+	assert.Equal(t, 0, check.SuccessBeforePassing)
+	assert.Equal(t, 0, check.FailuresBeforeCritical)
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	flogs "github.com/openfaas/faas-provider/logs"
+)
+
+const (
+	// Nomad addresses log files by byte offset, so a tail of n lines is approximated
+	// by reading n * tailLineBytes from the end of each log file.
+	tailLineBytes = 256
+)
+
+var logTypes = []string{"stdout", "stderr"}
+
+func MakeLogHandler(config *types.ProviderConfig, jobs services.Jobs, logs services.Logs, logger hclog.Logger) http.HandlerFunc {
+	requester := &logRequester{
+		config: config,
+		jobs:   jobs,
+		logs:   logs,
+		log:    logger.Named("log_handler"),
+	}
+
+	timeout := config.FaaS.WriteTimeout
+	if timeout <= 0 {
+		timeout = config.FaaS.GetReadTimeout()
+	}
+
+	return flogs.NewLogHandlerFunc(requester, timeout)
+}
+
+type logRequester struct {
+	config *types.ProviderConfig
+	jobs   services.Jobs
+	logs   services.Logs
+	log    hclog.Logger
+}
+
+// Query streams the stdout and stderr logs of every matching allocation of the function.
+// Nomad does not record timestamps for log lines, so messages are stamped when they are received
+// and `since` is applied to whole allocations: allocations that stopped before `since` are skipped.
+func (l *logRequester) Query(ctx context.Context, r flogs.Request) (<-chan flogs.Message, error) {
+	namespace := l.config.Scheduling.Namespace
+	jobID := fmt.Sprintf("%s%s", l.config.Scheduling.JobPrefix, r.Name)
+
+	allocs, _, err := l.jobs.Allocations(jobID, false, &api.QueryOptions{Namespace: namespace})
+	if err != nil {
+		l.log.Error("Error listing allocations", "function", r.Name, "namespace", namespace, "error", err.Error())
+		return nil, err
+	}
+
+	msgs := make(chan flogs.Message, 100)
+	wg := sync.WaitGroup{}
+
+	for _, a := range allocs {
+		if !includeAllocation(a, r) {
+			continue
+		}
+
+		alloc := &api.Allocation{ID: a.ID, NodeID: a.NodeID, Namespace: a.Namespace}
+
+		for _, logType := range logTypes {
+			wg.Add(1)
+			go func(alloc *api.Allocation, logType string) {
+				defer wg.Done()
+				l.stream(ctx, r, alloc, logType, namespace, msgs)
+			}(alloc, logType)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(msgs)
+	}()
+
+	return msgs, nil
+}
+
+func (l *logRequester) stream(ctx context.Context, r flogs.Request, alloc *api.Allocation, logType, namespace string, msgs chan<- flogs.Message) {
+	origin := "start"
+	offset := int64(0)
+	if r.Tail > 0 {
+		origin = "end"
+		offset = int64(r.Tail * tailLineBytes)
+	}
+
+	frames, errors := l.logs.Logs(alloc, r.Follow, r.Name, logType, origin, offset, ctx.Done(), &api.QueryOptions{Namespace: namespace})
+
+	lines := &lineBuffer{skipFirst: r.Tail > 0}
+
+	emit := func(text string) bool {
+		msg := flogs.Message{
+			Name:      r.Name,
+			Namespace: namespace,
+			Instance:  alloc.ID,
+			Timestamp: time.Now(),
+			Text:      text,
+		}
+		select {
+		case msgs <- msg:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errors:
+			if err != nil {
+				l.log.Error("Error streaming logs", "function", r.Name, "allocation", alloc.ID, "type", logType, "error", err.Error())
+			}
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				if rest := lines.flush(); rest != "" {
+					lines.add(rest)
+				}
+				for _, text := range lines.last(r.Tail) {
+					if !emit(text) {
+						return
+					}
+				}
+				return
+			}
+
+			for _, text := range lines.write(frame.Data) {
+				if r.Follow || r.Tail <= 0 {
+					if !emit(text) {
+						return
+					}
+				} else {
+					lines.add(text)
+				}
+			}
+		}
+	}
+}
+
+func includeAllocation(a *api.AllocationListStub, r flogs.Request) bool {
+	if len(r.Instance) != 0 && !strings.HasPrefix(a.ID, r.Instance) {
+		return false
+	}
+
+	switch a.ClientStatus {
+	case "running":
+		return true
+	case "complete", "failed", "lost":
+		if r.Follow {
+			return false
+		}
+		return r.Since == nil || !time.Unix(0, a.ModifyTime).Before(*r.Since)
+	default:
+		return false
+	}
+}
+
+// lineBuffer splits a stream of log frames into lines, keeping incomplete lines until the rest arrives.
+type lineBuffer struct {
+	partial   []byte
+	lines     []string
+	skipFirst bool
+}
+
+func (b *lineBuffer) write(data []byte) []string {
+	var result []string
+
+	b.partial = append(b.partial, data...)
+	for {
+		idx := bytes.IndexByte(b.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(b.partial[:idx]), "\r")
+		b.partial = b.partial[idx+1:]
+
+		// when reading from an offset, the first line is most likely incomplete
+		if b.skipFirst {
+			b.skipFirst = false
+			continue
+		}
+		result = append(result, line)
+	}
+
+	return result
+}
+
+func (b *lineBuffer) flush() string {
+	if b.skipFirst {
+		b.partial = nil
+		return ""
+	}
+	rest := string(b.partial)
+	b.partial = nil
+	return rest
+}
+
+func (b *lineBuffer) add(line string) {
+	b.lines = append(b.lines, line)
+}
+
+func (b *lineBuffer) last(n int) []string {
+	if n > 0 && len(b.lines) > n {
+		return b.lines[len(b.lines)-n:]
+	}
+	return b.lines
+}
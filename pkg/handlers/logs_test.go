@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	flogs "github.com/openfaas/faas-provider/logs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupLogRequester() (*services.MockJobs, *services.MockLogs, *logRequester) {
+	jobs := &services.MockJobs{}
+	logs := &services.MockLogs{}
+
+	config := &types.ProviderConfig{Scheduling: types.SchedulingConfig{
+		JobPrefix: "faas-fn-",
+		Namespace: "default",
+	}}
+
+	requester := &logRequester{config: config, jobs: jobs, logs: logs, log: hclog.NewNullLogger()}
+
+	return jobs, logs, requester
+}
+
+func fakeLogStream(data ...string) chan *api.StreamFrame {
+	frames := make(chan *api.StreamFrame, len(data))
+	for _, d := range data {
+		frames <- &api.StreamFrame{Data: []byte(d)}
+	}
+	close(frames)
+	return frames
+}
+
+func collectMessages(msgs <-chan flogs.Message) []flogs.Message {
+	var result []flogs.Message
+	for m := range msgs {
+		result = append(result, m)
+	}
+	return result
+}
+
+func TestLogRequesterReportsErrorWhenListingAllocationsFails(t *testing.T) {
+	jobs, _, requester := setupLogRequester()
+
+	jobs.On("Allocations", "faas-fn-func123", false, mock.Anything).Return(nil, nil, fmt.Errorf("failure"))
+
+	_, err := requester.Query(context.Background(), flogs.Request{Name: "func123"})
+
+	assert.Error(t, err)
+}
+
+func TestLogRequesterStreamsLinesOfRunningAllocations(t *testing.T) {
+	jobs, logs, requester := setupLogRequester()
+
+	allocs := []*api.AllocationListStub{
+		{ID: "alloc-1", ClientStatus: "running"},
+		{ID: "alloc-2", ClientStatus: "pending"},
+	}
+
+	jobs.On("Allocations", "faas-fn-func123", false, mock.Anything).Return(allocs, nil, nil)
+	logs.On("Logs", mock.Anything, false, "func123", "stdout", "start", int64(0), mock.Anything).Return(fakeLogStream("hello\nwor", "ld\n"), make(chan error))
+	logs.On("Logs", mock.Anything, false, "func123", "stderr", "start", int64(0), mock.Anything).Return(fakeLogStream(), make(chan error))
+
+	msgs, err := requester.Query(context.Background(), flogs.Request{Name: "func123"})
+	assert.NoError(t, err)
+
+	result := collectMessages(msgs)
+
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "hello", result[0].Text)
+	assert.Equal(t, "world", result[1].Text)
+	assert.Equal(t, "func123", result[0].Name)
+	assert.Equal(t, "default", result[0].Namespace)
+	assert.Equal(t, "alloc-1", result[0].Instance)
+	logs.AssertNumberOfCalls(t, "Logs", 2)
+}
+
+func TestLogRequesterFiltersOnInstance(t *testing.T) {
+	jobs, logs, requester := setupLogRequester()
+
+	allocs := []*api.AllocationListStub{
+		{ID: "abc-1", ClientStatus: "running"},
+		{ID: "def-2", ClientStatus: "running"},
+	}
+
+	jobs.On("Allocations", "faas-fn-func123", false, mock.Anything).Return(allocs, nil, nil)
+	logs.On("Logs", mock.MatchedBy(func(a *api.Allocation) bool { return a.ID == "def-2" }), false, "func123", "stdout", mock.Anything, mock.Anything, mock.Anything).Return(fakeLogStream("line\n"), make(chan error))
+	logs.On("Logs", mock.MatchedBy(func(a *api.Allocation) bool { return a.ID == "def-2" }), false, "func123", "stderr", mock.Anything, mock.Anything, mock.Anything).Return(fakeLogStream(), make(chan error))
+
+	msgs, err := requester.Query(context.Background(), flogs.Request{Name: "func123", Instance: "def"})
+	assert.NoError(t, err)
+
+	result := collectMessages(msgs)
+
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "def-2", result[0].Instance)
+	logs.AssertNumberOfCalls(t, "Logs", 2)
+}
+
+func TestLogRequesterReturnsTailOfLogs(t *testing.T) {
+	jobs, logs, requester := setupLogRequester()
+
+	allocs := []*api.AllocationListStub{{ID: "alloc-1", ClientStatus: "running"}}
+
+	jobs.On("Allocations", "faas-fn-func123", false, mock.Anything).Return(allocs, nil, nil)
+	logs.On("Logs", mock.Anything, false, "func123", "stdout", "end", int64(2*tailLineBytes), mock.Anything).Return(fakeLogStream("tial\none\ntwo\nthree\n"), make(chan error))
+	logs.On("Logs", mock.Anything, false, "func123", "stderr", "end", int64(2*tailLineBytes), mock.Anything).Return(fakeLogStream(), make(chan error))
+
+	msgs, err := requester.Query(context.Background(), flogs.Request{Name: "func123", Tail: 2})
+	assert.NoError(t, err)
+
+	result := collectMessages(msgs)
+
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "two", result[0].Text)
+	assert.Equal(t, "three", result[1].Text)
+}
+
+func TestLogRequesterSkipsAllocationsStoppedBeforeSince(t *testing.T) {
+	jobs, logs, requester := setupLogRequester()
+
+	since := time.Now().Add(-1 * time.Hour)
+	allocs := []*api.AllocationListStub{
+		{ID: "old", ClientStatus: "complete", ModifyTime: since.Add(-1 * time.Minute).UnixNano()},
+		{ID: "new", ClientStatus: "complete", ModifyTime: since.Add(1 * time.Minute).UnixNano()},
+	}
+
+	jobs.On("Allocations", "faas-fn-func123", false, mock.Anything).Return(allocs, nil, nil)
+	logs.On("Logs", mock.MatchedBy(func(a *api.Allocation) bool { return a.ID == "new" }), false, "func123", "stdout", mock.Anything, mock.Anything, mock.Anything).Return(fakeLogStream("line\n"), make(chan error))
+	logs.On("Logs", mock.MatchedBy(func(a *api.Allocation) bool { return a.ID == "new" }), false, "func123", "stderr", mock.Anything, mock.Anything, mock.Anything).Return(fakeLogStream(), make(chan error))
+
+	msgs, err := requester.Query(context.Background(), flogs.Request{Name: "func123", Since: &since})
+	assert.NoError(t, err)
+
+	result := collectMessages(msgs)
+
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "new", result[0].Instance)
+	logs.AssertNumberOfCalls(t, "Logs", 2)
+}
+
+func TestLogRequesterStopsFollowingWhenContextIsCancelled(t *testing.T) {
+	jobs, logs, requester := setupLogRequester()
+
+	allocs := []*api.AllocationListStub{{ID: "alloc-1", ClientStatus: "running"}}
+	frames := make(chan *api.StreamFrame, 1)
+	frames <- &api.StreamFrame{Data: []byte("first\n")}
+
+	jobs.On("Allocations", "faas-fn-func123", false, mock.Anything).Return(allocs, nil, nil)
+	logs.On("Logs", mock.Anything, true, "func123", mock.Anything, "start", int64(0), mock.Anything).Return(frames, make(chan error))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	msgs, err := requester.Query(ctx, flogs.Request{Name: "func123", Follow: true})
+	assert.NoError(t, err)
+
+	first := <-msgs
+	assert.Equal(t, "first", first.Text)
+
+	cancel()
+
+	select {
+	case <-waitForClose(msgs):
+	case <-time.After(5 * time.Second):
+		t.Fatal("log stream was not closed after cancellation")
+	}
+}
+
+func waitForClose(msgs <-chan flogs.Message) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for range msgs {
+		}
+		close(done)
+	}()
+	return done
+}
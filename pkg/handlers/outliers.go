@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jsiebens/faas-nomad/pkg/proxy"
+)
+
+func MakeOutlierStatusHandler(outliers *proxy.OutlierDetector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonOut, marshalErr := json.Marshal(outliers.Status())
+		if marshalErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(HeaderContentType, TypeApplicationJson)
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonOut)
+	}
+}
@@ -3,15 +3,17 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/metrics"
 	"github.com/jsiebens/faas-nomad/pkg/services"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 	ftypes "github.com/openfaas/faas-provider/types"
 )
 
-func MakeFunctionReader(config *types.ProviderConfig, jobs services.Jobs, logger hclog.Logger) func(w http.ResponseWriter, r *http.Request) {
+func MakeFunctionReader(config *types.ProviderConfig, jobs services.Jobs, invocations *metrics.InvocationCounter, logger hclog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	log := logger.Named("function_reader")
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -29,7 +31,7 @@ func MakeFunctionReader(config *types.ProviderConfig, jobs services.Jobs, logger
 			return
 		}
 
-		functions, err := getFunctions(config, jobs, list, options)
+		functions, err := getFunctions(config, jobs, invocations, list, options)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			log.Error("Error listing functions", "namespace", namespace, "error", err.Error())
@@ -45,7 +47,7 @@ func MakeFunctionReader(config *types.ProviderConfig, jobs services.Jobs, logger
 	}
 }
 
-func getFunctions(config *types.ProviderConfig, client services.Jobs, jobs []*api.JobListStub, options *api.QueryOptions) ([]ftypes.FunctionStatus, error) {
+func getFunctions(config *types.ProviderConfig, client services.Jobs, invocations *metrics.InvocationCounter, jobs []*api.JobListStub, options *api.QueryOptions) ([]ftypes.FunctionStatus, error) {
 	functions := make([]ftypes.FunctionStatus, 0)
 	for _, j := range jobs {
 		job, _, err := client.Info(j.ID, options)
@@ -53,11 +55,35 @@ func getFunctions(config *types.ProviderConfig, client services.Jobs, jobs []*ap
 			return functions, err
 		}
 
-		functions = append(functions, createFunctionStatus(job, config.Scheduling.JobPrefix))
+		status := services.CreateFunctionStatus(job, config.Scheduling.JobPrefix)
+		status.InvocationCount = invocations.Count(status.Name)
+		status.Annotations = withInvocationCounts(status.Annotations, invocations.CountByStatus(status.Name))
+
+		functions = append(functions, status)
 	}
 	return functions, nil
 }
 
+// withInvocationCounts adds the invocation counts per status class to a copy of the function annotations.
+func withInvocationCounts(annotations *map[string]string, counts map[string]uint64) *map[string]string {
+	if len(counts) == 0 {
+		return annotations
+	}
+
+	result := map[string]string{}
+	if annotations != nil {
+		for k, v := range *annotations {
+			result[k] = v
+		}
+	}
+
+	for class, count := range counts {
+		result[services.InvocationCountAnnotationPrefix+class] = strconv.FormatUint(count, 10)
+	}
+
+	return &result
+}
+
 func writeError(w http.ResponseWriter, status int, err error) {
 	w.WriteHeader(status)
 	w.Write([]byte(err.Error()))
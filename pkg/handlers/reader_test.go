@@ -12,6 +12,7 @@ import (
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/metrics"
 	"github.com/jsiebens/faas-nomad/pkg/services"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 	ftypes "github.com/openfaas/faas-provider/types"
@@ -55,7 +56,7 @@ func setupFunctionReader() (*services.MockJobs, http.HandlerFunc, *http.Request,
 		JobPrefix: "faas-fn-",
 	}}
 
-	handler := MakeFunctionReader(config, jobs, hclog.Default())
+	handler := MakeFunctionReader(config, jobs, nil, hclog.Default())
 
 	return jobs, handler, request, response
 }
@@ -112,3 +113,33 @@ func TestFunctionReaderReportsRunningFunctions(t *testing.T) {
 
 	assert.Equal(t, 3, len(funcs))
 }
+
+func TestFunctionReaderReportsInvocationCounts(t *testing.T) {
+	jobs := &services.MockJobs{}
+	config := &types.ProviderConfig{Scheduling: types.SchedulingConfig{
+		JobPrefix: "faas-fn-",
+	}}
+
+	invocations := metrics.NewInvocationCounter(types.MetricsConfig{}, hclog.NewNullLogger())
+	invocations.InvocationFinished("JOB123", http.StatusOK, time.Millisecond)
+	invocations.InvocationFinished("JOB123", http.StatusOK, time.Millisecond)
+	invocations.InvocationFinished("JOB123", http.StatusBadGateway, time.Millisecond)
+
+	job := createMockJob("1234", "running")
+	jobs.On("List", mock.Anything).Return([]*api.JobListStub{{ID: *job.ID, Status: *job.Status}}, nil, nil)
+	jobs.On("Info", *job.ID, mock.Anything).Return(job, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/system/functions", nil)
+
+	MakeFunctionReader(config, jobs, invocations, hclog.Default())(recorder, request)
+
+	funcs := make([]ftypes.FunctionStatus, 0)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &funcs))
+
+	assert.Equal(t, 1, len(funcs))
+	assert.Equal(t, 3.0, funcs[0].InvocationCount)
+	assert.Equal(t, "2", (*funcs[0].Annotations)["com.openfaas.invocation_count.2xx"])
+	assert.Equal(t, "1", (*funcs[0].Annotations)["com.openfaas.invocation_count.5xx"])
+	assert.Equal(t, "test", (*funcs[0].Annotations)["topic"])
+}
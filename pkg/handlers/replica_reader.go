@@ -5,15 +5,19 @@ import (
 	"fmt"
 	"github.com/jsiebens/faas-nomad/pkg/resolver"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/metrics"
+	"github.com/jsiebens/faas-nomad/pkg/scaling"
 	"github.com/jsiebens/faas-nomad/pkg/services"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 )
 
-func MakeReplicaReader(config *types.ProviderConfig, client services.Jobs, resolver resolver.ServiceResolver, logger hclog.Logger) http.HandlerFunc {
+func MakeReplicaReader(config *types.ProviderConfig, client services.Jobs, resolver resolver.ServiceResolver, autoscaler *scaling.Autoscaler, invocations *metrics.InvocationCounter, logger hclog.Logger) http.HandlerFunc {
 	log := logger.Named("replica_reader")
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -32,7 +36,7 @@ func MakeReplicaReader(config *types.ProviderConfig, client services.Jobs, resol
 			return
 		}
 
-		status := createFunctionStatus(job, config.Scheduling.JobPrefix)
+		status := services.CreateFunctionStatus(job, config.Scheduling.JobPrefix)
 
 		if job.Status != nil && *job.Status == "dead" {
 			status.Replicas = 0
@@ -47,6 +51,13 @@ func MakeReplicaReader(config *types.ProviderConfig, client services.Jobs, resol
 			status.AvailableReplicas = uint64(len(availableReplicas))
 		}
 
+		status.InvocationCount = invocations.Count(functionName)
+		status.Annotations = withInvocationCounts(status.Annotations, invocations.CountByStatus(functionName))
+
+		if decision, ok := autoscaler.LastDecision(functionName); ok {
+			status.Annotations = withScalingDecision(status.Annotations, decision)
+		}
+
 		statusBytes, _ := json.Marshal(status)
 		w.Header().Set(HeaderContentType, TypeApplicationJson)
 		w.WriteHeader(http.StatusOK)
@@ -56,3 +67,24 @@ func MakeReplicaReader(config *types.ProviderConfig, client services.Jobs, resol
 	}
 
 }
+
+// withScalingDecision adds the latest autoscaler decision to a copy of the function annotations.
+func withScalingDecision(annotations *map[string]string, decision scaling.Decision) *map[string]string {
+	result := map[string]string{}
+	if annotations != nil {
+		for k, v := range *annotations {
+			result[k] = v
+		}
+	}
+
+	result[services.AutoscalerAnnotationPrefix+"concurrency"] = strconv.FormatFloat(decision.Concurrency, 'f', 2, 64)
+	result[services.AutoscalerAnnotationPrefix+"queue_depth"] = strconv.Itoa(decision.QueueDepth)
+	result[services.AutoscalerAnnotationPrefix+"desired"] = strconv.Itoa(decision.Desired)
+	result[services.AutoscalerAnnotationPrefix+"reason"] = decision.Reason
+	result[services.AutoscalerAnnotationPrefix+"evaluated_at"] = decision.EvaluatedAt.Format(time.RFC3339)
+	if !decision.LastScaleAt.IsZero() {
+		result[services.AutoscalerAnnotationPrefix+"scaled_at"] = decision.LastScaleAt.Format(time.RFC3339)
+	}
+
+	return &result
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jsiebens/faas-nomad/pkg/routing"
+)
+
+func MakeRoutesHandler(routes *routing.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonOut, marshalErr := json.Marshal(routes.List())
+		if marshalErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(HeaderContentType, TypeApplicationJson)
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonOut)
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/proxy"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+// TrafficSplit is the weighted split of the traffic of a function between its versions.
+type TrafficSplit struct {
+	Function string         `json:"function"`
+	Weights  map[string]int `json:"weights"`
+}
+
+// MakeTrafficSplitHandler reads (GET), adjusts (PUT, POST) and resets (DELETE) the traffic split of a function.
+// Adjusted weights take precedence over the `com.openfaas.traffic_split` annotation until they are reset.
+func MakeTrafficSplitHandler(config *types.ProviderConfig, splits *proxy.TrafficSplits, functions services.Functions, logger hclog.Logger) http.HandlerFunc {
+	log := logger.Named("traffic_split")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		functionName := strings.TrimSuffix(mux.Vars(r)["name"], "."+config.Scheduling.Namespace)
+
+		switch r.Method {
+		case http.MethodGet:
+			fn, err := functions.Get(functionName)
+			if fn == nil || err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			weights, ok := splits.Get(functionName, fn)
+			if !ok {
+				weights = map[string]int{functionName: 100}
+			}
+
+			writeTrafficSplit(w, functionName, weights)
+			return
+		case http.MethodPost, http.MethodPut:
+			if fn, err := functions.Get(functionName); fn == nil || err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(r.Body)
+
+			request := TrafficSplit{}
+			if err := json.Unmarshal(body, &request); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			for version := range request.Weights {
+				if fn, err := functions.Get(version); fn == nil || err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("unknown function version: %s", version))
+					return
+				}
+			}
+
+			if err := splits.Set(functionName, request.Weights); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			weights, _ := splits.Get(functionName, nil)
+			writeTrafficSplit(w, functionName, weights)
+
+			log.Info("Traffic split updated", "function", functionName, "weights", weights)
+			return
+		case http.MethodDelete:
+			splits.Reset(functionName)
+			w.WriteHeader(http.StatusNoContent)
+
+			log.Info("Traffic split reset", "function", functionName)
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+func writeTrafficSplit(w http.ResponseWriter, functionName string, weights map[string]int) {
+	jsonOut, err := json.Marshal(TrafficSplit{Function: functionName, Weights: weights})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set(HeaderContentType, TypeApplicationJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonOut)
+}
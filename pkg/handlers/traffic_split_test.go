@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/proxy"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func invokeTrafficSplitHandler(handler http.HandlerFunc, method string, body []byte) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/system/traffic-split/echo", bytes.NewReader(body))
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+func TestTrafficSplitHandlerAdjustsWeights(t *testing.T) {
+	config, _ := types.DefaultConfig()
+	functions := &services.MockFunctions{}
+	annotations := map[string]string{"com.openfaas.traffic_split": "echo-v2=10"}
+	functions.On("Get", "echo").Return(&ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}, nil)
+	functions.On("Get", "echo-v2").Return(&ftypes.FunctionStatus{Name: "echo-v2"}, nil)
+
+	handler := MakeTrafficSplitHandler(config, proxy.NewTrafficSplits(), functions, hclog.NewNullLogger())
+
+	recorder := invokeTrafficSplitHandler(handler, http.MethodGet, nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"function":"echo","weights":{"echo":90,"echo-v2":10}}`, recorder.Body.String())
+
+	body, _ := json.Marshal(TrafficSplit{Weights: map[string]int{"echo-v2": 25}})
+	recorder = invokeTrafficSplitHandler(handler, http.MethodPut, body)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"function":"echo","weights":{"echo":75,"echo-v2":25}}`, recorder.Body.String())
+
+	recorder = invokeTrafficSplitHandler(handler, http.MethodGet, nil)
+	assert.JSONEq(t, `{"function":"echo","weights":{"echo":75,"echo-v2":25}}`, recorder.Body.String())
+
+	recorder = invokeTrafficSplitHandler(handler, http.MethodDelete, nil)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	recorder = invokeTrafficSplitHandler(handler, http.MethodGet, nil)
+	assert.JSONEq(t, `{"function":"echo","weights":{"echo":90,"echo-v2":10}}`, recorder.Body.String())
+}
+
+func TestTrafficSplitHandlerRejectsInvalidWeights(t *testing.T) {
+	config, _ := types.DefaultConfig()
+	functions := &services.MockFunctions{}
+	functions.On("Get", "echo").Return(&ftypes.FunctionStatus{Name: "echo"}, nil)
+	functions.On("Get", "echo-v2").Return(&ftypes.FunctionStatus{Name: "echo-v2"}, nil)
+	functions.On("Get", "echo-v3").Return(nil, fmt.Errorf("job not found"))
+	handler := MakeTrafficSplitHandler(config, proxy.NewTrafficSplits(), functions, hclog.NewNullLogger())
+
+	recorder := invokeTrafficSplitHandler(handler, http.MethodPut, []byte(`{"weights":{"echo-v2":-5}}`))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = invokeTrafficSplitHandler(handler, http.MethodPut, []byte(`invalid`))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = invokeTrafficSplitHandler(handler, http.MethodPut, []byte(`{"weights":{"echo-v3":10}}`))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "unknown function version: echo-v3", recorder.Body.String())
+}
+
+func TestTrafficSplitHandlerReportsNotFoundForUnknownFunction(t *testing.T) {
+	config, _ := types.DefaultConfig()
+	functions := &services.MockFunctions{}
+	functions.On("Get", "echo").Return(nil, fmt.Errorf("job not found"))
+
+	splits := proxy.NewTrafficSplits()
+	handler := MakeTrafficSplitHandler(config, splits, functions, hclog.NewNullLogger())
+
+	recorder := invokeTrafficSplitHandler(handler, http.MethodPut, []byte(`{"weights":{"echo-v2":10}}`))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	_, ok := splits.Get("echo", nil)
+	assert.False(t, ok)
+}
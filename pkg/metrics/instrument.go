@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/resolver"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	backendNomad = "nomad"
+	backendVault = "vault"
+)
+
+// InstrumentJobs records the requests sent to Nomad through the Jobs service.
+func (p *Prometheus) InstrumentJobs(jobs services.Jobs) services.Jobs {
+	return &instrumentedJobs{jobs: jobs, metrics: p}
+}
+
+// InstrumentSecrets records the requests sent to Vault through the Secrets service.
+func (p *Prometheus) InstrumentSecrets(secrets services.Secrets) services.Secrets {
+	return &instrumentedSecrets{secrets: secrets, metrics: p}
+}
+
+// InstrumentResolver records the lookups of function endpoints in the given service discovery backend,
+// e.g. consul, nomad or file.
+func (p *Prometheus) InstrumentResolver(resolver resolver.ServiceResolver, backend string) resolver.ServiceResolver {
+	return &instrumentedResolver{resolver: resolver, backend: backend, metrics: p}
+}
+
+type instrumentedJobs struct {
+	jobs    services.Jobs
+	metrics *Prometheus
+}
+
+func (j *instrumentedJobs) List(q *api.QueryOptions) ([]*api.JobListStub, *api.QueryMeta, error) {
+	start := time.Now()
+	list, meta, err := j.jobs.List(q)
+	return list, meta, j.metrics.observeBackend(backendNomad, "list", start, err)
+}
+
+func (j *instrumentedJobs) Info(jobID string, q *api.QueryOptions) (*api.Job, *api.QueryMeta, error) {
+	start := time.Now()
+	job, meta, err := j.jobs.Info(jobID, q)
+	return job, meta, j.metrics.observeBackend(backendNomad, "info", start, err)
+}
+
+func (j *instrumentedJobs) LatestDeployment(jobID string, q *api.QueryOptions) (*api.Deployment, *api.QueryMeta, error) {
+	start := time.Now()
+	deployment, meta, err := j.jobs.LatestDeployment(jobID, q)
+	return deployment, meta, j.metrics.observeBackend(backendNomad, "latest_deployment", start, err)
+}
+
+func (j *instrumentedJobs) RegisterOpts(job *api.Job, opts *api.RegisterOptions, q *api.WriteOptions) (*api.JobRegisterResponse, *api.WriteMeta, error) {
+	start := time.Now()
+	resp, meta, err := j.jobs.RegisterOpts(job, opts, q)
+	return resp, meta, j.metrics.observeBackend(backendNomad, "register", start, err)
+}
+
+func (j *instrumentedJobs) Deregister(jobID string, purge bool, q *api.WriteOptions) (string, *api.WriteMeta, error) {
+	start := time.Now()
+	evalID, meta, err := j.jobs.Deregister(jobID, purge, q)
+	return evalID, meta, j.metrics.observeBackend(backendNomad, "deregister", start, err)
+}
+
+func (j *instrumentedJobs) Scale(jobID, group string, count *int, message string, error bool, meta map[string]interface{}, q *api.WriteOptions) (*api.JobRegisterResponse, *api.WriteMeta, error) {
+	start := time.Now()
+	resp, wm, err := j.jobs.Scale(jobID, group, count, message, error, meta, q)
+	return resp, wm, j.metrics.observeBackend(backendNomad, "scale", start, err)
+}
+
+func (j *instrumentedJobs) Allocations(jobID string, allAllocs bool, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error) {
+	start := time.Now()
+	allocs, meta, err := j.jobs.Allocations(jobID, allAllocs, q)
+	return allocs, meta, j.metrics.observeBackend(backendNomad, "allocations", start, err)
+}
+
+type instrumentedSecrets struct {
+	secrets services.Secrets
+	metrics *Prometheus
+}
+
+func (s *instrumentedSecrets) List() ([]ftypes.Secret, error) {
+	start := time.Now()
+	secrets, err := s.secrets.List()
+	return secrets, s.metrics.observeBackend(backendVault, "list", start, err)
+}
+
+func (s *instrumentedSecrets) Set(key, value string) error {
+	start := time.Now()
+	return s.metrics.observeBackend(backendVault, "set", start, s.secrets.Set(key, value))
+}
+
+func (s *instrumentedSecrets) Get(key string) (string, error) {
+	start := time.Now()
+	value, err := s.secrets.Get(key)
+	return value, s.metrics.observeBackend(backendVault, "get", start, err)
+}
+
+func (s *instrumentedSecrets) Exists(key string) bool {
+	start := time.Now()
+	exists := s.secrets.Exists(key)
+	s.metrics.observeBackend(backendVault, "exists", start, nil)
+	return exists
+}
+
+func (s *instrumentedSecrets) Delete(key string) error {
+	start := time.Now()
+	return s.metrics.observeBackend(backendVault, "delete", start, s.secrets.Delete(key))
+}
+
+type instrumentedResolver struct {
+	resolver resolver.ServiceResolver
+	backend  string
+	metrics  *Prometheus
+}
+
+func (r *instrumentedResolver) Resolve(functionName string) (url.URL, error) {
+	start := time.Now()
+	u, err := r.resolver.Resolve(functionName)
+	return u, r.metrics.observeBackend(r.backend, "resolve", start, err)
+}
+
+func (r *instrumentedResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	start := time.Now()
+	urls, err := r.resolver.ResolveAll(functionName)
+	return urls, r.metrics.observeBackend(r.backend, "resolve_all", start, err)
+}
+
+func (r *instrumentedResolver) ResolveEndpoints(functionName string) ([]resolver.Endpoint, error) {
+	start := time.Now()
+	endpoints, err := r.resolver.ResolveEndpoints(functionName)
+	return endpoints, r.metrics.observeBackend(r.backend, "resolve_endpoints", start, err)
+}
+
+func (r *instrumentedResolver) Watch(functionName string) {
+	r.resolver.Watch(functionName)
+}
+
+func (r *instrumentedResolver) Unwatch(functionName string) {
+	r.resolver.Unwatch(functionName)
+}
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+// InvocationCounter counts the invocations of each function per status class (2xx, 4xx, 5xx, ...)
+// by observing the function proxy. When a file is configured, the counts are loaded at startup and
+// written back periodically, so they survive a restart of the provider.
+type InvocationCounter struct {
+	file          string
+	flushInterval time.Duration
+	log           hclog.Logger
+
+	mu     sync.Mutex
+	counts map[string]map[string]uint64
+	dirty  bool
+}
+
+func NewInvocationCounter(config types.MetricsConfig, logger hclog.Logger) *InvocationCounter {
+	return &InvocationCounter{
+		file:          config.InvocationCountFile,
+		flushInterval: config.InvocationCountFlushInterval,
+		log:           logger.Named("invocation_counter"),
+		counts:        map[string]map[string]uint64{},
+	}
+}
+
+func (c *InvocationCounter) InvocationStarted(function string) {
+}
+
+func (c *InvocationCounter) InvocationFinished(function string, statusCode int, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	classes, ok := c.counts[function]
+	if !ok {
+		classes = map[string]uint64{}
+		c.counts[function] = classes
+	}
+
+	classes[StatusClass(statusCode)]++
+	c.dirty = true
+}
+
+// Count returns the total number of invocations of the function.
+func (c *InvocationCounter) Count(function string) float64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var total uint64
+	for _, count := range c.counts[function] {
+		total += count
+	}
+	return float64(total)
+}
+
+// CountByStatus returns the number of invocations of the function per status class.
+func (c *InvocationCounter) CountByStatus(function string) map[string]uint64 {
+	result := map[string]uint64{}
+	if c == nil {
+		return result
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for class, count := range c.counts[function] {
+		result[class] = count
+	}
+	return result
+}
+
+// Start loads the persisted counts and writes them back at the configured interval.
+// Without a file, the counts are only kept in memory.
+func (c *InvocationCounter) Start() error {
+	if c.file == "" {
+		return nil
+	}
+
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.flushInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := c.Flush(); err != nil {
+				c.log.Error("Error writing invocation counts", "file", c.file, "error", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *InvocationCounter) load() error {
+	data, err := ioutil.ReadFile(c.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]map[string]uint64{}
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = counts
+
+	return nil
+}
+
+// Flush writes the counts to the configured file, when they changed since the last flush.
+func (c *InvocationCounter) Flush() error {
+	if c.file == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(c.counts)
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(c.file, data); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// writeFile writes to a temporary file first, so a crash never leaves a truncated file behind.
+func writeFile(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// StatusClass returns the class of an HTTP status code, e.g. 2xx.
+func StatusClass(statusCode int) string {
+	return strconv.Itoa(statusCode/100) + "xx"
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvocationCounterCountsPerStatusClass(t *testing.T) {
+	counter := NewInvocationCounter(types.MetricsConfig{}, hclog.NewNullLogger())
+
+	counter.InvocationFinished("fn", http.StatusOK, time.Millisecond)
+	counter.InvocationFinished("fn", http.StatusAccepted, time.Millisecond)
+	counter.InvocationFinished("fn", http.StatusNotFound, time.Millisecond)
+	counter.InvocationFinished("fn", http.StatusServiceUnavailable, time.Millisecond)
+	counter.InvocationFinished("other", http.StatusOK, time.Millisecond)
+
+	assert.Equal(t, 4.0, counter.Count("fn"))
+	assert.Equal(t, map[string]uint64{"2xx": 2, "4xx": 1, "5xx": 1}, counter.CountByStatus("fn"))
+	assert.Equal(t, 0.0, counter.Count("unknown"))
+}
+
+func TestInvocationCounterIsNilSafe(t *testing.T) {
+	var counter *InvocationCounter
+
+	assert.Equal(t, 0.0, counter.Count("fn"))
+	assert.Empty(t, counter.CountByStatus("fn"))
+}
+
+func TestInvocationCounterPersistsCounts(t *testing.T) {
+	config := types.MetricsConfig{
+		InvocationCountFile:          filepath.Join(t.TempDir(), "invocations.json"),
+		InvocationCountFlushInterval: time.Hour,
+	}
+
+	counter := NewInvocationCounter(config, hclog.NewNullLogger())
+	assert.NoError(t, counter.Start())
+
+	counter.InvocationFinished("fn", http.StatusOK, time.Millisecond)
+	counter.InvocationFinished("fn", http.StatusInternalServerError, time.Millisecond)
+	assert.NoError(t, counter.Flush())
+
+	restarted := NewInvocationCounter(config, hclog.NewNullLogger())
+	assert.NoError(t, restarted.Start())
+
+	assert.Equal(t, 2.0, restarted.Count("fn"))
+	assert.Equal(t, map[string]uint64{"2xx": 1, "5xx": 1}, restarted.CountByStatus("fn"))
+}
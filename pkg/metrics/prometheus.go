@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus holds the metrics exposed by the provider on `/metrics`.
+//
+// The function invocation metrics are recorded by observing the function proxy and use the same names
+// and labels as the OpenFaaS gateway. The provider API handlers and the calls to Nomad, Vault and Consul
+// are recorded with the instrumentation helpers.
+type Prometheus struct {
+	namespace string
+	registry  *prometheus.Registry
+
+	invocationStarted  *prometheus.CounterVec
+	invocationTotal    *prometheus.CounterVec
+	invocationDuration *prometheus.HistogramVec
+	invocationInflight *prometheus.GaugeVec
+	queueDepth         *prometheus.GaugeVec
+	mirrorTotal        *prometheus.CounterVec
+	mirrorErrors       *prometheus.CounterVec
+	mirrorDuration     *prometheus.HistogramVec
+
+	handlerTotal    *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+
+	backendTotal    *prometheus.CounterVec
+	backendDuration *prometheus.HistogramVec
+}
+
+func NewPrometheus(config *types.ProviderConfig) *Prometheus {
+	p := &Prometheus{
+		namespace: config.Scheduling.Namespace,
+		registry:  prometheus.NewRegistry(),
+
+		invocationStarted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_function_invocation_started",
+			Help: "Function invocations started",
+		}, []string{"function_name"}),
+		invocationTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_function_invocation_total",
+			Help: "Function invocations",
+		}, []string{"function_name", "code"}),
+		invocationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gateway_functions_seconds",
+			Help: "Function invocation time taken",
+		}, []string{"function_name", "code"}),
+		invocationInflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gateway_function_invocation_inflight",
+			Help: "Function invocations in flight",
+		}, []string{"function_name"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "faas_nomad_function_queue_depth",
+			Help: "Function invocations waiting for a replica with capacity",
+		}, []string{"function_name"}),
+		mirrorTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "faas_nomad_function_mirrored_total",
+			Help: "Function invocations mirrored to a shadow function",
+		}, []string{"function_name", "shadow_name", "code"}),
+		mirrorErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "faas_nomad_function_mirrored_errors_total",
+			Help: "Mirrored function invocations which failed, or returned a server error",
+		}, []string{"function_name", "shadow_name"}),
+		mirrorDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "faas_nomad_function_mirrored_seconds",
+			Help: "Mirrored function invocation time taken",
+		}, []string{"function_name", "shadow_name"}),
+
+		handlerTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "faas_nomad_http_requests_total",
+			Help: "Requests handled by the provider API",
+		}, []string{"handler", "method", "code"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "faas_nomad_http_request_duration_seconds",
+			Help: "Time taken to handle requests to the provider API",
+		}, []string{"handler", "method", "code"}),
+
+		backendTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "faas_nomad_backend_requests_total",
+			Help: "Requests sent to Nomad, Vault and Consul",
+		}, []string{"backend", "operation", "result"}),
+		backendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "faas_nomad_backend_request_duration_seconds",
+			Help: "Time taken by the requests sent to Nomad, Vault and Consul",
+		}, []string{"backend", "operation"}),
+	}
+
+	p.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		p.invocationStarted,
+		p.invocationTotal,
+		p.invocationDuration,
+		p.invocationInflight,
+		p.queueDepth,
+		p.mirrorTotal,
+		p.mirrorErrors,
+		p.mirrorDuration,
+		p.handlerTotal,
+		p.handlerDuration,
+		p.backendTotal,
+		p.backendDuration,
+	)
+
+	return p
+}
+
+// Handler returns the handler serving the metrics.
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// functionName returns the name of the function as reported by the gateway, including the namespace.
+func (p *Prometheus) functionName(function string) string {
+	return function + "." + p.namespace
+}
+
+func (p *Prometheus) InvocationStarted(function string) {
+	name := p.functionName(function)
+	p.invocationStarted.WithLabelValues(name).Inc()
+	p.invocationInflight.WithLabelValues(name).Inc()
+}
+
+func (p *Prometheus) InvocationFinished(function string, statusCode int, duration time.Duration) {
+	name := p.functionName(function)
+	code := strconv.Itoa(statusCode)
+	p.invocationInflight.WithLabelValues(name).Dec()
+	p.invocationTotal.WithLabelValues(name, code).Inc()
+	p.invocationDuration.WithLabelValues(name, code).Observe(duration.Seconds())
+}
+
+func (p *Prometheus) QueueDepthChanged(function string, depth int) {
+	p.queueDepth.WithLabelValues(p.functionName(function)).Set(float64(depth))
+}
+
+func (p *Prometheus) InvocationMirrored(function string, shadow string, statusCode int, duration time.Duration) {
+	name := p.functionName(function)
+	shadowName := p.functionName(shadow)
+
+	p.mirrorTotal.WithLabelValues(name, shadowName, strconv.Itoa(statusCode)).Inc()
+	p.mirrorDuration.WithLabelValues(name, shadowName).Observe(duration.Seconds())
+	if statusCode == 0 || statusCode >= http.StatusInternalServerError {
+		p.mirrorErrors.WithLabelValues(name, shadowName).Inc()
+	}
+}
+
+// InstrumentHandler records the requests and latency of a provider API handler.
+func (p *Prometheus) InstrumentHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"handler": name}
+	total := p.handlerTotal.MustCurryWith(labels)
+	duration := p.handlerDuration.MustCurryWith(labels)
+
+	return promhttp.InstrumentHandlerCounter(total, promhttp.InstrumentHandlerDuration(duration, handler))
+}
+
+// observeBackend records the outcome of a request sent to a backend, and returns the error unchanged.
+func (p *Prometheus) observeBackend(backend, operation string, start time.Time, err error) error {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	p.backendTotal.WithLabelValues(backend, operation, result).Inc()
+	p.backendDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+
+	return err
+}
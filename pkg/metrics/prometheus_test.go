@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupPrometheus() *Prometheus {
+	config, _ := types.DefaultConfig()
+	config.Scheduling.Namespace = "openfaas-fn"
+	return NewPrometheus(config)
+}
+
+func TestPrometheusRecordsInvocations(t *testing.T) {
+	p := setupPrometheus()
+
+	p.InvocationStarted("fn")
+	p.InvocationStarted("fn")
+	p.InvocationFinished("fn", http.StatusOK, 10*time.Millisecond)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.invocationStarted.WithLabelValues("fn.openfaas-fn")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.invocationInflight.WithLabelValues("fn.openfaas-fn")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.invocationTotal.WithLabelValues("fn.openfaas-fn", "200")))
+}
+
+func TestPrometheusRecordsMirroredInvocations(t *testing.T) {
+	p := setupPrometheus()
+
+	p.InvocationMirrored("fn", "fn-v2", http.StatusOK, time.Millisecond)
+	p.InvocationMirrored("fn", "fn-v2", http.StatusInternalServerError, time.Millisecond)
+	p.InvocationMirrored("fn", "fn-v2", 0, time.Millisecond)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.mirrorTotal.WithLabelValues("fn.openfaas-fn", "fn-v2.openfaas-fn", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.mirrorTotal.WithLabelValues("fn.openfaas-fn", "fn-v2.openfaas-fn", "500")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.mirrorErrors.WithLabelValues("fn.openfaas-fn", "fn-v2.openfaas-fn")))
+}
+
+func TestPrometheusInstrumentsHandlers(t *testing.T) {
+	p := setupPrometheus()
+
+	handler := p.InstrumentHandler("deploy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/system/functions", nil))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.handlerTotal.WithLabelValues("deploy", "post", "400")))
+}
+
+func TestPrometheusInstrumentsJobs(t *testing.T) {
+	p := setupPrometheus()
+
+	mockJobs := &services.MockJobs{}
+	mockJobs.On("Info", "faas-fn-ok", mock.Anything).Return(nil, nil, nil)
+	mockJobs.On("Info", "faas-fn-error", mock.Anything).Return(nil, nil, errors.New("failure"))
+
+	jobs := p.InstrumentJobs(mockJobs)
+	jobs.Info("faas-fn-ok", nil)
+	_, _, err := jobs.Info("faas-fn-error", nil)
+
+	assert.EqualError(t, err, "failure")
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.backendTotal.WithLabelValues("nomad", "info", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.backendTotal.WithLabelValues("nomad", "info", "error")))
+}
+
+func TestPrometheusInstrumentsResolverWithItsBackend(t *testing.T) {
+	p := setupPrometheus()
+
+	mockResolver := &services.MockResolver{}
+	mockResolver.On("ResolveAll", "fn").Return([]url.URL{}, nil)
+
+	p.InstrumentResolver(mockResolver, "file").ResolveAll("fn")
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.backendTotal.WithLabelValues("file", "resolve_all", "success")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.backendTotal.WithLabelValues("consul", "resolve_all", "success")))
+}
+
+func TestPrometheusServesMetrics(t *testing.T) {
+	p := setupPrometheus()
+	p.InvocationFinished("fn", http.StatusOK, time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	p.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `gateway_function_invocation_total{code="200",function_name="fn.openfaas-fn"} 1`)
+}
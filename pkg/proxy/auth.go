@@ -0,0 +1,514 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/openfaas/faas-provider/httputil"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	authAnnotation             = "com.openfaas.auth"
+	authAPIKeySecretAnnotation = "com.openfaas.auth.api_key.secret"
+	authAPIKeyHeaderAnnotation = "com.openfaas.auth.api_key.header"
+	authBasicSecretAnnotation  = "com.openfaas.auth.basic.secret"
+	authJWKSAnnotation         = "com.openfaas.auth.jwt.jwks"
+	authIssuerAnnotation       = "com.openfaas.auth.jwt.issuer"
+	authAudienceAnnotation     = "com.openfaas.auth.jwt.audience"
+	authClaimsAnnotation       = "com.openfaas.auth.jwt.claims"
+
+	authMethodAPIKey = "api_key"
+	authMethodBasic  = "basic"
+	authMethodJWT    = "jwt"
+
+	defaultAPIKeyHeader = "X-Api-Key"
+
+	// AuthMethodHeader is passed to the authenticated functions, with the method which verified the caller.
+	AuthMethodHeader = "X-Auth-Method"
+	// AuthSubjectHeader is passed to the authenticated functions, with the basic auth user or the subject of the token.
+	AuthSubjectHeader = "X-Auth-Subject"
+	// AuthClaimHeaderPrefix prefixes the headers holding the claims of the token, e.g. `X-Auth-Claim-Email`.
+	AuthClaimHeaderPrefix = "X-Auth-Claim-"
+
+	authHeaderPrefix = "X-Auth-"
+
+	// unknown key IDs trigger a reload of the key set, at most once per period
+	jwksMinRefreshInterval = 10 * time.Second
+	jwksFetchTimeout       = 10 * time.Second
+)
+
+var (
+	errUnauthenticated = errors.New("missing or invalid credentials")
+	errAuthUnavailable = errors.New("unable to verify credentials")
+)
+
+// authPolicy lists the methods accepted to authenticate the callers of a function. It is configured with the
+// `com.openfaas.auth` annotation, a comma separated list of `api_key`, `basic` and `jwt`, a caller is
+// authenticated when one of the methods accepts its credentials.
+//
+// API keys are read from the header named by `com.openfaas.auth.api_key.header` (X-Api-Key by default) and
+// compared with the Vault secret named by `com.openfaas.auth.api_key.secret`, which holds one key per line.
+// Basic auth credentials are compared with the Vault secret named by `com.openfaas.auth.basic.secret`, which
+// holds one `user:password` entry per line, the password being plain text or a bcrypt hash.
+// Bearer tokens are verified with the JWKS loaded from the file or URL in `com.openfaas.auth.jwt.jwks`, or
+// the provider default, and their issuer and audience are checked when `com.openfaas.auth.jwt.issuer` and
+// `com.openfaas.auth.jwt.audience` are set. The subject and the claims listed in `com.openfaas.auth.jwt.claims`
+// are passed to the function as headers.
+type authPolicy struct {
+	methods      []string
+	apiKeySecret string
+	apiKeyHeader string
+	basicSecret  string
+	jwks         string
+	issuer       string
+	audience     string
+	claims       []string
+}
+
+// CredentialHeaders returns the headers of a request which may hold the credentials of the caller of a function.
+func CredentialHeaders(fn *ftypes.FunctionStatus) []string {
+	apiKeyHeader := defaultAPIKeyHeader
+	if fn != nil {
+		apiKeyHeader = types.ParseStringValueFromMap(fn.Annotations, authAPIKeyHeaderAnnotation, defaultAPIKeyHeader)
+	}
+	return []string{"Authorization", "Proxy-Authorization", "Cookie", apiKeyHeader}
+}
+
+func newAuthPolicy(config types.ProxyConfig, fn *ftypes.FunctionStatus) authPolicy {
+	if fn == nil || fn.Annotations == nil {
+		return authPolicy{}
+	}
+
+	return authPolicy{
+		methods:      types.ParseListValue(types.ParseStringValueFromMap(fn.Annotations, authAnnotation, "")),
+		apiKeySecret: types.ParseStringValueFromMap(fn.Annotations, authAPIKeySecretAnnotation, ""),
+		apiKeyHeader: types.ParseStringValueFromMap(fn.Annotations, authAPIKeyHeaderAnnotation, defaultAPIKeyHeader),
+		basicSecret:  types.ParseStringValueFromMap(fn.Annotations, authBasicSecretAnnotation, ""),
+		jwks:         types.ParseStringValueFromMap(fn.Annotations, authJWKSAnnotation, config.AuthJWKS),
+		issuer:       types.ParseStringValueFromMap(fn.Annotations, authIssuerAnnotation, ""),
+		audience:     types.ParseStringValueFromMap(fn.Annotations, authAudienceAnnotation, ""),
+		claims:       types.ParseListValue(types.ParseStringValueFromMap(fn.Annotations, authClaimsAnnotation, "")),
+	}
+}
+
+func (ap authPolicy) enabled() bool {
+	return len(ap.methods) > 0
+}
+
+// challenges returns the WWW-Authenticate challenges of the policy.
+func (ap authPolicy) challenges(functionName string) []string {
+	var challenges []string
+	for _, m := range ap.methods {
+		switch m {
+		case authMethodBasic:
+			challenges = append(challenges, fmt.Sprintf("Basic realm=%q", functionName))
+		case authMethodJWT:
+			challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", functionName))
+		}
+	}
+	return challenges
+}
+
+// identity is the verified caller of a function.
+type identity struct {
+	method  string
+	subject string
+	claims  map[string]string
+}
+
+// authenticator verifies the credentials of the callers. The secrets read from Vault are cached for the
+// configured TTL, the key sets are reloaded periodically and when a token is signed by an unknown key.
+type authenticator struct {
+	config  types.ProxyConfig
+	secrets services.Secrets
+	client  *http.Client
+	now     func() time.Time
+	log     hclog.Logger
+
+	// the policies of the protected functions, by name
+	policies sync.Map
+
+	mu           sync.Mutex
+	secretValues map[string]cachedSecret
+	keySets      map[string]*keySet
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+type keySet struct {
+	mu      sync.Mutex
+	keys    jose.JSONWebKeySet
+	loaded  bool
+	fetched time.Time
+}
+
+func newAuthenticator(config types.ProxyConfig, secrets services.Secrets, log hclog.Logger) *authenticator {
+	return &authenticator{
+		config:       config,
+		secrets:      secrets,
+		client:       &http.Client{Timeout: jwksFetchTimeout},
+		now:          time.Now,
+		log:          log,
+		secretValues: map[string]cachedSecret{},
+		keySets:      map[string]*keySet{},
+	}
+}
+
+// policy returns the auth policy of a function, given the result of its lookup. The policies of the protected
+// functions are remembered, so they stay protected when their details can't be read. The other functions are
+// not protected when their details can't be read, e.g. with the file discovery or when Nomad is unavailable.
+func (a *authenticator) policy(functionName string, fn *ftypes.FunctionStatus, lookupErr error) authPolicy {
+	if lookupErr != nil {
+		if policy, ok := a.policies.Load(functionName); ok {
+			return policy.(authPolicy)
+		}
+		return authPolicy{}
+	}
+
+	policy := newAuthPolicy(a.config, fn)
+	if policy.enabled() {
+		a.policies.Store(functionName, policy)
+	} else {
+		a.policies.Delete(functionName)
+	}
+	return policy
+}
+
+// authenticate verifies the credentials of the request with the methods of the policy.
+func (a *authenticator) authenticate(r *http.Request, policy authPolicy) (*identity, error) {
+	unavailable := false
+
+	for _, method := range policy.methods {
+		var id *identity
+		var err error
+
+		switch method {
+		case authMethodAPIKey:
+			id, err = a.verifyAPIKey(r, policy)
+		case authMethodBasic:
+			id, err = a.verifyBasic(r, policy)
+		case authMethodJWT:
+			id, err = a.verifyJWT(r, policy)
+		default:
+			err = fmt.Errorf("unsupported auth method %s", method)
+		}
+
+		if err == nil {
+			return id, nil
+		}
+		if err != errUnauthenticated {
+			a.log.Warn("unable to verify credentials", "method", method, "error", err.Error())
+			unavailable = true
+		}
+	}
+
+	if unavailable {
+		return nil, errAuthUnavailable
+	}
+	return nil, errUnauthenticated
+}
+
+func (a *authenticator) verifyAPIKey(r *http.Request, policy authPolicy) (*identity, error) {
+	key := r.Header.Get(policy.apiKeyHeader)
+	if key == "" {
+		return nil, errUnauthenticated
+	}
+
+	value, err := a.secret(policy.apiKeySecret)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range strings.Split(value, "\n") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate != "" && subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return &identity{method: authMethodAPIKey}, nil
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+func (a *authenticator) verifyBasic(r *http.Request, policy authPolicy) (*identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user == "" {
+		return nil, errUnauthenticated
+	}
+
+	value, err := a.secret(policy.basicSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range strings.Split(value, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] != user {
+			continue
+		}
+
+		expected := parts[1]
+		if strings.HasPrefix(expected, "$2") {
+			if bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil {
+				return &identity{method: authMethodBasic, subject: user}, nil
+			}
+		} else if subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+			return &identity{method: authMethodBasic, subject: user}, nil
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+func (a *authenticator) verifyJWT(r *http.Request, policy authPolicy) (*identity, error) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return nil, errUnauthenticated
+	}
+
+	token, err := jwt.ParseSigned(raw)
+	if err != nil || len(token.Headers) == 0 {
+		return nil, errUnauthenticated
+	}
+
+	keys, err := a.keys(policy.jwks, token.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.Claims
+	var extra map[string]interface{}
+	verified := false
+	for _, key := range keys {
+		if err := token.Claims(key, &claims, &extra); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errUnauthenticated
+	}
+
+	expected := jwt.Expected{Issuer: policy.issuer, Time: a.now()}
+	if policy.audience != "" {
+		expected.Audience = jwt.Audience{policy.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return nil, errUnauthenticated
+	}
+
+	id := &identity{method: authMethodJWT, subject: claims.Subject, claims: map[string]string{}}
+	for _, name := range policy.claims {
+		if value, ok := extra[name]; ok {
+			id.claims[name] = claimValue(value)
+		}
+	}
+	return id, nil
+}
+
+// secret returns the value of a Vault secret, from the cache when it hasn't expired.
+func (a *authenticator) secret(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("no secret configured")
+	}
+	if a.secrets == nil {
+		return "", errors.New("no secrets backend available")
+	}
+
+	a.mu.Lock()
+	cached, ok := a.secretValues[name]
+	a.mu.Unlock()
+
+	if ok && a.now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	encoded, err := a.secrets.Get(name)
+	if err != nil {
+		return "", err
+	}
+
+	// the secrets are stored base64 encoded by the secrets API, like for the functions reading them
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode secret %s: %w", name, err)
+	}
+	value := string(decoded)
+
+	a.mu.Lock()
+	a.secretValues[name] = cachedSecret{value: value, expires: a.now().Add(a.config.AuthSecretTTL)}
+	a.mu.Unlock()
+
+	return value, nil
+}
+
+// keys returns the keys of a key set matching the key ID of a token, or all the keys when the token has none.
+func (a *authenticator) keys(source string, kid string) ([]jose.JSONWebKey, error) {
+	if source == "" {
+		return nil, errors.New("no JWKS configured")
+	}
+
+	a.mu.Lock()
+	set, ok := a.keySets[source]
+	if !ok {
+		set = &keySet{}
+		a.keySets[source] = set
+	}
+	a.mu.Unlock()
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	age := a.now().Sub(set.fetched)
+	stale := !set.loaded || age >= a.config.AuthJWKSRefreshInterval
+	unknown := kid != "" && len(set.keys.Key(kid)) == 0 && age >= jwksMinRefreshInterval
+
+	if stale || unknown {
+		keys, err := a.loadKeySet(source)
+		switch {
+		case err == nil:
+			set.keys, set.loaded = keys, true
+			set.fetched = a.now()
+		case set.loaded:
+			// keep using the previous keys until the key set is available again
+			a.log.Warn("unable to reload JWKS, using the previous keys", "jwks", source, "error", err.Error())
+		default:
+			return nil, err
+		}
+	}
+
+	if kid != "" {
+		return set.keys.Key(kid), nil
+	}
+	return set.keys.Keys, nil
+}
+
+// loadKeySet reads a JWKS from an http(s) URL or a local file.
+func (a *authenticator) loadKeySet(source string) (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = a.fetch(source)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return keys, err
+	}
+
+	err = json.Unmarshal(data, &keys)
+	return keys, err
+}
+
+func (a *authenticator) fetch(url string) ([]byte, error) {
+	response, err := a.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d while fetching %s", response.StatusCode, url)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// authenticate rejects the requests without valid credentials for a protected function. The headers of the
+// request are replaced with the verified identity, so the callers can't forge them. It returns false when the
+// request has been rejected.
+func (p *functionProxy) authenticate(w http.ResponseWriter, r *http.Request, functionName string, fn *ftypes.FunctionStatus, lookupErr error) bool {
+	policy := p.auth.policy(functionName, fn, lookupErr)
+	if !policy.enabled() {
+		return true
+	}
+
+	id, err := p.auth.authenticate(r, policy)
+	if err == errAuthUnavailable {
+		w.Header().Set("Retry-After", "1")
+		httputil.Errorf(w, http.StatusServiceUnavailable, "Unable to verify the credentials for: %s.", functionName)
+		return false
+	}
+	if err != nil {
+		for _, challenge := range policy.challenges(functionName) {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		httputil.Errorf(w, http.StatusUnauthorized, "Unauthorized invocation of: %s.", functionName)
+		return false
+	}
+
+	for name := range r.Header {
+		if strings.HasPrefix(name, authHeaderPrefix) {
+			r.Header.Del(name)
+		}
+	}
+
+	r.Header.Set(AuthMethodHeader, id.method)
+	if id.subject != "" {
+		r.Header.Set(AuthSubjectHeader, id.subject)
+	}
+	names := make([]string, 0, len(id.claims))
+	for name := range id.claims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.Header.Set(claimHeader(name), id.claims[name])
+	}
+
+	return true
+}
+
+// claimHeader returns the header holding a claim, e.g. `X-Auth-Claim-Email` for `email`.
+func claimHeader(claim string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || r == '.' || r == ':' || r == '/' {
+			return '-'
+		}
+		return r
+	}, claim)
+	return textproto.CanonicalMIMEHeaderKey(AuthClaimHeaderPrefix + name)
+}
+
+// claimValue formats a claim as a header value, lists are joined with commas.
+func claimValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, claimValue(item))
+		}
+		return strings.Join(values, ",")
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// identityServer echoes the auth headers received by the function.
+func identityServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(AuthMethodHeader, r.Header.Get(AuthMethodHeader))
+		w.Header().Set(AuthSubjectHeader, r.Header.Get(AuthSubjectHeader))
+		w.Header().Set("X-Auth-Claim-Email", r.Header.Get("X-Auth-Claim-Email"))
+		w.Header().Set("X-Auth-Claim-Groups", r.Header.Get("X-Auth-Claim-Groups"))
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// encodedSecret encodes a secret value like the secrets API does.
+func encodedSecret(value string) string {
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func setupAuthProxy(annotations map[string]string, secrets services.Secrets, resolver BaseURLResolver) http.HandlerFunc {
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.ScaleFromZero = false
+
+	fn := ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}
+	return NewHandlerFunc(providerConfig, resolver, &staticFunctions{function: fn}, nil, secrets, nil, nil, hclog.NewNullLogger())
+}
+
+func invokeWithHeaders(handler http.HandlerFunc, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+func TestProxyRejectsMissingAPIKeyBeforeResolving(t *testing.T) {
+	secrets := &services.MockSecrets{}
+	resolver := &countingResolver{}
+	handler := setupAuthProxy(map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys"}, secrets, resolver)
+
+	recorder := invokeWithHeaders(handler, nil)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	secrets.On("Get", "echo-keys").Return(encodedSecret("old-key\nnew-key"), nil)
+
+	recorder = invokeWithHeaders(handler, map[string]string{defaultAPIKeyHeader: "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, 0, resolver.calls)
+}
+
+func TestProxyAcceptsAPIKeysFromSecret(t *testing.T) {
+	server := identityServer()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	secrets := &services.MockSecrets{}
+	secrets.On("Get", "echo-keys").Return(encodedSecret("old-key\nnew-key"), nil).Once()
+
+	annotations := map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys", authAPIKeyHeaderAnnotation: "X-Echo-Key"}
+	handler := setupAuthProxy(annotations, secrets, &staticResolver{candidates: []url.URL{*u}})
+
+	for _, key := range []string{"old-key", "new-key"} {
+		recorder := invokeWithHeaders(handler, map[string]string{"X-Echo-Key": key, AuthSubjectHeader: "admin"})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "api_key", recorder.Header().Get(AuthMethodHeader))
+		assert.Equal(t, "", recorder.Header().Get(AuthSubjectHeader))
+	}
+
+	// the secret is cached
+	secrets.AssertNumberOfCalls(t, "Get", 1)
+}
+
+func TestProxyAcceptsBasicAuthCredentials(t *testing.T) {
+	server := identityServer()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+
+	secrets := &services.MockSecrets{}
+	secrets.On("Get", "echo-users").Return(encodedSecret("alice:wonderland\nbob:"+string(hash)), nil)
+
+	handler := setupAuthProxy(map[string]string{authAnnotation: "basic", authBasicSecretAnnotation: "echo-users"}, secrets, &staticResolver{candidates: []url.URL{*u}})
+
+	invoke := func(user, password string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+		request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+		request.SetBasicAuth(user, password)
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder
+	}
+
+	recorder := invoke("alice", "wonderland")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "alice", recorder.Header().Get(AuthSubjectHeader))
+
+	recorder = invoke("bob", "s3cret")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "bob", recorder.Header().Get(AuthSubjectHeader))
+
+	recorder = invoke("bob", "wonderland")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `Basic realm="echo"`, recorder.Header().Get("WWW-Authenticate"))
+}
+
+func TestProxyRejectsWhenSecretsAreUnavailable(t *testing.T) {
+	secrets := &services.MockSecrets{}
+	secrets.On("Get", "echo-keys").Return("", errors.New("vault is sealed"))
+
+	resolver := &countingResolver{}
+	handler := setupAuthProxy(map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys"}, secrets, resolver)
+
+	recorder := invokeWithHeaders(handler, map[string]string{defaultAPIKeyHeader: "key"})
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, 0, resolver.calls)
+}
+
+type signer struct {
+	key  *rsa.PrivateKey
+	kid  string
+	jose jose.Signer
+}
+
+func newSigner(t *testing.T, kid string) *signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{key: key, kid: kid, jose: s}
+}
+
+func (s *signer) jwks() []byte {
+	data, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &s.key.PublicKey, KeyID: s.kid, Algorithm: "RS256", Use: "sig"}}})
+	return data
+}
+
+func (s *signer) token(t *testing.T, claims jwt.Claims, extra map[string]interface{}) string {
+	token, err := jwt.Signed(s.jose).Claims(claims).Claims(extra).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestProxyVerifiesTokensWithJWKSFile(t *testing.T) {
+	server := identityServer()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	s := newSigner(t, "key-1")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(jwks, s.jwks(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations := map[string]string{
+		authAnnotation:         "jwt",
+		authJWKSAnnotation:     jwks,
+		authIssuerAnnotation:   "https://issuer.example.com",
+		authAudienceAnnotation: "echo",
+		authClaimsAnnotation:   "email,groups",
+	}
+	handler := setupAuthProxy(annotations, nil, &staticResolver{candidates: []url.URL{*u}})
+
+	now := time.Now()
+	valid := jwt.Claims{Issuer: "https://issuer.example.com", Subject: "alice", Audience: jwt.Audience{"echo"}, Expiry: jwt.NewNumericDate(now.Add(time.Hour))}
+	extra := map[string]interface{}{"email": "alice@example.com", "groups": []string{"admins", "users"}}
+
+	recorder := invokeWithHeaders(handler, map[string]string{"Authorization": "Bearer " + s.token(t, valid, extra), "X-Auth-Claim-Email": "eve@example.com"})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "jwt", recorder.Header().Get(AuthMethodHeader))
+	assert.Equal(t, "alice", recorder.Header().Get(AuthSubjectHeader))
+	assert.Equal(t, "alice@example.com", recorder.Header().Get("X-Auth-Claim-Email"))
+	assert.Equal(t, "admins,users", recorder.Header().Get("X-Auth-Claim-Groups"))
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+	recorder = invokeWithHeaders(handler, map[string]string{"Authorization": "Bearer " + s.token(t, expired, nil)})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `Bearer realm="echo"`, recorder.Header().Get("WWW-Authenticate"))
+
+	otherAudience := valid
+	otherAudience.Audience = jwt.Audience{"other"}
+	recorder = invokeWithHeaders(handler, map[string]string{"Authorization": "Bearer " + s.token(t, otherAudience, nil)})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	forged := newSigner(t, "key-1")
+	recorder = invokeWithHeaders(handler, map[string]string{"Authorization": "Bearer " + forged.token(t, valid, nil)})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestAuthenticatorReloadsJWKSForRotatedKeys(t *testing.T) {
+	var mu sync.Mutex
+	current := newSigner(t, "key-1")
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(current.jwks())
+	}))
+	defer jwksServer.Close()
+
+	config := types.ProxyConfig{AuthJWKS: jwksServer.URL, AuthJWKSRefreshInterval: time.Hour}
+	a := newAuthenticator(config, nil, hclog.NewNullLogger())
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	policy := authPolicy{methods: []string{authMethodJWT}, jwks: jwksServer.URL}
+	claims := jwt.Claims{Subject: "alice", Expiry: jwt.NewNumericDate(now.Add(time.Hour))}
+
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	request.Header.Set("Authorization", "Bearer "+current.token(t, claims, nil))
+	_, err := a.authenticate(request, policy)
+	assert.NoError(t, err)
+
+	rotated := newSigner(t, "key-2")
+	mu.Lock()
+	current = rotated
+	mu.Unlock()
+	request.Header.Set("Authorization", "Bearer "+rotated.token(t, claims, nil))
+
+	// the key set is reloaded at most once per interval
+	_, err = a.authenticate(request, policy)
+	assert.Equal(t, errUnauthenticated, err)
+
+	now = now.Add(jwksMinRefreshInterval)
+	id, err := a.authenticate(request, policy)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", id.subject)
+}
+
+type failingFunctions struct {
+	function *ftypes.FunctionStatus
+}
+
+func (f *failingFunctions) Get(functionName string) (*ftypes.FunctionStatus, error) {
+	if f.function == nil {
+		return nil, errors.New("nomad unavailable")
+	}
+	return f.function, nil
+}
+
+func (f *failingFunctions) Invalidate(functionName string) {
+}
+
+func TestProxyKeepsProtectingFunctionsWhenDetailsAreUnavailable(t *testing.T) {
+	server := identityServer()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.ScaleFromZero = false
+
+	functions := &failingFunctions{function: &ftypes.FunctionStatus{Name: "echo", Annotations: &map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys"}}}
+	handler := NewHandlerFunc(providerConfig, &staticResolver{candidates: []url.URL{*u}}, functions, nil, &services.MockSecrets{}, nil, nil, hclog.NewNullLogger())
+
+	assert.Equal(t, http.StatusUnauthorized, invokeWithHeaders(handler, nil).Code)
+
+	functions.function = nil
+	assert.Equal(t, http.StatusUnauthorized, invokeWithHeaders(handler, nil).Code)
+}
+
+func TestProxyAllowsFunctionsNotKnownToBeProtectedWhenDetailsAreUnavailable(t *testing.T) {
+	server := identityServer()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.ScaleFromZero = false
+
+	// e.g. with the file discovery, the functions aren't deployed on Nomad
+	functions := &failingFunctions{}
+	handler := NewHandlerFunc(providerConfig, &staticResolver{candidates: []url.URL{*u}}, functions, nil, &services.MockSecrets{}, nil, nil, hclog.NewNullLogger())
+
+	assert.Equal(t, http.StatusOK, invokeWithHeaders(handler, nil).Code)
+
+	// a function which is no longer protected isn't protected again when its details are unavailable
+	functions.function = &ftypes.FunctionStatus{Name: "echo", Annotations: &map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys"}}
+	assert.Equal(t, http.StatusUnauthorized, invokeWithHeaders(handler, nil).Code)
+
+	functions.function = &ftypes.FunctionStatus{Name: "echo"}
+	assert.Equal(t, http.StatusOK, invokeWithHeaders(handler, nil).Code)
+
+	functions.function = nil
+	assert.Equal(t, http.StatusOK, invokeWithHeaders(handler, nil).Code)
+}
+
+func TestProxyRejectsUndecodableSecrets(t *testing.T) {
+	secrets := &services.MockSecrets{}
+	secrets.On("Get", "echo-keys").Return("not base64", nil)
+	handler := setupAuthProxy(map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys"}, secrets, &countingResolver{})
+
+	recorder := invokeWithHeaders(handler, map[string]string{defaultAPIKeyHeader: "not base64"})
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	StrategyRoundRobin    = types.StrategyRoundRobin
+	StrategyRandom        = types.StrategyRandom
+	StrategyLeastRequests = types.StrategyLeastRequests
+	StrategyP2C           = types.StrategyP2C
+	StrategyHash          = types.StrategyHash
+
+	strategyAnnotation   = "com.openfaas.proxy.strategy"
+	hashHeaderAnnotation = "com.openfaas.proxy.hash_header"
+)
+
+// Balancer selects the endpoint of a function which will receive a request.
+type Balancer interface {
+	Select(function string, candidates []url.URL, r *http.Request) (url.URL, error)
+}
+
+// balancers holds the available load balancing strategies and picks the one configured for a function.
+type balancers struct {
+	defaultStrategy   string
+	defaultHashHeader string
+	strategies        map[string]Balancer
+}
+
+func newBalancers(config types.ProxyConfig, load *endpointLoad) (*balancers, error) {
+	b := &balancers{
+		defaultStrategy:   config.Strategy,
+		defaultHashHeader: config.HashHeader,
+		strategies: map[string]Balancer{
+			StrategyRoundRobin:    &roundRobinBalancer{},
+			StrategyRandom:        &randomBalancer{},
+			StrategyLeastRequests: &leastRequestsBalancer{load: load},
+			StrategyP2C:           &p2cBalancer{load: load},
+		},
+	}
+
+	if !b.supports(config.Strategy) {
+		return nil, fmt.Errorf("unsupported proxy strategy '%s'", config.Strategy)
+	}
+
+	return b, nil
+}
+
+func (b *balancers) supports(strategy string) bool {
+	_, ok := b.strategies[strategy]
+	return ok || strategy == StrategyHash
+}
+
+// forFunction returns the Balancer for a function, taking the annotation overrides of the function into account.
+func (b *balancers) forFunction(fn *ftypes.FunctionStatus) Balancer {
+	strategy := b.defaultStrategy
+	hashHeader := b.defaultHashHeader
+
+	if fn != nil {
+		strategy = types.ParseStringValueFromMap(fn.Annotations, strategyAnnotation, strategy)
+		hashHeader = types.ParseStringValueFromMap(fn.Annotations, hashHeaderAnnotation, hashHeader)
+	}
+
+	if strategy == StrategyHash {
+		return &hashBalancer{header: hashHeader}
+	}
+
+	if s, ok := b.strategies[strategy]; ok {
+		return s
+	}
+
+	return b.strategies[b.defaultStrategy]
+}
+
+// roundRobinBalancer cycles through the candidates, keeping a separate position per function.
+type roundRobinBalancer struct {
+	counters sync.Map
+}
+
+func (rr *roundRobinBalancer) Select(function string, candidates []url.URL, r *http.Request) (url.URL, error) {
+	if len(candidates) == 0 {
+		return url.URL{}, errNoCandidates
+	}
+	val, _ := rr.counters.LoadOrStore(function, new(uint64))
+	next := atomic.AddUint64(val.(*uint64), 1)
+	return candidates[(next-1)%uint64(len(candidates))], nil
+}
+
+type randomBalancer struct {
+}
+
+func (rb *randomBalancer) Select(function string, candidates []url.URL, r *http.Request) (url.URL, error) {
+	if len(candidates) == 0 {
+		return url.URL{}, errNoCandidates
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+// leastRequestsBalancer selects the candidate with the fewest outstanding requests.
+type leastRequestsBalancer struct {
+	load *endpointLoad
+}
+
+func (lb *leastRequestsBalancer) Select(function string, candidates []url.URL, r *http.Request) (url.URL, error) {
+	if len(candidates) == 0 {
+		return url.URL{}, errNoCandidates
+	}
+
+	// start at a random offset so ties don't always favour the first candidate
+	offset := rand.Intn(len(candidates))
+	selected := candidates[offset]
+	min := lb.load.get(selected)
+
+	for i := 1; i < len(candidates); i++ {
+		c := candidates[(offset+i)%len(candidates)]
+		if l := lb.load.get(c); l < min {
+			selected = c
+			min = l
+		}
+	}
+
+	return selected, nil
+}
+
+// p2cBalancer picks two random candidates and selects the one with the fewest outstanding requests.
+type p2cBalancer struct {
+	load *endpointLoad
+}
+
+func (pb *p2cBalancer) Select(function string, candidates []url.URL, r *http.Request) (url.URL, error) {
+	if len(candidates) == 0 {
+		return url.URL{}, errNoCandidates
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := candidates[i], candidates[j]
+	if pb.load.get(b) < pb.load.get(a) {
+		return b, nil
+	}
+	return a, nil
+}
+
+// hashBalancer uses rendezvous hashing on the value of a request header, so requests with the same
+// key reach the same candidate while only a minimal number of keys move when candidates change.
+// When the header is not configured, the client address is used as key.
+type hashBalancer struct {
+	header string
+}
+
+func (hb *hashBalancer) Select(function string, candidates []url.URL, r *http.Request) (url.URL, error) {
+	if len(candidates) == 0 {
+		return url.URL{}, errNoCandidates
+	}
+
+	key := hb.key(r)
+	if key == "" {
+		return candidates[rand.Intn(len(candidates))], nil
+	}
+
+	var selected url.URL
+	var max uint64
+
+	for i, c := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(c.Host))
+		if sum := h.Sum64(); i == 0 || sum > max {
+			selected = c
+			max = sum
+		}
+	}
+
+	return selected, nil
+}
+
+func (hb *hashBalancer) key(r *http.Request) string {
+	if hb.header != "" {
+		return r.Header.Get(hb.header)
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// endpointLoad keeps track of the outstanding requests per endpoint. The endpoints without outstanding
+// requests are dropped, as the ports of the function instances are dynamic.
+type endpointLoad struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (el *endpointLoad) acquire(u url.URL) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if el.counters == nil {
+		el.counters = map[string]int64{}
+	}
+	el.counters[u.Host]++
+}
+
+func (el *endpointLoad) release(u url.URL) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if el.counters[u.Host] <= 1 {
+		delete(el.counters, u.Host)
+		return
+	}
+	el.counters[u.Host]--
+}
+
+func (el *endpointLoad) get(u url.URL) int64 {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	return el.counters[u.Host]
+}
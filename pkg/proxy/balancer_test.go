@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func createCandidates(hosts ...string) []url.URL {
+	var candidates []url.URL
+	for _, h := range hosts {
+		candidates = append(candidates, url.URL{Scheme: "http", Host: h})
+	}
+	return candidates
+}
+
+func TestRoundRobinBalancerCyclesThroughCandidatesPerFunction(t *testing.T) {
+	balancer := &roundRobinBalancer{}
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+	request := httptest.NewRequest("GET", "/function/test", nil)
+
+	var selected []string
+	for i := 0; i < 4; i++ {
+		u, _ := balancer.Select("fn1", candidates, request)
+		selected = append(selected, u.Host)
+	}
+	other, _ := balancer.Select("fn2", candidates, request)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.1:8080"}, selected)
+	assert.Equal(t, "10.0.0.1:8080", other.Host)
+}
+
+func TestLeastRequestsBalancerSelectsLeastLoadedCandidate(t *testing.T) {
+	load := &endpointLoad{}
+	balancer := &leastRequestsBalancer{load: load}
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+	request := httptest.NewRequest("GET", "/function/test", nil)
+
+	load.acquire(candidates[0])
+	load.acquire(candidates[0])
+	load.acquire(candidates[2])
+
+	for i := 0; i < 10; i++ {
+		u, _ := balancer.Select("fn1", candidates, request)
+		assert.Equal(t, "10.0.0.2:8080", u.Host)
+	}
+}
+
+func TestEndpointLoadDropsIdleEndpoints(t *testing.T) {
+	load := &endpointLoad{}
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	load.acquire(candidates[0])
+	load.acquire(candidates[0])
+	load.acquire(candidates[1])
+	load.release(candidates[0])
+	load.release(candidates[1])
+
+	assert.Equal(t, int64(1), load.get(candidates[0]))
+	assert.Equal(t, int64(0), load.get(candidates[1]))
+	assert.Len(t, load.counters, 1)
+
+	load.release(candidates[0])
+	assert.Empty(t, load.counters)
+}
+
+func TestP2CBalancerNeverSelectsMostLoadedCandidate(t *testing.T) {
+	load := &endpointLoad{}
+	balancer := &p2cBalancer{load: load}
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+	request := httptest.NewRequest("GET", "/function/test", nil)
+
+	load.acquire(candidates[1])
+
+	for i := 0; i < 50; i++ {
+		u, _ := balancer.Select("fn1", candidates, request)
+		assert.NotEqual(t, "10.0.0.2:8080", u.Host)
+	}
+}
+
+func TestHashBalancerIsConsistentForSameKey(t *testing.T) {
+	balancer := &hashBalancer{header: "X-User"}
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080")
+
+	request := httptest.NewRequest("GET", "/function/test", nil)
+	request.Header.Set("X-User", "alice")
+
+	first, _ := balancer.Select("fn1", candidates, request)
+	for i := 0; i < 10; i++ {
+		u, _ := balancer.Select("fn1", candidates, request)
+		assert.Equal(t, first, u)
+	}
+
+	// removing another candidate keeps the key on the same candidate
+	var remaining []url.URL
+	for _, c := range candidates {
+		if c != first {
+			remaining = append(remaining, c)
+			break
+		}
+	}
+	remaining = append(remaining, first)
+
+	u, _ := balancer.Select("fn1", remaining, request)
+	assert.Equal(t, first, u)
+}
+
+func TestBalancersUseAnnotationOverride(t *testing.T) {
+	b, err := newBalancers(types.ProxyConfig{Strategy: StrategyRoundRobin}, &endpointLoad{})
+	assert.NoError(t, err)
+
+	annotations := map[string]string{
+		strategyAnnotation:   StrategyHash,
+		hashHeaderAnnotation: "X-Tenant",
+	}
+
+	assert.IsType(t, &roundRobinBalancer{}, b.forFunction(nil))
+	assert.Equal(t, &hashBalancer{header: "X-Tenant"}, b.forFunction(&ftypes.FunctionStatus{Annotations: &annotations}))
+}
+
+func TestBalancersRejectUnknownStrategy(t *testing.T) {
+	_, err := newBalancers(types.ProxyConfig{Strategy: "unknown"}, &endpointLoad{})
+
+	assert.Error(t, err)
+}
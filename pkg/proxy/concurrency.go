@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	concurrencyAnnotation  = "com.openfaas.concurrency"
+	queueSizeAnnotation    = "com.openfaas.concurrency.queue_size"
+	queueTimeoutAnnotation = "com.openfaas.concurrency.queue_timeout"
+)
+
+var (
+	errQueueFull    = errors.New("queue is full")
+	errQueueTimeout = errors.New("timeout waiting in queue")
+)
+
+// concurrencyPolicy caps the in-flight requests per endpoint of a function annotated with `com.openfaas.concurrency`.
+// Excess requests wait in a bounded queue until an endpoint has capacity, or the queue timeout passes.
+type concurrencyPolicy struct {
+	perEndpoint  int
+	queueSize    int
+	queueTimeout time.Duration
+}
+
+func newConcurrencyPolicy(config types.ProxyConfig, fn *ftypes.FunctionStatus) concurrencyPolicy {
+	if fn == nil {
+		return concurrencyPolicy{}
+	}
+
+	return concurrencyPolicy{
+		perEndpoint:  types.ParseIntValueFromMap(fn.Annotations, concurrencyAnnotation, 0),
+		queueSize:    types.ParseIntValueFromMap(fn.Annotations, queueSizeAnnotation, config.QueueSize),
+		queueTimeout: types.ParseIntOrDurationValueFromMap(fn.Annotations, queueTimeoutAnnotation, config.QueueTimeout),
+	}
+}
+
+func (cp concurrencyPolicy) enabled() bool {
+	return cp.perEndpoint > 0
+}
+
+// concurrencyLimiter admits the requests of a function as long as its endpoints have capacity,
+// and queues the other ones in arrival order.
+type concurrencyLimiter struct {
+	observers observers
+
+	mu     sync.Mutex
+	queues map[string]*functionQueue
+}
+
+type functionQueue struct {
+	capacity int
+	inflight int
+	waiting  []chan struct{}
+}
+
+func newConcurrencyLimiter(o observers) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		observers: o,
+		queues:    map[string]*functionQueue{},
+	}
+}
+
+// admit blocks until the request can be sent to one of the candidates. On success, the caller must call the
+// returned release function once the request is done.
+func (cl *concurrencyLimiter) admit(ctx context.Context, function string, candidates []url.URL, policy concurrencyPolicy) (func(), error) {
+	if !policy.enabled() {
+		return func() {}, nil
+	}
+
+	release := func() { cl.release(function) }
+
+	cl.mu.Lock()
+	q, ok := cl.queues[function]
+	if !ok {
+		q = &functionQueue{}
+		cl.queues[function] = q
+	}
+	q.capacity = policy.perEndpoint * len(candidates)
+	q.dispatch()
+
+	if q.inflight < q.capacity {
+		q.inflight++
+		cl.mu.Unlock()
+		return release, nil
+	}
+
+	if len(q.waiting) >= policy.queueSize {
+		cl.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	ready := make(chan struct{})
+	q.waiting = append(q.waiting, ready)
+	depth := len(q.waiting)
+	cl.mu.Unlock()
+
+	cl.observers.queued(function, depth)
+
+	timer := time.NewTimer(policy.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return release, nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mu.Lock()
+	removed := q.remove(ready)
+	depth = len(q.waiting)
+	cl.mu.Unlock()
+
+	if !removed {
+		// the request got a slot right before giving up, hand it over to the next one
+		release()
+		return nil, err
+	}
+
+	cl.observers.queued(function, depth)
+	return nil, err
+}
+
+// release frees the slot of a request, handing it over to the first queued request if any.
+func (cl *concurrencyLimiter) release(function string) {
+	cl.mu.Lock()
+
+	q := cl.queues[function]
+	q.inflight--
+	woken := q.dispatch()
+	depth := len(q.waiting)
+
+	if q.inflight == 0 && depth == 0 {
+		delete(cl.queues, function)
+	}
+	cl.mu.Unlock()
+
+	if woken > 0 {
+		cl.observers.queued(function, depth)
+	}
+}
+
+// dispatch admits queued requests while there is capacity, and returns how many were admitted.
+func (q *functionQueue) dispatch() int {
+	woken := 0
+	for q.inflight < q.capacity && len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.inflight++
+		close(next)
+		woken++
+	}
+	return woken
+}
+
+func (q *functionQueue) remove(ready chan struct{}) bool {
+	for i, w := range q.waiting {
+		if w == ready {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// available returns the candidates with less than max outstanding requests, or all of them when none has capacity.
+func (el *endpointLoad) available(candidates []url.URL, max int) []url.URL {
+	if result := el.withCapacity(candidates, max); len(result) > 0 {
+		return result
+	}
+	return candidates
+}
+
+// withCapacity returns the candidates with less than max outstanding requests, or all of them without a max.
+func (el *endpointLoad) withCapacity(candidates []url.URL, max int) []url.URL {
+	if max <= 0 {
+		return candidates
+	}
+
+	var result []url.URL
+	for _, c := range candidates {
+		if el.get(c) < int64(max) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
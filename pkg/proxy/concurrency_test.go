@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type queueRecorder struct {
+	mu     sync.Mutex
+	depths []int
+}
+
+func (q *queueRecorder) InvocationStarted(function string) {}
+
+func (q *queueRecorder) InvocationFinished(function string, statusCode int, duration time.Duration) {}
+
+func (q *queueRecorder) QueueDepthChanged(function string, depth int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.depths = append(q.depths, depth)
+}
+
+func (q *queueRecorder) recorded() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]int{}, q.depths...)
+}
+
+var singleEndpoint = []url.URL{{Scheme: "http", Host: "10.0.0.1:8080"}}
+
+func TestConcurrencyLimiterQueuesExcessRequests(t *testing.T) {
+	recorder := &queueRecorder{}
+	limiter := newConcurrencyLimiter(observers{recorder})
+	policy := concurrencyPolicy{perEndpoint: 1, queueSize: 1, queueTimeout: time.Second}
+
+	release, err := limiter.admit(context.Background(), "echo", singleEndpoint, policy)
+	assert.NoError(t, err)
+
+	admitted := make(chan error)
+	go func() {
+		release, err := limiter.admit(context.Background(), "echo", singleEndpoint, policy)
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+
+	assert.Eventually(t, func() bool { return len(recorder.recorded()) == 1 }, time.Second, time.Millisecond)
+
+	_, err = limiter.admit(context.Background(), "echo", singleEndpoint, policy)
+	assert.Equal(t, errQueueFull, err)
+
+	release()
+	assert.NoError(t, <-admitted)
+	assert.Equal(t, []int{1, 0}, recorder.recorded())
+}
+
+func TestConcurrencyLimiterTimesOutQueuedRequests(t *testing.T) {
+	limiter := newConcurrencyLimiter(nil)
+	policy := concurrencyPolicy{perEndpoint: 1, queueSize: 1, queueTimeout: 10 * time.Millisecond}
+
+	release, err := limiter.admit(context.Background(), "echo", singleEndpoint, policy)
+	assert.NoError(t, err)
+
+	_, err = limiter.admit(context.Background(), "echo", singleEndpoint, policy)
+	assert.Equal(t, errQueueTimeout, err)
+
+	release()
+
+	release, err = limiter.admit(context.Background(), "echo", singleEndpoint, policy)
+	assert.NoError(t, err)
+	release()
+}
+
+func TestConcurrencyLimiterScalesWithEndpoints(t *testing.T) {
+	limiter := newConcurrencyLimiter(nil)
+	policy := concurrencyPolicy{perEndpoint: 2, queueSize: 0}
+	endpoints := []url.URL{{Host: "10.0.0.1:8080"}, {Host: "10.0.0.2:8080"}}
+
+	for i := 0; i < 4; i++ {
+		_, err := limiter.admit(context.Background(), "echo", endpoints, policy)
+		assert.NoError(t, err)
+	}
+
+	_, err := limiter.admit(context.Background(), "echo", endpoints, policy)
+	assert.Equal(t, errQueueFull, err)
+}
+
+func TestProxyRejectsRequestsWhenQueueIsFull(t *testing.T) {
+	started := make(chan struct{})
+	done := make(chan struct{})
+	function := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-done
+	}))
+	defer function.Close()
+
+	annotations := map[string]string{concurrencyAnnotation: "1", queueSizeAnnotation: "0"}
+	handler := setupProxyWithFunction(ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}, time.Minute, types.ProxyConfig{}, serverEndpoint(function))
+
+	first := make(chan int)
+	go func() {
+		first <- invokeProxy(handler, http.MethodGet, "").Code
+	}()
+	<-started
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+
+	close(done)
+	assert.Equal(t, http.StatusOK, <-first)
+}
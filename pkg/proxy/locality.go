@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/url"
+
+	"github.com/jsiebens/faas-nomad/pkg/resolver"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+// DatacenterHeader reports the datacenter of the function instance which served the request, when the resolver
+// reports it, e.g. to see when a request was served by a failover datacenter. The Consul datacenter of the instance
+// is reported when it is known.
+const DatacenterHeader = "X-Function-Datacenter"
+
+// EndpointResolver can be implemented by a BaseURLResolver to report the location of the endpoints,
+// so the proxy can prefer the endpoints close to the provider.
+type EndpointResolver interface {
+	ResolveEndpoints(functionName string) ([]resolver.Endpoint, error)
+}
+
+// locality prefers the endpoints running in the datacenter and zone of the provider. The zone of an
+// endpoint is read from the metadata of its node. Remote endpoints are only used when no local endpoint
+// is healthy, or when all local endpoints are saturated.
+type locality struct {
+	datacenter string
+	zone       string
+	zoneKey    string
+	maxLoad    int
+}
+
+func newLocality(config types.ProxyConfig) *locality {
+	return &locality{
+		datacenter: config.LocalityDatacenter,
+		zone:       config.LocalityZone,
+		zoneKey:    config.LocalityZoneKey,
+		maxLoad:    config.LocalityMaxLoad,
+	}
+}
+
+func (l *locality) enabled() bool {
+	return l.datacenter != "" || l.zone != ""
+}
+
+func (l *locality) isLocal(e resolver.Endpoint) bool {
+	if l.datacenter != "" && e.Datacenter != l.datacenter {
+		return false
+	}
+	if l.zone != "" && e.NodeMeta[l.zoneKey] != l.zone {
+		return false
+	}
+	return true
+}
+
+// partition splits the candidates in local and remote endpoints. Endpoints with an unknown location are local.
+func (l *locality) partition(candidates []url.URL, locations locations) ([]url.URL, []url.URL) {
+	if !l.enabled() || len(locations) == 0 {
+		return candidates, nil
+	}
+
+	var local, remote []url.URL
+	for _, c := range candidates {
+		if e, ok := locations[c.Host]; ok && !l.isLocal(e) {
+			remote = append(remote, c)
+		} else {
+			local = append(local, c)
+		}
+	}
+	return local, remote
+}
+
+// locations holds the resolved endpoints of a function by host, when the resolver reports their location.
+type locations map[string]resolver.Endpoint
+
+// datacenterOf returns the datacenter reported for an endpoint, or an empty string when it is unknown. The
+// Consul datacenter of the endpoint is preferred, see DatacenterHeader.
+func (l locations) datacenterOf(endpoint url.URL) string {
+	e, ok := l[endpoint.Host]
+	if !ok {
+		return ""
+	}
+	if e.ConsulDatacenter != "" {
+		return e.ConsulDatacenter
+	}
+	return e.Datacenter
+}
+
+// resolveAll returns the endpoints of the function, with their location when the resolver reports it.
+func (p *functionProxy) resolveAll(functionName string) ([]url.URL, locations, error) {
+	er, ok := p.resolver.(EndpointResolver)
+	if !ok {
+		candidates, err := p.resolver.ResolveAll(functionName)
+		return candidates, nil, err
+	}
+
+	endpoints, err := er.ResolveEndpoints(functionName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := make([]url.URL, 0, len(endpoints))
+	located := make(locations, len(endpoints))
+	for _, e := range endpoints {
+		candidates = append(candidates, e.URL)
+		located[e.URL.Host] = e
+	}
+	return candidates, located, nil
+}
+
+// preferred returns the local candidates with capacity, or else the remote candidates with capacity.
+// Without a concurrency limit per endpoint, local endpoints are saturated when they reach the locality max load.
+func (p *functionProxy) preferred(candidates []url.URL, locations locations, perEndpoint int) []url.URL {
+	local, remote := p.locality.partition(candidates, locations)
+	if len(local) == 0 || len(remote) == 0 {
+		return p.load.available(candidates, perEndpoint)
+	}
+
+	max := perEndpoint
+	if max <= 0 {
+		max = p.locality.maxLoad
+	}
+
+	if available := p.load.withCapacity(local, max); len(available) > 0 {
+		return available
+	}
+	if available := p.load.withCapacity(remote, max); len(available) > 0 {
+		return available
+	}
+	return candidates
+}
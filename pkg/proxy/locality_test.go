@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/resolver"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type endpointResolver struct {
+	endpoints []resolver.Endpoint
+}
+
+func (e *endpointResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	var result []url.URL
+	for _, endpoint := range e.endpoints {
+		result = append(result, endpoint.URL)
+	}
+	return result, nil
+}
+
+func (e *endpointResolver) ResolveEndpoints(functionName string) ([]resolver.Endpoint, error) {
+	return e.endpoints, nil
+}
+
+func zoneEndpoint(u url.URL, zone string) resolver.Endpoint {
+	return resolver.Endpoint{URL: u, Datacenter: "dc1", NodeMeta: map[string]string{"zone": zone}}
+}
+
+func setupLocalityProxy(config types.ProxyConfig, endpoints ...resolver.Endpoint) http.HandlerFunc {
+	providerConfig, _ := types.DefaultConfig()
+	config.Strategy = StrategyRoundRobin
+	config.LocalityDatacenter = "dc1"
+	config.LocalityZone = "a"
+	config.LocalityZoneKey = "zone"
+	providerConfig.Proxy = config
+
+	return NewHandlerFunc(providerConfig, &endpointResolver{endpoints: endpoints}, nil, nil, nil, nil, nil, hclog.NewNullLogger())
+}
+
+func TestLocalityPartitionsEndpoints(t *testing.T) {
+	l := newLocality(types.ProxyConfig{LocalityDatacenter: "dc1", LocalityZone: "a", LocalityZoneKey: "zone"})
+
+	local := url.URL{Host: "10.0.0.1:8080"}
+	otherZone := url.URL{Host: "10.0.0.2:8080"}
+	otherDatacenter := url.URL{Host: "10.0.0.3:8080"}
+	unknown := url.URL{Host: "10.0.0.4:8080"}
+
+	located := locations{
+		local.Host:           zoneEndpoint(local, "a"),
+		otherZone.Host:       zoneEndpoint(otherZone, "b"),
+		otherDatacenter.Host: {URL: otherDatacenter, Datacenter: "dc2", NodeMeta: map[string]string{"zone": "a"}},
+	}
+
+	localEndpoints, remoteEndpoints := l.partition([]url.URL{local, otherZone, otherDatacenter, unknown}, located)
+	assert.Equal(t, []url.URL{local, unknown}, localEndpoints)
+	assert.Equal(t, []url.URL{otherZone, otherDatacenter}, remoteEndpoints)
+
+	disabled := newLocality(types.ProxyConfig{})
+	localEndpoints, remoteEndpoints = disabled.partition([]url.URL{local, otherZone}, located)
+	assert.Equal(t, []url.URL{local, otherZone}, localEndpoints)
+	assert.Empty(t, remoteEndpoints)
+}
+
+func TestProxyPrefersLocalEndpoints(t *testing.T) {
+	local := versionServer("local")
+	defer local.Close()
+	remote := versionServer("remote")
+	defer remote.Close()
+
+	handler := setupLocalityProxy(types.ProxyConfig{}, zoneEndpoint(serverEndpoint(remote), "b"), zoneEndpoint(serverEndpoint(local), "a"))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "local", invokeProxy(handler, http.MethodGet, "").Body.String())
+	}
+}
+
+func TestProxyFallsBackToRemoteEndpoints(t *testing.T) {
+	remote := versionServer("remote")
+	defer remote.Close()
+
+	handler := setupLocalityProxy(types.ProxyConfig{MaxRetries: 1}, zoneEndpoint(closedEndpoint(t), "a"), zoneEndpoint(serverEndpoint(remote), "b"))
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "remote", recorder.Body.String())
+}
+
+func TestProxyFallsBackToRemoteEndpointsWhenLocalAreSaturated(t *testing.T) {
+	started := make(chan struct{})
+	done := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-done
+		w.Write([]byte("local"))
+	}))
+	defer local.Close()
+	remote := versionServer("remote")
+	defer remote.Close()
+
+	handler := setupLocalityProxy(types.ProxyConfig{LocalityMaxLoad: 1}, zoneEndpoint(serverEndpoint(local), "a"), zoneEndpoint(serverEndpoint(remote), "b"))
+
+	first := make(chan string)
+	go func() {
+		first <- invokeProxy(handler, http.MethodGet, "").Body.String()
+	}()
+	<-started
+
+	assert.Equal(t, "remote", invokeProxy(handler, http.MethodGet, "").Body.String())
+
+	close(done)
+	assert.Equal(t, "local", <-first)
+}
+
+func TestProxyReportsDatacenterOfEndpoint(t *testing.T) {
+	remote := versionServer("remote")
+	defer remote.Close()
+
+	// locality is disabled, the datacenter is still reported
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.Strategy = StrategyRoundRobin
+	endpoints := []resolver.Endpoint{{URL: serverEndpoint(remote), Datacenter: "dc2"}}
+	handler := NewHandlerFunc(providerConfig, &endpointResolver{endpoints: endpoints}, nil, nil, nil, nil, nil, hclog.NewNullLogger())
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "dc2", recorder.Header().Get(DatacenterHeader))
+
+	// the Consul datacenter of a failover endpoint is reported, rather than its Nomad datacenter
+	failover := []resolver.Endpoint{{URL: serverEndpoint(remote), Datacenter: "west", ConsulDatacenter: "dc3"}}
+	handler = NewHandlerFunc(providerConfig, &endpointResolver{endpoints: failover}, nil, nil, nil, nil, nil, hclog.NewNullLogger())
+	assert.Equal(t, "dc3", invokeProxy(handler, http.MethodGet, "").Header().Get(DatacenterHeader))
+
+	unknown := setupProxy(types.ProxyConfig{}, serverEndpoint(remote))
+	assert.Empty(t, invokeProxy(unknown, http.MethodGet, "").Header().Get(DatacenterHeader))
+}
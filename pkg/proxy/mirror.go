@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jsiebens/faas-nomad/pkg/tracing"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	mirrorAnnotation           = "com.openfaas.mirror.function"
+	mirrorPercentageAnnotation = "com.openfaas.mirror.percentage"
+
+	// MirrorHeader is added to the mirrored requests, with the name of the function receiving the original request.
+	MirrorHeader = "X-Mirrored-From"
+)
+
+// mirrorPolicy duplicates a sample of the requests of a function to a shadow function, e.g. a candidate
+// version which isn't serving any traffic yet. It is configured with the `com.openfaas.mirror.function`
+// and `com.openfaas.mirror.percentage` annotations, all requests are mirrored when no percentage is set.
+type mirrorPolicy struct {
+	shadow     string
+	percentage int
+}
+
+func newMirrorPolicy(fn *ftypes.FunctionStatus) mirrorPolicy {
+	if fn == nil {
+		return mirrorPolicy{}
+	}
+
+	return mirrorPolicy{
+		shadow:     types.ParseStringValueFromMap(fn.Annotations, mirrorAnnotation, ""),
+		percentage: types.ParseIntValueFromMap(fn.Annotations, mirrorPercentageAnnotation, 100),
+	}
+}
+
+func (mp mirrorPolicy) enabled() bool {
+	return mp.shadow != "" && mp.percentage > 0
+}
+
+// sample reports whether the next request is mirrored.
+func (mp mirrorPolicy) sample() bool {
+	return mp.enabled() && rand.Intn(100) < mp.percentage
+}
+
+// mirror sends a copy of the request to the shadow function in the background, and discards the response.
+// Requests with a body larger than the mirror body limit are not mirrored, nor are requests exceeding the
+// maximum number of mirrored requests in flight.
+func (p *functionProxy) mirror(ctx context.Context, originalReq *http.Request, functionName string, policy mirrorPolicy, body *replayableBody) {
+	if !body.replayable || int64(len(body.buffered)) > p.config.MirrorBodyLimit {
+		p.log.Debug("request body too large to mirror", "function", functionName, "shadow", policy.shadow)
+		return
+	}
+
+	select {
+	case p.mirrors <- struct{}{}:
+	default:
+		p.log.Debug("too many mirrored requests in flight", "function", functionName, "shadow", policy.shadow)
+		return
+	}
+
+	name := strings.TrimSuffix(functionName, "."+p.namespace)
+	payload := body.buffered
+	params := mux.Vars(originalReq)["params"]
+
+	// the original request is cloned before the handler returns, the mirror is not bound to its lifetime
+	mirrorReq := originalReq.Clone(trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx)))
+
+	go func() {
+		defer func() { <-p.mirrors }()
+
+		start := time.Now()
+		statusCode, err := p.sendMirror(mirrorReq, name, policy.shadow, params, payload)
+		if err != nil {
+			p.log.Debug("error with mirrored request", "function", name, "shadow", policy.shadow, "error", err.Error())
+		}
+
+		p.observers.mirrored(name, policy.shadow, statusCode, time.Since(start))
+	}()
+}
+
+// sendMirror sends the request to an endpoint of the shadow function, and returns the status code of the response.
+func (p *functionProxy) sendMirror(mirrorReq *http.Request, functionName string, shadow string, params string, payload []byte) (int, error) {
+	ctx, span := tracing.Tracer().Start(mirrorReq.Context(), "mirror",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			tracing.FunctionName.String(shadow),
+			tracing.FunctionNamespace.String(p.namespace),
+		),
+	)
+
+	candidates, locations, err := p.resolveAll(shadow)
+	if err == nil && len(candidates) == 0 {
+		err = errNoCandidates
+	}
+	if err != nil {
+		tracing.EndWithError(span, err)
+		return 0, err
+	}
+
+	fn, _ := p.lookup(shadow)
+	functionAddr, err := p.balancers.forFunction(fn).Select(shadow, p.preferred(p.outliers.filter(candidates), locations, 0), mirrorReq)
+	if err != nil {
+		tracing.EndWithError(span, err)
+		return 0, err
+	}
+
+	proxyReq, err := buildProxyRequest(mirrorReq, functionAddr, params)
+	if err != nil {
+		tracing.EndWithError(span, err)
+		return 0, err
+	}
+
+	if payload != nil {
+		proxyReq.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		proxyReq.ContentLength = int64(len(payload))
+	}
+	proxyReq.Header.Set(MirrorHeader, functionName)
+	tracing.Inject(ctx, proxyReq.Header)
+
+	p.load.acquire(functionAddr)
+	defer p.load.release(functionAddr)
+
+	response, err := p.client.Do(proxyReq.WithContext(ctx))
+	if err != nil {
+		tracing.EndWithError(span, err)
+		return 0, err
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	tracing.EndWithStatus(span, response.StatusCode)
+	return response.StatusCode, nil
+}
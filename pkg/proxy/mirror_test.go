@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type mirroredRequest struct {
+	body   string
+	origin string
+}
+
+type mirrorRecorder struct {
+	statusCodes chan int
+}
+
+func (m *mirrorRecorder) InvocationStarted(function string) {}
+
+func (m *mirrorRecorder) InvocationFinished(function string, statusCode int, duration time.Duration) {
+}
+
+func (m *mirrorRecorder) InvocationMirrored(function string, shadow string, statusCode int, duration time.Duration) {
+	m.statusCodes <- statusCode
+}
+
+func setupMirroredProxy(t *testing.T, annotations map[string]string) (http.HandlerFunc, chan mirroredRequest, *mirrorRecorder) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(primary.Close)
+
+	received := make(chan mirroredRequest, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- mirroredRequest{body: string(body), origin: r.Header.Get(MirrorHeader)}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(shadow.Close)
+
+	resolver := &versionResolver{versions: map[string][]url.URL{
+		"echo":        {serverEndpoint(primary)},
+		"echo-shadow": {serverEndpoint(shadow)},
+	}}
+
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.MirrorBodyLimit = 8
+	recorder := &mirrorRecorder{statusCodes: make(chan int, 10)}
+	handler := NewHandlerFunc(providerConfig, resolver, &staticFunctions{function: ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}}, nil, nil, nil, nil, hclog.NewNullLogger(), recorder)
+
+	return handler, received, recorder
+}
+
+func TestMirrorPolicyFromAnnotations(t *testing.T) {
+	annotations := map[string]string{mirrorAnnotation: "echo-v2"}
+	policy := newMirrorPolicy(&ftypes.FunctionStatus{Annotations: &annotations})
+	assert.Equal(t, mirrorPolicy{shadow: "echo-v2", percentage: 100}, policy)
+	assert.True(t, policy.sample())
+
+	disabled := map[string]string{mirrorAnnotation: "echo-v2", mirrorPercentageAnnotation: "0"}
+	assert.False(t, newMirrorPolicy(&ftypes.FunctionStatus{Annotations: &disabled}).sample())
+
+	assert.False(t, newMirrorPolicy(&ftypes.FunctionStatus{}).sample())
+	assert.False(t, newMirrorPolicy(nil).sample())
+}
+
+func TestProxyMirrorsRequestsToShadowFunction(t *testing.T) {
+	handler, received, recorder := setupMirroredProxy(t, map[string]string{mirrorAnnotation: "echo-shadow"})
+
+	response := invokeProxy(handler, http.MethodPost, "hello")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "hello", response.Body.String())
+
+	select {
+	case r := <-received:
+		assert.Equal(t, "hello", r.body)
+		assert.Equal(t, "echo", r.origin)
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirrored request not received")
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, <-recorder.statusCodes)
+}
+
+func TestProxyDoesNotMirrorLargeBodies(t *testing.T) {
+	handler, received, _ := setupMirroredProxy(t, map[string]string{mirrorAnnotation: "echo-shadow"})
+
+	request := httptest.NewRequest(http.MethodPost, "/function/echo", strings.NewReader("this body is too large"))
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+	response := httptest.NewRecorder()
+	handler(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "this body is too large", response.Body.String())
+
+	select {
+	case <-received:
+		t.Fatal("large request should not be mirrored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
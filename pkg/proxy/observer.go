@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Observer is notified when the proxy starts and finishes handling a function invocation.
+type Observer interface {
+	InvocationStarted(function string)
+	InvocationFinished(function string, statusCode int, duration time.Duration)
+}
+
+// QueueObserver can be implemented by an Observer to be notified when the number of requests queued
+// for a function changes, see the `com.openfaas.concurrency` annotation.
+type QueueObserver interface {
+	QueueDepthChanged(function string, depth int)
+}
+
+// MirrorObserver can be implemented by an Observer to be notified when a mirrored request to a shadow
+// function returns, see the `com.openfaas.mirror.function` annotation. The status code is 0 when the shadow
+// function couldn't be reached.
+type MirrorObserver interface {
+	InvocationMirrored(function string, shadow string, statusCode int, duration time.Duration)
+}
+
+type observers []Observer
+
+func (o observers) started(function string) {
+	for _, observer := range o {
+		observer.InvocationStarted(function)
+	}
+}
+
+func (o observers) finished(function string, statusCode int, duration time.Duration) {
+	for _, observer := range o {
+		observer.InvocationFinished(function, statusCode, duration)
+	}
+}
+
+func (o observers) queued(function string, depth int) {
+	for _, observer := range o {
+		if qo, ok := observer.(QueueObserver); ok {
+			qo.QueueDepthChanged(function, depth)
+		}
+	}
+}
+
+func (o observers) mirrored(function string, shadow string, statusCode int, duration time.Duration) {
+	for _, observer := range o {
+		if mo, ok := observer.(MirrorObserver); ok {
+			mo.InvocationMirrored(function, shadow, statusCode, duration)
+		}
+	}
+}
+
+// statusRecorder captures the status code written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (r *statusRecorder) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+	return r.statusCode
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type invocationRecorder struct {
+	mu       sync.Mutex
+	started  []string
+	finished []int
+}
+
+func (i *invocationRecorder) InvocationStarted(function string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.started = append(i.started, function)
+}
+
+func (i *invocationRecorder) InvocationFinished(function string, statusCode int, duration time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.finished = append(i.finished, statusCode)
+}
+
+func setupObservedProxy(functions *staticFunctions, resolver *staticResolver) (http.HandlerFunc, *invocationRecorder) {
+	config, _ := types.DefaultConfig()
+	recorder := &invocationRecorder{}
+
+	if functions == nil {
+		return NewHandlerFunc(config, resolver, nil, nil, nil, nil, nil, hclog.NewNullLogger(), recorder), recorder
+	}
+	return NewHandlerFunc(config, resolver, functions, nil, nil, nil, nil, hclog.NewNullLogger(), recorder), recorder
+}
+
+func TestProxyDoesNotObserveUnknownFunctions(t *testing.T) {
+	handler, recorder := setupObservedProxy(nil, &staticResolver{})
+
+	response := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Empty(t, recorder.started)
+	assert.Empty(t, recorder.finished)
+}
+
+func TestProxyObservesFunctionsWithEndpoints(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	handler, recorder := setupObservedProxy(nil, &staticResolver{candidates: []url.URL{serverEndpoint(server)}})
+
+	response := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, []string{"echo"}, recorder.started)
+	assert.Equal(t, []int{http.StatusOK}, recorder.finished)
+}
+
+func TestProxyObservesDeployedFunctionsWithoutEndpoints(t *testing.T) {
+	handler, recorder := setupObservedProxy(&staticFunctions{function: ftypes.FunctionStatus{Name: "echo"}}, &staticResolver{})
+
+	response := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Equal(t, []string{"echo"}, recorder.started)
+	assert.Equal(t, []int{http.StatusServiceUnavailable}, recorder.finished)
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// OutlierDetector passively tracks the outcome of the requests sent to each function endpoint.
+// An endpoint failing too many times in a row is ejected from the candidates for a backoff period
+// (open circuit). Once the period is over, a single probe request is allowed (half-open circuit): when
+// it succeeds the endpoint is readmitted, otherwise it is ejected again with a doubled backoff.
+//
+// The endpoints which are no longer resolved for the maximum ejection time, e.g. of stopped allocations, are
+// forgotten.
+type OutlierDetector struct {
+	consecutiveFailures int
+	maxLatency          time.Duration
+	baseEjectionTime    time.Duration
+	maxEjectionTime     time.Duration
+	now                 func() time.Time
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointHealth
+	nextPrune time.Time
+}
+
+type endpointHealth struct {
+	function            string
+	state               string
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+	probing             bool
+	latency             time.Duration
+	lastChange          time.Time
+	lastSeen            time.Time
+}
+
+// EndpointStatus is the state of a function endpoint as reported by the debug endpoint.
+type EndpointStatus struct {
+	Function            string     `json:"function"`
+	Endpoint            string     `json:"endpoint"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+	Latency             string     `json:"latency"`
+}
+
+func NewOutlierDetector(config types.ProxyConfig) *OutlierDetector {
+	return &OutlierDetector{
+		consecutiveFailures: config.OutlierConsecutiveFailures,
+		maxLatency:          config.OutlierMaxLatency,
+		baseEjectionTime:    config.OutlierEjectionTime,
+		maxEjectionTime:     config.OutlierMaxEjectionTime,
+		now:                 time.Now,
+		endpoints:           map[string]*endpointHealth{},
+	}
+}
+
+func (o *OutlierDetector) enabled() bool {
+	return o != nil && o.consecutiveFailures > 0
+}
+
+// filter removes the ejected endpoints from the candidates. When all candidates are ejected, they are
+// all returned, as sending traffic to a possibly unhealthy endpoint is better than failing every request.
+func (o *OutlierDetector) filter(candidates []url.URL) []url.URL {
+	if !o.enabled() {
+		return candidates
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	o.prune(now)
+
+	result := make([]url.URL, 0, len(candidates))
+
+	for _, c := range candidates {
+		h, ok := o.endpoints[c.Host]
+		if !ok {
+			result = append(result, c)
+			continue
+		}
+		h.lastSeen = now
+
+		if h.state == CircuitOpen && !now.Before(h.ejectedUntil) {
+			h.state = CircuitHalfOpen
+			h.probing = false
+			h.lastChange = now
+		}
+
+		switch h.state {
+		case CircuitClosed:
+			result = append(result, c)
+		case CircuitHalfOpen:
+			if !h.probing {
+				result = append(result, c)
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return candidates
+	}
+
+	return result
+}
+
+// begin marks the start of a request to the endpoint, a request to a half-open endpoint is the probe. It
+// returns false when another request is already probing the endpoint, the endpoint being left to it.
+func (o *OutlierDetector) begin(u url.URL) bool {
+	if !o.enabled() {
+		return true
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if h, ok := o.endpoints[u.Host]; ok && h.state == CircuitHalfOpen {
+		if h.probing {
+			return false
+		}
+		h.probing = true
+	}
+	return true
+}
+
+// cancel ends a request to the endpoint without an outcome, e.g. when the caller cancelled it. A cancelled
+// probe doesn't tell anything about the endpoint, so another request is allowed to probe it.
+func (o *OutlierDetector) cancel(u url.URL) {
+	if !o.enabled() {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if h, ok := o.endpoints[u.Host]; ok && h.state == CircuitHalfOpen {
+		h.probing = false
+	}
+}
+
+// report records the outcome of a request to an endpoint. A request failed when it didn't get a
+// response, got a 5xx response, or took longer than the configured maximum latency.
+func (o *OutlierDetector) report(function string, u url.URL, statusCode int, err error, latency time.Duration) {
+	if !o.enabled() {
+		return
+	}
+
+	failed := err != nil || statusCode >= http.StatusInternalServerError || (o.maxLatency > 0 && latency > o.maxLatency)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+
+	h, ok := o.endpoints[u.Host]
+	if !ok {
+		if !failed {
+			return
+		}
+		h = &endpointHealth{function: function, state: CircuitClosed, lastChange: now}
+		o.endpoints[u.Host] = h
+	}
+	h.lastSeen = now
+
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		// exponentially weighted moving average
+		h.latency = (h.latency*4 + latency) / 5
+	}
+
+	if !failed {
+		h.consecutiveFailures = 0
+		if h.state == CircuitHalfOpen {
+			h.state = CircuitClosed
+			h.probing = false
+			h.lastChange = now
+		}
+		// forget endpoints which have been healthy for a while
+		if h.state == CircuitClosed && now.Sub(h.lastChange) > o.maxEjectionTime {
+			delete(o.endpoints, u.Host)
+		}
+		return
+	}
+
+	h.consecutiveFailures++
+
+	if h.state == CircuitHalfOpen || (h.state == CircuitClosed && h.consecutiveFailures >= o.consecutiveFailures) {
+		o.eject(h, now)
+	}
+}
+
+// prune forgets the endpoints which haven't been resolved for the maximum ejection time, at most once per
+// maximum ejection time. The lock must be held.
+func (o *OutlierDetector) prune(now time.Time) {
+	if now.Before(o.nextPrune) {
+		return
+	}
+	o.nextPrune = now.Add(o.maxEjectionTime)
+
+	for host, h := range o.endpoints {
+		if now.Sub(h.lastSeen) > o.maxEjectionTime {
+			delete(o.endpoints, host)
+		}
+	}
+}
+
+func (o *OutlierDetector) eject(h *endpointHealth, now time.Time) {
+	ejectionTime := o.baseEjectionTime << uint(h.ejections)
+	if ejectionTime > o.maxEjectionTime || ejectionTime <= 0 {
+		ejectionTime = o.maxEjectionTime
+	}
+
+	h.state = CircuitOpen
+	h.probing = false
+	h.ejections++
+	h.ejectedUntil = now.Add(ejectionTime)
+	h.lastChange = now
+}
+
+// Status returns the state of all the endpoints which have recently failed.
+func (o *OutlierDetector) Status() []EndpointStatus {
+	result := make([]EndpointStatus, 0)
+	if !o.enabled() {
+		return result
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.prune(o.now())
+
+	for host, h := range o.endpoints {
+		status := EndpointStatus{
+			Function:            h.function,
+			Endpoint:            host,
+			State:               h.state,
+			ConsecutiveFailures: h.consecutiveFailures,
+			Ejections:           h.ejections,
+			Latency:             h.latency.String(),
+		}
+		if h.state == CircuitOpen {
+			until := h.ejectedUntil
+			status.EjectedUntil = &until
+		}
+		result = append(result, status)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Function == result[j].Function {
+			return result[i].Endpoint < result[j].Endpoint
+		}
+		return result[i].Function < result[j].Function
+	})
+
+	return result
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupOutlierDetector() (*OutlierDetector, *time.Time) {
+	now := time.Now()
+	detector := NewOutlierDetector(types.ProxyConfig{
+		OutlierConsecutiveFailures: 2,
+		OutlierMaxLatency:          time.Second,
+		OutlierEjectionTime:        10 * time.Second,
+		OutlierMaxEjectionTime:     time.Minute,
+	})
+	detector.now = func() time.Time { return now }
+	return detector, &now
+}
+
+func TestOutlierDetectorEjectsEndpointAfterConsecutiveFailures(t *testing.T) {
+	detector, _ := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusInternalServerError, nil, time.Millisecond)
+	assert.Equal(t, candidates, detector.filter(candidates))
+
+	detector.report("fn", candidates[0], 0, fmt.Errorf("connection refused"), time.Millisecond)
+	assert.Equal(t, candidates[1:], detector.filter(candidates))
+
+	status := detector.Status()
+	assert.Equal(t, 1, len(status))
+	assert.Equal(t, CircuitOpen, status[0].State)
+	assert.Equal(t, "fn", status[0].Function)
+}
+
+func TestOutlierDetectorTreatsSlowResponsesAsFailures(t *testing.T) {
+	detector, _ := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusOK, nil, 2*time.Second)
+	detector.report("fn", candidates[0], http.StatusOK, nil, 2*time.Second)
+
+	assert.Equal(t, candidates[1:], detector.filter(candidates))
+}
+
+func TestOutlierDetectorReadmitsEndpointAfterSuccessfulProbe(t *testing.T) {
+	detector, now := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+
+	*now = now.Add(11 * time.Second)
+
+	// half-open, a single probe is allowed
+	assert.Equal(t, candidates, detector.filter(candidates))
+	detector.begin(candidates[0])
+	assert.Equal(t, candidates[1:], detector.filter(candidates))
+
+	detector.report("fn", candidates[0], http.StatusOK, nil, time.Millisecond)
+	assert.Equal(t, candidates, detector.filter(candidates))
+	assert.Equal(t, CircuitClosed, detector.Status()[0].State)
+}
+
+func TestOutlierDetectorDoublesEjectionTimeWhenProbeFails(t *testing.T) {
+	detector, now := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+
+	*now = now.Add(11 * time.Second)
+	detector.filter(candidates)
+	detector.begin(candidates[0])
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+
+	*now = now.Add(11 * time.Second)
+	assert.Equal(t, candidates[1:], detector.filter(candidates))
+
+	*now = now.Add(10 * time.Second)
+	assert.Equal(t, candidates, detector.filter(candidates))
+}
+
+func TestOutlierDetectorKeepsCandidatesWhenAllAreEjected(t *testing.T) {
+	detector, _ := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+
+	assert.Equal(t, candidates, detector.filter(candidates))
+}
+
+func TestOutlierDetectorRearmsCancelledProbe(t *testing.T) {
+	detector, now := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+
+	*now = now.Add(11 * time.Second)
+	detector.filter(candidates)
+	detector.begin(candidates[0])
+	assert.Equal(t, candidates[1:], detector.filter(candidates))
+
+	detector.cancel(candidates[0])
+	assert.Equal(t, candidates, detector.filter(candidates))
+	assert.Equal(t, CircuitHalfOpen, detector.Status()[0].State)
+}
+
+func TestOutlierDetectorAllowsSingleProbe(t *testing.T) {
+	detector, now := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+
+	*now = now.Add(11 * time.Second)
+	detector.filter(candidates)
+
+	assert.True(t, detector.begin(candidates[0]))
+	assert.False(t, detector.begin(candidates[0]))
+	assert.True(t, detector.begin(candidates[1]))
+}
+
+// staleBalancer selects the first endpoint it was created with, as if it was selected before being probed by
+// another request, and then the first candidate.
+type staleBalancer struct {
+	first *url.URL
+}
+
+func (b *staleBalancer) Select(function string, candidates []url.URL, r *http.Request) (url.URL, error) {
+	if b.first != nil {
+		u := *b.first
+		b.first = nil
+		return u, nil
+	}
+	return candidates[0], nil
+}
+
+func TestProxySkipsEndpointProbedByAnotherRequest(t *testing.T) {
+	detector, now := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	*now = now.Add(11 * time.Second)
+	detector.filter(candidates)
+	detector.begin(candidates[0])
+
+	p := &functionProxy{outliers: detector, load: &endpointLoad{}, locality: newLocality(types.ProxyConfig{})}
+	request := httptest.NewRequest(http.MethodGet, "/function/fn", nil)
+
+	selected, err := p.selectEndpoint(&staleBalancer{first: &candidates[0]}, "fn", candidates, nil, nil, 0, request)
+	assert.NoError(t, err)
+	assert.Equal(t, candidates[1], selected)
+
+	// the probed endpoint is kept when it is the only one
+	selected, err = p.selectEndpoint(&staleBalancer{}, "fn", candidates[:1], nil, nil, 0, request)
+	assert.NoError(t, err)
+	assert.Equal(t, candidates[0], selected)
+}
+
+func TestOutlierDetectorForgetsEndpointsNoLongerResolved(t *testing.T) {
+	detector, now := setupOutlierDetector()
+	candidates := createCandidates("10.0.0.1:8080", "10.0.0.2:8080")
+
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[0], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[1], http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("fn", candidates[1], http.StatusBadGateway, nil, time.Millisecond)
+	assert.Equal(t, 2, len(detector.Status()))
+
+	*now = now.Add(50 * time.Second)
+	detector.filter(candidates[1:])
+
+	*now = now.Add(20 * time.Second)
+	status := detector.Status()
+	assert.Equal(t, 1, len(status))
+	assert.Equal(t, candidates[1].Host, status[0].Endpoint)
+}
+
+func TestProxyRearmsProbeCancelledByCaller(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	detector, now := setupOutlierDetector()
+	probed := serverEndpoint(server)
+	other := url.URL{Scheme: "http", Host: "10.0.0.2:8080"}
+
+	detector.report("echo", probed, http.StatusBadGateway, nil, time.Millisecond)
+	detector.report("echo", probed, http.StatusBadGateway, nil, time.Millisecond)
+	*now = now.Add(11 * time.Second)
+
+	providerConfig, _ := types.DefaultConfig()
+	handler := NewHandlerFunc(providerConfig, &staticResolver{candidates: []url.URL{probed}}, nil, nil, nil, detector, nil, hclog.NewNullLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil).WithContext(ctx)
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), request)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+	<-done
+
+	assert.Equal(t, []url.URL{probed, other}, detector.filter([]url.URL{probed, other}))
+}
+
+func TestProxyEjectsEndpointWhenFunctionTimesOut(t *testing.T) {
+	function := slowFunction(time.Second)
+	defer function.Close()
+
+	detector, _ := setupOutlierDetector()
+	slow := serverEndpoint(function)
+	other := url.URL{Scheme: "http", Host: "10.0.0.2:8080"}
+
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.MaxTimeout = time.Minute
+	annotations := map[string]string{timeoutAnnotation: "50ms"}
+	functions := &staticFunctions{function: ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}}
+	handler := NewHandlerFunc(providerConfig, &staticResolver{candidates: []url.URL{slow}}, functions, nil, nil, detector, nil, hclog.NewNullLogger())
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusGatewayTimeout, invokeProxy(handler, http.MethodGet, "").Code)
+	}
+
+	assert.Equal(t, []url.URL{other}, detector.filter([]url.URL{slow, other}))
+}
@@ -7,30 +7,38 @@
 //
 // openfaas-provider has implemented a standard HTTP HandlerFunc that will handle setting
 // timeout values, parsing the request path, and copying the request/response correctly.
-// 		bootstrapHandlers := bootTypes.FaaSHandlers{
-// 			FunctionProxy:  proxy.NewHandlerFunc(timeout, resolver),
-// 			DeleteHandler:  handlers.MakeDeleteHandler(clientset),
-// 			DeployHandler:  handlers.MakeDeployHandler(clientset),
-// 			FunctionReader: handlers.MakeFunctionReader(clientset),
-// 			ReplicaReader:  handlers.MakeReplicaReader(clientset),
-// 			ReplicaUpdater: handlers.MakeReplicaUpdater(clientset),
-// 			InfoHandler:    handlers.MakeInfoHandler(),
-// 		}
+//
+//	bootstrapHandlers := bootTypes.FaaSHandlers{
+//		FunctionProxy:  proxy.NewHandlerFunc(timeout, resolver),
+//		DeleteHandler:  handlers.MakeDeleteHandler(clientset),
+//		DeployHandler:  handlers.MakeDeployHandler(clientset),
+//		FunctionReader: handlers.MakeFunctionReader(clientset),
+//		ReplicaReader:  handlers.MakeReplicaReader(clientset),
+//		ReplicaUpdater: handlers.MakeReplicaUpdater(clientset),
+//		InfoHandler:    handlers.MakeInfoHandler(),
+//	}
 //
 // proxy.NewHandlerFunc is optional, but does simplify the logic of your provider.
 package proxy
 
 import (
+	"context"
+	"errors"
 	"github.com/hashicorp/go-hclog"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/tracing"
+	"github.com/jsiebens/faas-nomad/pkg/types"
 	"github.com/openfaas/faas-provider/httputil"
-	"github.com/openfaas/faas-provider/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -38,33 +46,97 @@ const (
 	defaultContentType = "text/plain"
 )
 
+var errNoCandidates = errors.New("no candidate available")
+
 // BaseURLResolver URL resolver for proxy requests
 //
 // The FaaS provider implementation is responsible for providing the resolver function implementation.
-// BaseURLResolver.Resolve will receive the function name and should return the URL of the
-// function service.
+// BaseURLResolver.ResolveAll will receive the function name and should return the URLs of all the
+// available instances of the function service, the proxy will select one of them using the configured
+// load balancing strategy.
 type BaseURLResolver interface {
-	Resolve(functionName string) (url.URL, error)
+	ResolveAll(functionName string) ([]url.URL, error)
+}
+
+type functionProxy struct {
+	config       types.ProxyConfig
+	client       *http.Client
+	streamClient *http.Client
+	resolver     BaseURLResolver
+	functions    services.Functions
+	balancers    *balancers
+	load         *endpointLoad
+	outliers     *OutlierDetector
+	locality     *locality
+	splits       *TrafficSplits
+	limiter      *rateLimiter
+	queue        *concurrencyLimiter
+	mirrors      chan struct{}
+	auth         *authenticator
+	scaler       *functionScaler
+	observers    observers
+	writeTimeout time.Duration
+	namespace    string
+	log          hclog.Logger
 }
 
 // NewHandlerFunc creates a standard http.HandlerFunc to proxy function requests.
 // The returned http.HandlerFunc will ensure:
 //
-// 	- proper proxy request timeouts
-// 	- proxy requests for GET, POST, PATCH, PUT, and DELETE
-// 	- path parsing including support for extracing the function name, sub-paths, and query paremeters
-// 	- passing and setting the `X-Forwarded-Host` and `X-Forwarded-For` headers
-// 	- logging errors and proxy request timing to stdout
+//   - proper proxy request timeouts, including per function timeouts
+//   - proxy requests for GET, POST, PATCH, PUT, and DELETE
+//   - path parsing including support for extracing the function name, sub-paths, and query paremeters
+//   - passing and setting the `X-Forwarded-Host` and `X-Forwarded-For` headers
+//   - authenticating the callers of the protected functions, with the API keys and credentials kept in `secrets`
+//   - splitting the traffic between the versions of a function when TrafficSplits are provided
+//   - enforcing the rate limits of the functions
+//   - capping the concurrent requests per function instance, queueing the excess requests
+//   - selecting a function instance with the configured load balancing strategy, preferring local instances
+//   - reporting the datacenter of the instance which served the request, when the resolver reports it
+//   - streaming responses and tunnelling protocol upgrades such as WebSockets
+//   - mirroring a sample of the requests to a shadow function
+//   - retrying failed requests on another instance
+//   - ejecting failing instances when an OutlierDetector is provided
+//   - scaling functions from zero replicas when `jobs` is provided
+//   - notifying the observers about every invocation
+//   - tracing the invocation, continuing the W3C trace context of the caller
+//   - logging errors and proxy request timing to stdout
 //
-// Note that this will panic if `resolver` is nil.
-func NewHandlerFunc(config types.FaaSConfig, resolver BaseURLResolver, logger hclog.Logger) http.HandlerFunc {
+// Note that this will panic if `resolver` is nil or if the configured strategy is not supported.
+func NewHandlerFunc(config *types.ProviderConfig, resolver BaseURLResolver, functions services.Functions, jobs services.Jobs, secrets services.Secrets, outliers *OutlierDetector, splits *TrafficSplits, logger hclog.Logger, o ...Observer) http.HandlerFunc {
 	if resolver == nil {
 		panic("NewHandlerFunc: empty proxy handler resolver, cannot be nil")
 	}
 
+	load := &endpointLoad{}
+	balancers, err := newBalancers(config.Proxy, load)
+	if err != nil {
+		panic("NewHandlerFunc: " + err.Error())
+	}
+
 	log := logger.Named("proxy")
 
-	proxyClient := NewProxyClientFromConfig(config)
+	p := &functionProxy{
+		config:       config.Proxy,
+		client:       NewProxyClientFromConfig(config.FaaS),
+		streamClient: NewStreamingProxyClientFromConfig(config.FaaS),
+		resolver:     resolver,
+		functions:    functions,
+		balancers:    balancers,
+		load:         load,
+		outliers:     outliers,
+		locality:     newLocality(config.Proxy),
+		splits:       splits,
+		limiter:      newRateLimiter(),
+		queue:        newConcurrencyLimiter(o),
+		mirrors:      make(chan struct{}, config.Proxy.MirrorMaxInflight),
+		auth:         newAuthenticator(config.Proxy, secrets, log),
+		scaler:       newFunctionScaler(config, jobs, resolver, log),
+		observers:    o,
+		writeTimeout: config.FaaS.WriteTimeout,
+		namespace:    config.Scheduling.Namespace,
+		log:          log,
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Body != nil {
@@ -79,7 +151,7 @@ func NewHandlerFunc(config types.FaaSConfig, resolver BaseURLResolver, logger hc
 			http.MethodGet,
 			http.MethodOptions,
 			http.MethodHead:
-			proxyRequest(w, r, proxyClient, resolver, log)
+			p.traceRequest(w, r)
 
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -89,10 +161,18 @@ func NewHandlerFunc(config types.FaaSConfig, resolver BaseURLResolver, logger hc
 
 // NewProxyClientFromConfig creates a new http.Client designed for proxying requests and enforcing
 // certain minimum configuration values.
-func NewProxyClientFromConfig(config types.FaaSConfig) *http.Client {
+func NewProxyClientFromConfig(config ftypes.FaaSConfig) *http.Client {
 	return NewProxyClient(config.GetReadTimeout(), config.GetMaxIdleConns(), config.GetMaxIdleConnsPerHost())
 }
 
+// NewStreamingProxyClientFromConfig creates a new http.Client for streaming requests, which are not bound
+// by a total timeout. The proxy cancels streaming requests when they are idle instead.
+func NewStreamingProxyClientFromConfig(config ftypes.FaaSConfig) *http.Client {
+	client := NewProxyClientFromConfig(config)
+	client.Timeout = 0
+	return client
+}
+
 // NewProxyClient creates a new http.Client designed for proxying requests, this is exposed as a
 // convenience method for internal or advanced uses. Most people should use NewProxyClientFromConfig.
 func NewProxyClient(timeout time.Duration, maxIdleConns int, maxIdleConnsPerHost int) *http.Client {
@@ -131,9 +211,58 @@ func NewProxyClient(timeout time.Duration, maxIdleConns int, maxIdleConnsPerHost
 	}
 }
 
-// proxyRequest handles the actual resolution of and then request to the function service.
-func proxyRequest(w http.ResponseWriter, originalReq *http.Request, proxyClient *http.Client, resolver BaseURLResolver, log hclog.Logger) {
+// traceRequest proxies the request within a span continuing the trace of the caller.
+func (p *functionProxy) traceRequest(w http.ResponseWriter, r *http.Request) {
+	functionName := strings.TrimSuffix(mux.Vars(r)["name"], "."+p.namespace)
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(r), "proxy "+functionName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			tracing.FunctionName.String(functionName),
+			tracing.FunctionNamespace.String(p.namespace),
+		),
+	)
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	if r, ok := p.split(recorder, r.WithContext(ctx)); ok {
+		p.observeRequest(recorder, r)
+	}
+
+	tracing.EndWithStatus(span, recorder.status())
+}
+
+// observeRequest proxies the request, notifying the observers about the invocation once the function is known.
+// The requests for unknown functions are not observed, so they don't grow the metrics and the scaling state.
+func (p *functionProxy) observeRequest(w http.ResponseWriter, r *http.Request) {
+	functionName := strings.TrimSuffix(mux.Vars(r)["name"], "."+p.namespace)
+	if functionName == "" || len(p.observers) == 0 {
+		p.proxyRequest(w, r, func() {})
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w}
+
+	start := time.Now()
+	observed := false
+	defer func() {
+		if observed {
+			p.observers.finished(functionName, recorder.status(), time.Since(start))
+		}
+	}()
+
+	p.proxyRequest(recorder, r, func() {
+		if !observed {
+			observed = true
+			p.observers.started(functionName)
+		}
+	})
+}
+
+// proxyRequest handles the actual resolution of and then request to the function service. The known func is
+// called once the function is known to exist, from its deployment details or its endpoints.
+func (p *functionProxy) proxyRequest(w http.ResponseWriter, originalReq *http.Request, known func()) {
 	ctx := originalReq.Context()
+	log := p.log
 
 	pathVars := mux.Vars(originalReq)
 	functionName := pathVars["name"]
@@ -142,50 +271,280 @@ func proxyRequest(w http.ResponseWriter, originalReq *http.Request, proxyClient
 		return
 	}
 
-	functionAddr, resolveErr := resolver.Resolve(functionName)
-	if resolveErr != nil {
+	name := strings.TrimSuffix(functionName, "."+p.namespace)
+	fn, lookupErr := p.lookup(functionName)
+	if fn != nil {
+		known()
+	}
+
+	// the primary function of a split has already admitted the request
+	if primary, _ := splitFrom(originalReq); primary != name && !p.admit(w, originalReq, name, fn, lookupErr) {
+		return
+	}
+
+	candidates, locations, resolveErr := p.resolve(ctx, functionName)
+	if resolveErr != nil || len(candidates) == 0 {
 		// TODO: Should record the 404/not found error in Prometheus.
 		httputil.Errorf(w, http.StatusServiceUnavailable, "No endpoints available for: %s.", functionName)
 		return
 	}
+	known()
+
+	policy := newRetryPolicy(p.config, fn)
+
+	bodyLimit := p.config.RetryBodyLimit
+	if policy.retries <= 0 {
+		bodyLimit = 0
+	}
+
+	if isUpgrade(originalReq) {
+		markVersion(w, originalReq, name)
+		p.tunnel(w, originalReq, functionName, fn, candidates, locations)
+		return
+	}
+
+	mirror := newMirrorPolicy(fn)
+	mirrored := mirror.sample()
+	if mirrored && bodyLimit < p.config.MirrorBodyLimit {
+		bodyLimit = p.config.MirrorBodyLimit
+	}
+
+	concurrency := newConcurrencyPolicy(p.config, fn)
+	release, err := p.queue.admit(ctx, name, candidates, concurrency)
+	if err != nil {
+		if err == errQueueFull {
+			w.Header().Set("Retry-After", "1")
+			httputil.Errorf(w, http.StatusTooManyRequests, "Too many concurrent requests for: %s.", functionName)
+			return
+		}
+		httputil.Errorf(w, http.StatusServiceUnavailable, "No replica available in time for: %s.", functionName)
+		return
+	}
+	defer release()
 
-	proxyReq, err := buildProxyRequest(originalReq, functionAddr, pathVars["params"])
+	body, err := newReplayableBody(originalReq, bodyLimit)
 	if err != nil {
-		httputil.Errorf(w, http.StatusInternalServerError, "Failed to resolve service: %s.", functionName)
+		httputil.Errorf(w, http.StatusBadRequest, "Failed to read request body for: %s.", functionName)
 		return
 	}
 
-	if proxyReq.Body != nil {
-		defer proxyReq.Body.Close()
+	markVersion(w, originalReq, name)
+
+	if mirrored {
+		p.mirror(ctx, originalReq, functionName, mirror, body)
+	}
+
+	client := p.client
+	streaming := isStreaming(originalReq, fn)
+
+	var idle *idleTimeout
+	if streaming {
+		client = p.streamClient
+		ctx, idle = withIdleTimeout(ctx, p.config.StreamIdleTimeout)
+		defer idle.stop()
+	}
+
+	timeout := functionTimeout(p.config, fn)
+	if timeout > 0 {
+		client = p.streamClient
+	} else if !streaming {
+		// the listeners have no write deadline, the responses which are not streamed are bound by the write timeout
+		timeout = p.writeTimeout
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
 	start := time.Now()
-	response, err := proxyClient.Do(proxyReq.WithContext(ctx))
+	response, functionAddr, err := p.invoke(ctx, client, originalReq, functionName, fn, candidates, locations, body, policy, concurrency)
 	seconds := time.Since(start)
 
 	if err != nil {
-		log.Error("error with proxy request", "target", proxyReq.URL.String(), "error", err.Error())
-
+		if isTimeout(err) && originalReq.Context().Err() == nil {
+			httputil.Errorf(w, http.StatusGatewayTimeout, "Timeout invoking function: %s.", functionName)
+			return
+		}
 		httputil.Errorf(w, http.StatusInternalServerError, "Can't reach service for: %s.", functionName)
 		return
 	}
 
+	defer p.load.release(functionAddr)
+
 	if response.Body != nil {
 		defer response.Body.Close()
 	}
 
-	log.Debug("request proxied successfully", "function", functionName, "target", proxyReq.URL.String(), "time", seconds.Seconds())
+	log.Debug("request proxied successfully", "function", functionName, "target", response.Request.URL.String(), "time", seconds.Seconds())
 
 	clientHeader := w.Header()
 	copyHeaders(clientHeader, &response.Header)
 	w.Header().Set("Content-Type", getContentType(originalReq.Header, response.Header))
+	if dc := locations.datacenterOf(functionAddr); dc != "" {
+		w.Header().Set(DatacenterHeader, dc)
+	}
 
 	w.WriteHeader(response.StatusCode)
 	if response.Body != nil {
-		io.Copy(w, response.Body)
+		if err := copyResponse(w, response.Body, shouldFlush(response, streaming), idle); err != nil {
+			log.Debug("error copying response", "function", functionName, "error", err.Error())
+		}
 	}
 }
 
+// resolve returns the endpoints of the function, scaling it from zero when it has none.
+func (p *functionProxy) resolve(ctx context.Context, functionName string) ([]url.URL, locations, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "resolve", trace.WithAttributes(
+		tracing.FunctionName.String(strings.TrimSuffix(functionName, "."+p.namespace)),
+		tracing.FunctionNamespace.String(p.namespace),
+	))
+
+	candidates, located, err := p.resolveAll(functionName)
+	if err == nil && len(candidates) == 0 && p.scaler != nil {
+		span.AddEvent("scale from zero")
+		candidates, err = p.scaler.scaleFromZero(ctx, functionName)
+	}
+
+	if err != nil {
+		tracing.EndWithError(span, err)
+		return nil, nil, err
+	}
+
+	span.SetAttributes(attribute.Int("faas.endpoints", len(candidates)))
+	span.End()
+
+	return candidates, located, nil
+}
+
+// invoke sends the request to one of the candidates, retrying on another candidate according to the retry policy
+// of the function. On success, the selected endpoint is returned and the caller must release its load when done.
+func (p *functionProxy) invoke(ctx context.Context, client *http.Client, originalReq *http.Request, functionName string, fn *ftypes.FunctionStatus, candidates []url.URL, locations locations, body *replayableBody, policy retryPolicy, concurrency concurrencyPolicy) (*http.Response, url.URL, error) {
+	balancer := p.balancers.forFunction(fn)
+	params := mux.Vars(originalReq)["params"]
+
+	name := strings.TrimSuffix(functionName, "."+p.namespace)
+
+	var tried []url.URL
+
+	for attempt := 0; ; attempt++ {
+		functionAddr, err := p.selectEndpoint(balancer, functionName, candidates, locations, tried, concurrency.perEndpoint, originalReq)
+		if err != nil {
+			return nil, url.URL{}, err
+		}
+
+		proxyReq, err := buildProxyRequest(originalReq, functionAddr, params)
+		if err != nil {
+			return nil, url.URL{}, err
+		}
+		proxyReq.Body = body.reader()
+
+		tracker := &sentTracker{}
+
+		attemptCtx, span := tracing.Tracer().Start(ctx, "upstream",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				tracing.FunctionName.String(name),
+				tracing.FunctionNamespace.String(p.namespace),
+				tracing.Endpoint.String(proxyReq.URL.Host),
+				tracing.Attempt.Int(attempt+1),
+			),
+		)
+		tracing.Inject(attemptCtx, proxyReq.Header)
+
+		p.load.acquire(functionAddr)
+
+		start := time.Now()
+		response, err := client.Do(proxyReq.WithContext(tracker.withTrace(attemptCtx)))
+		if err == nil {
+			tracing.EndWithStatus(span, response.StatusCode)
+			p.outliers.report(functionName, functionAddr, response.StatusCode, nil, time.Since(start))
+			return response, functionAddr, nil
+		}
+
+		tracing.EndWithError(span, err)
+		p.load.release(functionAddr)
+		// a deadline of the proxy, e.g. the timeout of the function, is a failure of the endpoint, unlike the
+		// cancellation of the request by the caller
+		if originalReq.Context().Err() == nil {
+			p.outliers.report(functionName, functionAddr, 0, err, time.Since(start))
+		} else {
+			p.outliers.cancel(functionAddr)
+		}
+
+		p.log.Error("error with proxy request", "target", proxyReq.URL.String(), "attempt", attempt+1, "error", err.Error())
+
+		if attempt >= policy.retries || !body.canReplay() || !shouldRetry(originalReq.Method, err, tracker.wasSent()) {
+			return nil, functionAddr, err
+		}
+
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			tracing.Endpoint.String(proxyReq.URL.Host),
+			tracing.Attempt.Int(attempt+1),
+		))
+
+		if err := policy.wait(ctx, attempt); err != nil {
+			return nil, functionAddr, err
+		}
+
+		tried = append(tried, functionAddr)
+	}
+}
+
+// selectEndpoint selects the endpoint of a request among the candidates which were not excluded, and starts
+// the request to it. A half-open endpoint already probed by another request is skipped, unless no other
+// endpoint is available.
+func (p *functionProxy) selectEndpoint(balancer Balancer, functionName string, candidates []url.URL, locations locations, excluded []url.URL, perEndpoint int, r *http.Request) (url.URL, error) {
+	var probed []url.URL
+
+	for {
+		functionAddr, err := balancer.Select(functionName, p.preferred(without(p.outliers.filter(candidates), excluded), locations, perEndpoint), r)
+		if err != nil {
+			if len(probed) > 0 {
+				return probed[0], nil
+			}
+			return url.URL{}, err
+		}
+
+		if containsURL(probed, functionAddr) || p.outliers.begin(functionAddr) {
+			return functionAddr, nil
+		}
+
+		probed = append(probed, functionAddr)
+		excluded = append(excluded[:len(excluded):len(excluded)], functionAddr)
+	}
+}
+
+// admit authenticates and rate limits a request for a function, given the result of its lookup. It returns false
+// when the request has been rejected.
+func (p *functionProxy) admit(w http.ResponseWriter, r *http.Request, functionName string, fn *ftypes.FunctionStatus, lookupErr error) bool {
+	if !p.authenticate(w, r, functionName, fn, lookupErr) {
+		return false
+	}
+
+	if allowed, delay := p.limiter.allow(functionName, fn, lookupErr, r); !allowed {
+		w.Header().Set("Retry-After", retryAfter(delay))
+		httputil.Errorf(w, http.StatusTooManyRequests, "Rate limit exceeded for: %s.", functionName)
+		return false
+	}
+
+	return true
+}
+
+// lookup returns the details of a function, or nil with the error when they can't be read.
+func (p *functionProxy) lookup(functionName string) (*ftypes.FunctionStatus, error) {
+	if p.functions == nil {
+		return nil, nil
+	}
+	fn, err := p.functions.Get(functionName)
+	if err != nil {
+		p.log.Debug("unable to read function details, using defaults", "function", functionName, "error", err.Error())
+		return nil, err
+	}
+	return fn, nil
+}
+
 // buildProxyRequest creates a request object for the proxy request, it will ensure that
 // the original request headers are preserved as well as setting openfaas system headers
 func buildProxyRequest(originalReq *http.Request, baseURL url.URL, extraPath string) (*http.Request, error) {
@@ -215,10 +574,6 @@ func buildProxyRequest(originalReq *http.Request, baseURL url.URL, extraPath str
 		upstreamReq.Header["X-Forwarded-For"] = []string{originalReq.RemoteAddr}
 	}
 
-	if originalReq.Body != nil {
-		upstreamReq.Body = originalReq.Body
-	}
-
 	return upstreamReq, nil
 }
 
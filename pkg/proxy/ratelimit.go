@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitAnnotation          = "com.openfaas.ratelimit.rps"
+	rateLimitBurstAnnotation     = "com.openfaas.ratelimit.burst"
+	rateLimitKeyHeaderAnnotation = "com.openfaas.ratelimit.key_header"
+
+	// callers which haven't been seen for this period are forgotten
+	rateLimitIdleTime = 5 * time.Minute
+)
+
+// rateLimit is the token bucket configuration of a function.
+type rateLimit struct {
+	rps       float64
+	burst     int
+	keyHeader string
+}
+
+func newRateLimit(fn *ftypes.FunctionStatus) rateLimit {
+	if fn == nil || fn.Annotations == nil {
+		return rateLimit{}
+	}
+
+	rps, err := strconv.ParseFloat((*fn.Annotations)[rateLimitAnnotation], 64)
+	if err != nil || rps <= 0 {
+		return rateLimit{}
+	}
+
+	burst := types.ParseIntValueFromMap(fn.Annotations, rateLimitBurstAnnotation, int(math.Ceil(rps)))
+	if burst < 1 {
+		burst = 1
+	}
+
+	return rateLimit{
+		rps:       rps,
+		burst:     burst,
+		keyHeader: types.ParseStringValueFromMap(fn.Annotations, rateLimitKeyHeaderAnnotation, ""),
+	}
+}
+
+func (rl rateLimit) enabled() bool {
+	return rl.rps > 0
+}
+
+// rateLimiter enforces the token bucket rate limits of the functions annotated with
+// `com.openfaas.ratelimit.rps`, optionally per caller identified by the `com.openfaas.ratelimit.key_header` header.
+// When a function is redeployed with other limits, its buckets are replaced. When the details of a function
+// can't be read, its last known limits still apply.
+type rateLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	functions map[string]*functionLimiters
+	lastSweep time.Time
+}
+
+type functionLimiters struct {
+	limit     rateLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		now:       time.Now,
+		functions: map[string]*functionLimiters{},
+	}
+}
+
+// allow takes a token from the bucket of the caller, given the result of the lookup of the function. When the
+// bucket is empty, it returns false and the time after which a token will be available.
+func (rl *rateLimiter) allow(functionName string, fn *ftypes.FunctionStatus, lookupErr error, r *http.Request) (bool, time.Duration) {
+	limit := newRateLimit(fn)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	f, ok := rl.functions[functionName]
+	if ok && lookupErr != nil {
+		limit = f.limit
+	}
+
+	if !limit.enabled() {
+		delete(rl.functions, functionName)
+		return true, 0
+	}
+
+	if !ok || f.limit != limit {
+		f = &functionLimiters{limit: limit, buckets: map[string]*bucket{}, lastSweep: now}
+		rl.functions[functionName] = f
+	}
+
+	f.sweep(now)
+
+	key := ""
+	if limit.keyHeader != "" {
+		key = r.Header.Get(limit.keyHeader)
+	}
+
+	b, ok := f.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.rps), limit.burst)}
+		f.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+
+	return true, 0
+}
+
+// sweep forgets the functions which haven't been invoked for a while, e.g. because they were deleted.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitIdleTime {
+		return
+	}
+
+	for name, f := range rl.functions {
+		f.sweep(now)
+		if len(f.buckets) == 0 {
+			delete(rl.functions, name)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// sweep forgets the callers which haven't been seen for a while.
+func (f *functionLimiters) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < rateLimitIdleTime {
+		return
+	}
+
+	for key, b := range f.buckets {
+		if now.Sub(b.lastSeen) > rateLimitIdleTime {
+			delete(f.buckets, key)
+		}
+	}
+	f.lastSweep = now
+}
+
+// retryAfter formats the delay for the Retry-After header, in whole seconds.
+func retryAfter(delay time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(delay.Seconds())))
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func rateLimitedFunction(annotations map[string]string) *ftypes.FunctionStatus {
+	return &ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}
+}
+
+func setupRateLimiter() (*rateLimiter, *time.Time) {
+	now := time.Now()
+	limiter := newRateLimiter()
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestRateLimiterAllowsBurstThenRejects(t *testing.T) {
+	limiter, now := setupRateLimiter()
+	fn := rateLimitedFunction(map[string]string{rateLimitAnnotation: "1", rateLimitBurstAnnotation: "2"})
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+
+	allowed, _ := limiter.allow("echo", fn, nil, request)
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow("echo", fn, nil, request)
+	assert.True(t, allowed)
+
+	allowed, delay := limiter.allow("echo", fn, nil, request)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, delay)
+	assert.Equal(t, "1", retryAfter(delay))
+
+	*now = now.Add(time.Second)
+	allowed, _ = limiter.allow("echo", fn, nil, request)
+	assert.True(t, allowed)
+}
+
+func TestRateLimiterLimitsPerCaller(t *testing.T) {
+	limiter, _ := setupRateLimiter()
+	fn := rateLimitedFunction(map[string]string{rateLimitAnnotation: "1", rateLimitKeyHeaderAnnotation: "X-Api-Key"})
+
+	alice := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	alice.Header.Set("X-Api-Key", "alice")
+	bob := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	bob.Header.Set("X-Api-Key", "bob")
+
+	allowed, _ := limiter.allow("echo", fn, nil, alice)
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow("echo", fn, nil, alice)
+	assert.False(t, allowed)
+
+	allowed, _ = limiter.allow("echo", fn, nil, bob)
+	assert.True(t, allowed)
+}
+
+func TestRateLimiterAppliesUpdatedLimits(t *testing.T) {
+	limiter, _ := setupRateLimiter()
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+
+	fn := rateLimitedFunction(map[string]string{rateLimitAnnotation: "1"})
+	limiter.allow("echo", fn, nil, request)
+	allowed, _ := limiter.allow("echo", fn, nil, request)
+	assert.False(t, allowed)
+
+	updated := rateLimitedFunction(map[string]string{rateLimitAnnotation: "10"})
+	allowed, _ = limiter.allow("echo", updated, nil, request)
+	assert.True(t, allowed)
+
+	allowed, _ = limiter.allow("echo", &ftypes.FunctionStatus{Name: "echo"}, nil, request)
+	assert.True(t, allowed)
+}
+
+func TestRateLimiterKeepsLimitsWhenLookupFails(t *testing.T) {
+	limiter, now := setupRateLimiter()
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	unavailable := errors.New("nomad unavailable")
+
+	fn := rateLimitedFunction(map[string]string{rateLimitAnnotation: "1"})
+	allowed, _ := limiter.allow("echo", fn, nil, request)
+	assert.True(t, allowed)
+
+	allowed, _ = limiter.allow("echo", nil, unavailable, request)
+	assert.False(t, allowed)
+
+	// the limits of a function which is no longer invoked are forgotten
+	*now = now.Add(rateLimitIdleTime + time.Second)
+	allowed, _ = limiter.allow("other", nil, nil, request)
+	assert.True(t, allowed)
+	assert.Empty(t, limiter.functions)
+}
+
+type countingResolver struct {
+	calls int
+}
+
+func (c *countingResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	c.calls++
+	return nil, nil
+}
+
+func TestProxyRejectsRateLimitedRequestsBeforeResolving(t *testing.T) {
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.ScaleFromZero = false
+
+	resolver := &countingResolver{}
+	fn := ftypes.FunctionStatus{Name: "echo", Annotations: &map[string]string{rateLimitAnnotation: "0.5"}}
+	handler := NewHandlerFunc(providerConfig, resolver, &staticFunctions{function: fn}, nil, nil, nil, nil, hclog.NewNullLogger())
+
+	assert.Equal(t, http.StatusServiceUnavailable, invokeProxy(handler, http.MethodGet, "").Code)
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, 1, resolver.calls)
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	retriesAnnotation      = "com.openfaas.proxy.retries"
+	retryBackoffAnnotation = "com.openfaas.proxy.retry_backoff"
+)
+
+// retryPolicy defines how many times a failed invocation is retried on another endpoint,
+// and how long to wait before the first retry. The backoff doubles with every attempt.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+}
+
+func newRetryPolicy(config types.ProxyConfig, fn *ftypes.FunctionStatus) retryPolicy {
+	policy := retryPolicy{
+		retries: config.MaxRetries,
+		backoff: config.RetryBackoff,
+	}
+
+	if fn != nil {
+		policy.retries = types.ParseIntValueFromMap(fn.Annotations, retriesAnnotation, policy.retries)
+		policy.backoff = types.ParseIntOrDurationValueFromMap(fn.Annotations, retryBackoffAnnotation, policy.backoff)
+	}
+
+	return policy
+}
+
+// wait blocks for the backoff duration of the given attempt, or until the context is done.
+func (rp retryPolicy) wait(ctx context.Context, attempt int) error {
+	if rp.backoff <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(rp.backoff << uint(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shouldRetry reports whether a failed attempt can safely be sent again. This is the case when the
+// request never reached the function, or when the method is idempotent.
+func shouldRetry(method string, err error, sent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if !sent || isDialError(err) {
+		return true
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// sentTracker records if a request was written to the connection.
+type sentTracker struct {
+	sent int32
+}
+
+func (st *sentTracker) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			atomic.StoreInt32(&st.sent, 1)
+		},
+	})
+}
+
+func (st *sentTracker) wasSent() bool {
+	return atomic.LoadInt32(&st.sent) == 1
+}
+
+// replayableBody holds a request body so it can be sent more than once.
+// Bodies larger than the limit are streamed and can only be sent once.
+type replayableBody struct {
+	buffered   []byte
+	remainder  io.ReadCloser
+	replayable bool
+	used       bool
+}
+
+func newReplayableBody(r *http.Request, limit int64) (*replayableBody, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return &replayableBody{replayable: true}, nil
+	}
+
+	if limit <= 0 {
+		return &replayableBody{remainder: r.Body}, nil
+	}
+
+	buffered, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(buffered)) > limit {
+		return &replayableBody{buffered: buffered, remainder: r.Body}, nil
+	}
+
+	return &replayableBody{buffered: buffered, replayable: true}, nil
+}
+
+// canReplay reports if the body can be sent (again).
+func (b *replayableBody) canReplay() bool {
+	return b.replayable || !b.used
+}
+
+// reader returns a fresh reader for the body, or nil when the request has no body.
+func (b *replayableBody) reader() io.ReadCloser {
+	b.used = true
+
+	if b.remainder != nil {
+		return ioutil.NopCloser(io.MultiReader(bytes.NewReader(b.buffered), b.remainder))
+	}
+	if b.buffered == nil {
+		return nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.buffered))
+}
+
+// without returns the candidates which are not in the excluded list, or all candidates when none would remain.
+func without(candidates []url.URL, excluded []url.URL) []url.URL {
+	var result []url.URL
+	for _, c := range candidates {
+		if !containsURL(excluded, c) {
+			result = append(result, c)
+		}
+	}
+	if len(result) == 0 {
+		return candidates
+	}
+	return result
+}
+
+func containsURL(list []url.URL, u url.URL) bool {
+	for _, l := range list {
+		if l.Host == u.Host {
+			return true
+		}
+	}
+	return false
+}
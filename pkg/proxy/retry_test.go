@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticResolver struct {
+	candidates []url.URL
+}
+
+func (s *staticResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	return s.candidates, nil
+}
+
+func closedEndpoint(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return url.URL{Scheme: "http", Host: addr}
+}
+
+func serverEndpoint(s *httptest.Server) url.URL {
+	u, _ := url.Parse(s.URL)
+	return *u
+}
+
+func setupProxy(config types.ProxyConfig, candidates ...url.URL) http.HandlerFunc {
+	providerConfig, _ := types.DefaultConfig()
+	config.Strategy = StrategyRoundRobin
+	providerConfig.Proxy = config
+
+	return NewHandlerFunc(providerConfig, &staticResolver{candidates: candidates}, nil, nil, nil, nil, nil, hclog.NewNullLogger())
+}
+
+func invokeProxy(handler http.HandlerFunc, method string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/function/echo", strings.NewReader(body))
+	request = mux.SetURLVars(request, map[string]string{"name": "echo"})
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+func TestProxyRetriesOnAnotherEndpointWhenConnectionFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	handler := setupProxy(types.ProxyConfig{MaxRetries: 1, RetryBodyLimit: 1024}, closedEndpoint(t), serverEndpoint(server))
+
+	recorder := invokeProxy(handler, http.MethodPost, "hello")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "hello", recorder.Body.String())
+}
+
+func TestProxyDoesNotRetryWhenRetriesAreDisabled(t *testing.T) {
+	handler := setupProxy(types.ProxyConfig{MaxRetries: 0}, closedEndpoint(t), closedEndpoint(t))
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
+
+func TestProxyDoesNotRetryNonIdempotentRequestAfterItWasSent(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		hj, _ := w.(http.Hijacker)
+		conn, _, _ := hj.Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	handler := setupProxy(types.ProxyConfig{MaxRetries: 3, RetryBodyLimit: 1024}, serverEndpoint(server))
+
+	recorder := invokeProxy(handler, http.MethodPost, "hello")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestProxyRetriesIdempotentRequestAfterItWasSent(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	handler := setupProxy(types.ProxyConfig{MaxRetries: 3, RetryBackoff: time.Millisecond}, serverEndpoint(server))
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestProxyDoesNotRetryWhenBodyExceedsLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	handler := setupProxy(types.ProxyConfig{MaxRetries: 1, RetryBodyLimit: 2}, closedEndpoint(t), serverEndpoint(server))
+
+	recorder := invokeProxy(handler, http.MethodPost, "hello")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
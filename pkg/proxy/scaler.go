@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	scaleMinLabel = "com.openfaas.scale.min"
+)
+
+// functionScaler brings functions which are scaled to zero back up when they are invoked.
+// Concurrent requests for the same function share a single scale operation.
+type functionScaler struct {
+	jobs         services.Jobs
+	resolver     BaseURLResolver
+	prefix       string
+	namespace    string
+	timeout      time.Duration
+	pollInterval time.Duration
+	log          hclog.Logger
+
+	mu     sync.Mutex
+	starts map[string]*coldStart
+}
+
+type coldStart struct {
+	done       chan struct{}
+	candidates []url.URL
+	err        error
+}
+
+func newFunctionScaler(config *types.ProviderConfig, jobs services.Jobs, resolver BaseURLResolver, log hclog.Logger) *functionScaler {
+	if jobs == nil || !config.Proxy.ScaleFromZero {
+		return nil
+	}
+
+	return &functionScaler{
+		jobs:         jobs,
+		resolver:     resolver,
+		prefix:       config.Scheduling.JobPrefix,
+		namespace:    config.Scheduling.Namespace,
+		timeout:      config.Proxy.ScaleFromZeroTimeout,
+		pollInterval: 250 * time.Millisecond,
+		log:          log,
+		starts:       map[string]*coldStart{},
+	}
+}
+
+// scaleFromZero scales the function up when it has no replicas, and waits until the resolver reports
+// an endpoint or the deadline passes. Functions with replicas are left untouched.
+func (s *functionScaler) scaleFromZero(ctx context.Context, functionName string) ([]url.URL, error) {
+	name := strings.TrimSuffix(functionName, "."+s.namespace)
+
+	s.mu.Lock()
+	start, ok := s.starts[name]
+	if !ok {
+		start = &coldStart{done: make(chan struct{})}
+		s.starts[name] = start
+
+		go func() {
+			start.candidates, start.err = s.start(functionName, name)
+			close(start.done)
+
+			s.mu.Lock()
+			delete(s.starts, name)
+			s.mu.Unlock()
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-start.done:
+		return start.candidates, start.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *functionScaler) start(functionName, name string) ([]url.URL, error) {
+	jobID := fmt.Sprintf("%s%s", s.prefix, name)
+
+	job, _, err := s.jobs.Info(jobID, &api.QueryOptions{Namespace: s.namespace})
+	if err != nil {
+		return nil, err
+	}
+
+	if job == nil || len(job.TaskGroups) == 0 || job.TaskGroups[0].Count == nil || *job.TaskGroups[0].Count > 0 {
+		return nil, nil
+	}
+
+	status := services.CreateFunctionStatus(job, s.prefix)
+	replicas := types.ParseIntValueFromMap(status.Labels, scaleMinLabel, 1)
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	s.log.Info("Scaling function from zero", "function", name, "replicas", replicas)
+
+	_, _, err = s.jobs.Scale(jobID, name, &replicas, "scaled from zero by the faas-nomad proxy", false, nil, &api.WriteOptions{Namespace: s.namespace})
+	if err != nil {
+		s.log.Error("Error scaling function from zero", "function", name, "error", err.Error())
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		candidates, err := s.resolver.ResolveAll(functionName)
+		if err == nil && len(candidates) > 0 {
+			s.log.Debug("Function scaled from zero", "function", name, "replicas", replicas)
+			return candidates, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.log.Warn("Timeout waiting for function to scale from zero", "function", name, "timeout", s.timeout)
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type scalingResolver struct {
+	scaled     int32
+	candidates []url.URL
+}
+
+func (s *scalingResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	if atomic.LoadInt32(&s.scaled) == 1 {
+		return s.candidates, nil
+	}
+	return []url.URL{}, nil
+}
+
+func createScaledJob(count int, labels map[string]interface{}) *api.Job {
+	name := "faas-fn-echo"
+	namespace := "default"
+	now := time.Now().UnixNano()
+	return &api.Job{
+		ID:         &name,
+		Name:       &name,
+		Namespace:  &namespace,
+		SubmitTime: &now,
+		TaskGroups: []*api.TaskGroup{{
+			Count: &count,
+			Tasks: []*api.Task{{
+				Name:   "echo",
+				Config: map[string]interface{}{"image": "echo", "labels": []interface{}{labels}},
+			}},
+		}},
+	}
+}
+
+func setupFunctionScaler(jobs *services.MockJobs, resolver BaseURLResolver) *functionScaler {
+	config, _ := types.DefaultConfig()
+	config.Proxy.ScaleFromZeroTimeout = time.Second
+
+	scaler := newFunctionScaler(config, jobs, resolver, hclog.NewNullLogger())
+	scaler.pollInterval = 5 * time.Millisecond
+	return scaler
+}
+
+func TestFunctionScalerScalesToMinReplicasAndWaitsForEndpoint(t *testing.T) {
+	jobs := &services.MockJobs{}
+	resolver := &scalingResolver{candidates: createCandidates("10.0.0.1:8080")}
+	scaler := setupFunctionScaler(jobs, resolver)
+
+	jobs.On("Info", "faas-fn-echo", mock.Anything).Return(createScaledJob(0, map[string]interface{}{scaleMinLabel: "2"}), nil, nil)
+	jobs.On("Scale", "faas-fn-echo", "echo", mock.Anything, mock.Anything, false, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				atomic.StoreInt32(&resolver.scaled, 1)
+			}()
+		}).
+		Return(nil, nil, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			candidates, err := scaler.scaleFromZero(context.Background(), "echo")
+			assert.NoError(t, err)
+			assert.Equal(t, resolver.candidates, candidates)
+		}()
+	}
+	wg.Wait()
+
+	jobs.AssertNumberOfCalls(t, "Scale", 1)
+	assert.Equal(t, 2, *jobs.Calls[1].Arguments.Get(2).(*int))
+}
+
+func TestFunctionScalerIgnoresFunctionsWithReplicas(t *testing.T) {
+	jobs := &services.MockJobs{}
+	scaler := setupFunctionScaler(jobs, &scalingResolver{})
+
+	jobs.On("Info", "faas-fn-echo", mock.Anything).Return(createScaledJob(1, map[string]interface{}{}), nil, nil)
+
+	candidates, err := scaler.scaleFromZero(context.Background(), "echo")
+
+	assert.NoError(t, err)
+	assert.Empty(t, candidates)
+	jobs.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestFunctionScalerGivesUpAfterDeadline(t *testing.T) {
+	jobs := &services.MockJobs{}
+	scaler := setupFunctionScaler(jobs, &scalingResolver{})
+	scaler.timeout = 50 * time.Millisecond
+
+	jobs.On("Info", "faas-fn-echo", mock.Anything).Return(createScaledJob(0, map[string]interface{}{}), nil, nil)
+	jobs.On("Scale", "faas-fn-echo", "echo", mock.Anything, mock.Anything, false, mock.Anything, mock.Anything).Return(nil, nil, nil)
+
+	_, err := scaler.scaleFromZero(context.Background(), "echo")
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, *jobs.Calls[1].Arguments.Get(2).(*int))
+}
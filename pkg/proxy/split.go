@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	trafficSplitAnnotation = "com.openfaas.traffic_split"
+
+	// VersionHeader names the version of the function which served a request, when the traffic of the
+	// requested function is split between versions.
+	VersionHeader = "X-Function-Version"
+)
+
+// TrafficSplits holds the weighted traffic splits between the versions of a function, e.g. `fn` and `fn-v2`.
+//
+// A split is declared on the primary function with the `com.openfaas.traffic_split` annotation, as a comma
+// separated list of versions and weights, e.g. `fn-v2=10`. When the primary function is not listed, it
+// receives the remainder of 100. The weights can be adjusted at runtime with Set, these overrides take
+// precedence over the annotation and are kept in memory until they are reset.
+type TrafficSplits struct {
+	mu        sync.RWMutex
+	overrides map[string]map[string]int
+	random    func(n int) int
+}
+
+func NewTrafficSplits() *TrafficSplits {
+	return &TrafficSplits{
+		overrides: map[string]map[string]int{},
+		random:    rand.Intn,
+	}
+}
+
+// Get returns the effective weights of the versions of a function, and whether its traffic is split.
+func (ts *TrafficSplits) Get(function string, fn *ftypes.FunctionStatus) (map[string]int, bool) {
+	if ts == nil {
+		return nil, false
+	}
+
+	ts.mu.RLock()
+	override, ok := ts.overrides[function]
+	ts.mu.RUnlock()
+
+	if ok {
+		return override, true
+	}
+
+	if fn == nil || fn.Annotations == nil {
+		return nil, false
+	}
+
+	value, ok := (*fn.Annotations)[trafficSplitAnnotation]
+	if !ok {
+		return nil, false
+	}
+
+	weights, err := parseWeights(value)
+	if err != nil {
+		return nil, false
+	}
+
+	weights, err = normalizeWeights(function, weights)
+	if err != nil {
+		return nil, false
+	}
+
+	return weights, true
+}
+
+// Set overrides the weights of the versions of a function.
+func (ts *TrafficSplits) Set(function string, weights map[string]int) error {
+	normalized, err := normalizeWeights(function, weights)
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.overrides[function] = normalized
+
+	return nil
+}
+
+// Reset removes the overridden weights of a function, the annotation applies again.
+func (ts *TrafficSplits) Reset(function string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.overrides, function)
+}
+
+// Forget removes a deleted function from the overridden weights: its own weights are reset, and it no longer
+// receives the traffic of the other functions. The overrides left without any weight are reset.
+func (ts *TrafficSplits) Forget(function string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.overrides, function)
+
+	for primary, weights := range ts.overrides {
+		if _, ok := weights[function]; !ok {
+			continue
+		}
+
+		remaining := map[string]int{}
+		total := 0
+		for name, weight := range weights {
+			if name != function {
+				remaining[name] = weight
+				total += weight
+			}
+		}
+
+		if total == 0 {
+			delete(ts.overrides, primary)
+		} else {
+			ts.overrides[primary] = remaining
+		}
+	}
+}
+
+// pick selects the version of the function serving a request, proportionally to the weights.
+func (ts *TrafficSplits) pick(function string, fn *ftypes.FunctionStatus) string {
+	weights, ok := ts.Get(function, fn)
+	if !ok {
+		return function
+	}
+
+	names := make([]string, 0, len(weights))
+	total := 0
+	for name, weight := range weights {
+		names = append(names, name)
+		total += weight
+	}
+	sort.Strings(names)
+
+	n := ts.random(total)
+	for _, name := range names {
+		n -= weights[name]
+		if n < 0 {
+			return name
+		}
+	}
+
+	return function
+}
+
+// parseWeights parses a list of versions and weights, e.g. `fn=90,fn-v2=10`.
+func parseWeights(value string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid traffic split entry: " + entry)
+		}
+
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.New("invalid traffic split weight: " + entry)
+		}
+
+		weights[strings.TrimSpace(parts[0])] = weight
+	}
+	return weights, nil
+}
+
+// normalizeWeights validates the weights, and assigns the remainder of 100 to the primary function
+// when it isn't listed.
+func normalizeWeights(function string, weights map[string]int) (map[string]int, error) {
+	result := map[string]int{}
+	total := 0
+	for name, weight := range weights {
+		if name == "" {
+			return nil, errors.New("traffic split version without name")
+		}
+		if weight < 0 {
+			return nil, errors.New("traffic split weight must not be negative: " + name)
+		}
+		result[name] = weight
+		total += weight
+	}
+
+	if _, ok := result[function]; !ok && total < 100 {
+		result[function] = 100 - total
+		total = 100
+	}
+
+	if total == 0 {
+		return nil, errors.New("traffic split weights must not all be zero")
+	}
+
+	return result, nil
+}
+
+// splitKey marks the context of a request routed by a traffic split, with the name of the primary function.
+type splitKey struct{}
+
+// split routes the request to the version of the function selected by its traffic split. The request is
+// authenticated and rate limited on the primary function first, so the split can't bypass its policies, the
+// selected version being checked with its own policies when the request is proxied. It returns false when
+// the request has been rejected.
+func (p *functionProxy) split(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	vars := mux.Vars(r)
+	functionName := strings.TrimSuffix(vars["name"], "."+p.namespace)
+	if functionName == "" || p.splits == nil {
+		return r, true
+	}
+
+	fn, lookupErr := p.lookup(functionName)
+	if _, ok := p.splits.Get(functionName, fn); !ok {
+		return r, true
+	}
+
+	if !p.admit(w, r, functionName, fn, lookupErr) {
+		return r, false
+	}
+
+	routed := map[string]string{}
+	for k, v := range vars {
+		routed[k] = v
+	}
+	routed["name"] = p.splits.pick(functionName, fn)
+
+	ctx := context.WithValue(r.Context(), splitKey{}, functionName)
+	return mux.SetURLVars(r.WithContext(ctx), routed), true
+}
+
+// splitFrom returns the primary function of a request routed by a traffic split, if any.
+func splitFrom(r *http.Request) (string, bool) {
+	primary, ok := r.Context().Value(splitKey{}).(string)
+	return primary, ok
+}
+
+// markVersion adds the version header to the response of a request routed by a traffic split.
+func markVersion(w http.ResponseWriter, r *http.Request, version string) {
+	if _, ok := splitFrom(r); ok {
+		w.Header().Set(VersionHeader, version)
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type versionResolver struct {
+	versions map[string][]url.URL
+}
+
+func (v *versionResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	return v.versions[functionName], nil
+}
+
+func versionServer(version string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(version))
+	}))
+}
+
+func TestTrafficSplitFromAnnotation(t *testing.T) {
+	splits := NewTrafficSplits()
+
+	annotations := map[string]string{trafficSplitAnnotation: "echo-v2=10"}
+	weights, ok := splits.Get("echo", &ftypes.FunctionStatus{Annotations: &annotations})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int{"echo": 90, "echo-v2": 10}, weights)
+
+	explicit := map[string]string{trafficSplitAnnotation: "echo=1, echo-v2=3"}
+	weights, ok = splits.Get("echo", &ftypes.FunctionStatus{Annotations: &explicit})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int{"echo": 1, "echo-v2": 3}, weights)
+
+	invalid := map[string]string{trafficSplitAnnotation: "echo-v2"}
+	_, ok = splits.Get("echo", &ftypes.FunctionStatus{Annotations: &invalid})
+	assert.False(t, ok)
+
+	_, ok = splits.Get("echo", &ftypes.FunctionStatus{})
+	assert.False(t, ok)
+}
+
+func TestTrafficSplitOverridesTakePrecedence(t *testing.T) {
+	splits := NewTrafficSplits()
+	annotations := map[string]string{trafficSplitAnnotation: "echo-v2=10"}
+	fn := &ftypes.FunctionStatus{Annotations: &annotations}
+
+	assert.NoError(t, splits.Set("echo", map[string]int{"echo-v2": 50}))
+
+	weights, _ := splits.Get("echo", fn)
+	assert.Equal(t, map[string]int{"echo": 50, "echo-v2": 50}, weights)
+
+	splits.Reset("echo")
+
+	weights, _ = splits.Get("echo", fn)
+	assert.Equal(t, map[string]int{"echo": 90, "echo-v2": 10}, weights)
+
+	assert.Error(t, splits.Set("echo", map[string]int{"echo-v2": -1}))
+	assert.Error(t, splits.Set("echo", map[string]int{"echo": 0, "echo-v2": 0}))
+}
+
+func TestTrafficSplitForgetsDeletedFunctions(t *testing.T) {
+	splits := NewTrafficSplits()
+
+	assert.NoError(t, splits.Set("echo", map[string]int{"echo-v2": 20, "echo-v3": 30}))
+	assert.NoError(t, splits.Set("other", map[string]int{"other": 0, "echo-v2": 100}))
+	assert.NoError(t, splits.Set("echo-v2", map[string]int{"echo-v3": 10}))
+
+	splits.Forget("echo-v2")
+
+	weights, _ := splits.Get("echo", nil)
+	assert.Equal(t, map[string]int{"echo": 50, "echo-v3": 30}, weights)
+
+	_, ok := splits.Get("other", nil)
+	assert.False(t, ok)
+
+	_, ok = splits.Get("echo-v2", nil)
+	assert.False(t, ok)
+}
+
+func TestTrafficSplitPicksVersionsByWeight(t *testing.T) {
+	splits := NewTrafficSplits()
+	assert.NoError(t, splits.Set("echo", map[string]int{"echo-v2": 10}))
+
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		splits.random = func(n int) int { return i % n }
+		counts[splits.pick("echo", nil)]++
+	}
+
+	assert.Equal(t, map[string]int{"echo": 90, "echo-v2": 10}, counts)
+	assert.Equal(t, "other", splits.pick("other", nil))
+}
+
+func TestProxyRoutesRequestsToSelectedVersion(t *testing.T) {
+	v1 := versionServer("v1")
+	defer v1.Close()
+	v2 := versionServer("v2")
+	defer v2.Close()
+
+	resolver := &versionResolver{versions: map[string][]url.URL{
+		"echo":    {serverEndpoint(v1)},
+		"echo-v2": {serverEndpoint(v2)},
+	}}
+
+	splits := NewTrafficSplits()
+	providerConfig, _ := types.DefaultConfig()
+	handler := NewHandlerFunc(providerConfig, resolver, nil, nil, nil, nil, splits, hclog.NewNullLogger())
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, "v1", recorder.Body.String())
+	assert.Empty(t, recorder.Header().Get(VersionHeader))
+
+	assert.NoError(t, splits.Set("echo", map[string]int{"echo": 0, "echo-v2": 1}))
+
+	recorder = invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, "v2", recorder.Body.String())
+	assert.Equal(t, "echo-v2", recorder.Header().Get(VersionHeader))
+}
+
+func setupSplitAuthProxy(t *testing.T, secrets services.Secrets, primary map[string]string, version map[string]string) http.HandlerFunc {
+	v1 := versionServer("v1")
+	t.Cleanup(v1.Close)
+	v2 := versionServer("v2")
+	t.Cleanup(v2.Close)
+
+	resolver := &versionResolver{versions: map[string][]url.URL{
+		"echo":    {serverEndpoint(v1)},
+		"echo-v2": {serverEndpoint(v2)},
+	}}
+
+	functions := &services.MockFunctions{}
+	functions.On("Get", "echo").Return(&ftypes.FunctionStatus{Name: "echo", Annotations: &primary}, nil)
+	functions.On("Get", "echo-v2").Return(&ftypes.FunctionStatus{Name: "echo-v2", Annotations: &version}, nil)
+
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.Proxy.ScaleFromZero = false
+	return NewHandlerFunc(providerConfig, resolver, functions, nil, secrets, nil, NewTrafficSplits(), hclog.NewNullLogger())
+}
+
+func TestProxyAuthenticatesPrimaryFunctionBeforeSplitting(t *testing.T) {
+	secrets := &services.MockSecrets{}
+	secrets.On("Get", "echo-keys").Return(encodedSecret("key"), nil)
+
+	handler := setupSplitAuthProxy(t, secrets,
+		map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-keys", trafficSplitAnnotation: "echo-v2=100"},
+		map[string]string{},
+	)
+
+	recorder := invokeWithHeaders(handler, nil)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Empty(t, recorder.Header().Get(VersionHeader))
+
+	recorder = invokeWithHeaders(handler, map[string]string{defaultAPIKeyHeader: "key"})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "v2", recorder.Body.String())
+	assert.Equal(t, "echo-v2", recorder.Header().Get(VersionHeader))
+}
+
+func TestProxyAuthenticatesSelectedVersion(t *testing.T) {
+	secrets := &services.MockSecrets{}
+	secrets.On("Get", "echo-v2-keys").Return(encodedSecret("key"), nil)
+
+	handler := setupSplitAuthProxy(t, secrets,
+		map[string]string{trafficSplitAnnotation: "echo-v2=100"},
+		map[string]string{authAnnotation: "api_key", authAPIKeySecretAnnotation: "echo-v2-keys"},
+	)
+
+	recorder := invokeWithHeaders(handler, nil)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Empty(t, recorder.Header().Get(VersionHeader))
+
+	recorder = invokeWithHeaders(handler, map[string]string{defaultAPIKeyHeader: "key"})
+	assert.Equal(t, "v2", recorder.Body.String())
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	stdhttputil "net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jsiebens/faas-nomad/pkg/tracing"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/openfaas/faas-provider/httputil"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	streamingAnnotation = "com.openfaas.proxy.streaming"
+
+	eventStreamContentType = "text/event-stream"
+	copyBufferSize         = 32 * 1024
+)
+
+// isStreaming reports whether the response of the function is expected to be streamed, because the caller
+// accepts Server-Sent Events or the function is annotated with `com.openfaas.proxy.streaming=true`.
+// Streaming requests are not bound by the total timeout of the proxy client, nor by the write timeout
+// (write_timeout) of the other requests, but by an idle timeout.
+func isStreaming(r *http.Request, fn *ftypes.FunctionStatus) bool {
+	if strings.Contains(r.Header.Get("Accept"), eventStreamContentType) {
+		return true
+	}
+	return fn != nil && types.ParseBoolValueFromMap(fn.Annotations, streamingAnnotation, false)
+}
+
+// isUpgrade reports whether the request asks to switch protocols, e.g. to open a WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idleTimeout cancels a context when it isn't reset within the timeout.
+type idleTimeout struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func withIdleTimeout(ctx context.Context, timeout time.Duration) (context.Context, *idleTimeout) {
+	ctx, cancel := context.WithCancel(ctx)
+	idle := &idleTimeout{timeout: timeout, cancel: cancel}
+	if timeout > 0 {
+		idle.timer = time.AfterFunc(timeout, cancel)
+	}
+	return ctx, idle
+}
+
+func (i *idleTimeout) reset() {
+	if i != nil && i.timer != nil {
+		i.timer.Reset(i.timeout)
+	}
+}
+
+func (i *idleTimeout) stop() {
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+	i.cancel()
+}
+
+// copyResponse copies the body of the response to the client. When flush is enabled, every chunk is
+// sent to the client as soon as it is read, instead of waiting for the buffer of the server to fill up.
+func copyResponse(w http.ResponseWriter, body io.Reader, flush bool, idle *idleTimeout) error {
+	flusher, canFlush := w.(http.Flusher)
+	buf := make([]byte, copyBufferSize)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			idle.reset()
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flush && canFlush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// shouldFlush reports whether the response must be flushed to the client chunk by chunk.
+func shouldFlush(response *http.Response, streaming bool) bool {
+	return streaming ||
+		response.ContentLength == -1 ||
+		strings.HasPrefix(response.Header.Get("Content-Type"), eventStreamContentType)
+}
+
+// tunnel forwards a protocol upgrade request (e.g. a WebSocket) to one of the candidates. Once the function
+// accepted the upgrade, the client connection is hijacked and the traffic is copied in both directions until
+// one side closes the connection or no data is exchanged for the idle timeout.
+func (p *functionProxy) tunnel(w http.ResponseWriter, originalReq *http.Request, functionName string, fn *ftypes.FunctionStatus, candidates []url.URL, locations locations) {
+	functionAddr, err := p.selectEndpoint(p.balancers.forFunction(fn), functionName, candidates, locations, nil, 0, originalReq)
+	if err != nil {
+		httputil.Errorf(w, http.StatusServiceUnavailable, "No endpoints available for: %s.", functionName)
+		return
+	}
+
+	target, err := buildProxyRequest(originalReq, functionAddr, mux.Vars(originalReq)["params"])
+	if err != nil {
+		httputil.Errorf(w, http.StatusInternalServerError, "Can't reach service for: %s.", functionName)
+		return
+	}
+
+	p.load.acquire(functionAddr)
+	defer p.load.release(functionAddr)
+
+	start := time.Now()
+	failed := false
+
+	proxy := &stdhttputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = target.URL
+			req.Host = target.URL.Host
+			req.Header = target.Header
+			// the reverse proxy appends the client address itself
+			if _, ok := originalReq.Header["X-Forwarded-For"]; !ok {
+				req.Header.Del("X-Forwarded-For")
+			}
+			tracing.Inject(req.Context(), req.Header)
+		},
+		Transport: p.streamClient.Transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			failed = true
+			p.outliers.report(functionName, functionAddr, 0, err, time.Since(start))
+			p.log.Error("error with upgrade request", "target", target.URL.String(), "error", err.Error())
+			httputil.Errorf(w, http.StatusBadGateway, "Can't reach service for: %s.", functionName)
+		},
+		ModifyResponse: func(response *http.Response) error {
+			p.outliers.report(functionName, functionAddr, response.StatusCode, nil, time.Since(start))
+			return nil
+		},
+	}
+
+	proxy.ServeHTTP(&tunnelWriter{ResponseWriter: w, idleTimeout: p.config.StreamIdleTimeout}, originalReq)
+
+	if !failed {
+		p.log.Debug("upgrade request proxied successfully", "function", functionName, "target", target.URL.String(), "time", time.Since(start).Seconds())
+	}
+}
+
+// tunnelWriter hijacks the client connection for a tunnel. The read and write timeouts of the server
+// no longer apply to the hijacked connection, it is closed when idle instead.
+type tunnelWriter struct {
+	http.ResponseWriter
+	idleTimeout time.Duration
+}
+
+func (t *tunnelWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := t.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if t.idleTimeout <= 0 {
+		conn.SetDeadline(time.Time{})
+		return conn, rw, nil
+	}
+
+	idle := &idleConn{Conn: conn, timeout: t.idleTimeout}
+	idle.extend()
+	return idle, rw, nil
+}
+
+// idleConn extends the deadline of the connection every time data is exchanged.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) extend() {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupProxyServer serves the proxy for the echo function over HTTP, with the given client timeout.
+func setupProxyServer(timeout time.Duration, config types.ProxyConfig, candidates ...url.URL) *httptest.Server {
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.FaaS.ReadTimeout = timeout
+	config.Strategy = StrategyRoundRobin
+	providerConfig.Proxy = config
+
+	handler := NewHandlerFunc(providerConfig, &staticResolver{candidates: candidates}, nil, nil, nil, nil, nil, hclog.NewNullLogger())
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, mux.SetURLVars(r, map[string]string{"name": "echo"}))
+	}))
+}
+
+func TestProxyFlushesServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	function := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer function.Close()
+
+	server := setupProxyServer(100*time.Millisecond, types.ProxyConfig{StreamIdleTimeout: time.Second}, serverEndpoint(function))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("Accept", "text/event-stream")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	for i := 0; i < 3; i++ {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("data: %d\n", i), line)
+		reader.ReadString('\n')
+
+		// outlive the total timeout of the proxy client
+		time.Sleep(60 * time.Millisecond)
+		next <- struct{}{}
+	}
+}
+
+func TestProxyStreamsPastWriteTimeout(t *testing.T) {
+	function := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("done"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer function.Close()
+
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.FaaS.WriteTimeout = 150 * time.Millisecond
+	providerConfig.Proxy = types.ProxyConfig{Strategy: StrategyRoundRobin, StreamIdleTimeout: time.Second}
+	handler := NewHandlerFunc(providerConfig, &staticResolver{candidates: []url.URL{serverEndpoint(function)}}, nil, nil, nil, nil, nil, hclog.NewNullLogger())
+
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	recorder := httptest.NewRecorder()
+	handler(recorder, mux.SetURLVars(request, map[string]string{"name": "echo"}))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "data: 0\n\ndata: 1\n\ndata: 2\n\n", recorder.Body.String())
+
+	// the responses which are not streamed are still bound by the write timeout
+	recorder = invokeProxy(handler, http.MethodGet, "")
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+}
+
+func TestProxyCancelsIdleStreams(t *testing.T) {
+	done := make(chan struct{})
+	function := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer function.Close()
+	defer close(done)
+
+	server := setupProxyServer(time.Minute, types.ProxyConfig{StreamIdleTimeout: 100 * time.Millisecond}, serverEndpoint(function))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("Accept", "text/event-stream")
+
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	assert.Equal(t, "data: first\n\n", string(body))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestProxyTunnelsUpgradeRequests(t *testing.T) {
+	function := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+
+		line, _ := rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}))
+	defer function.Close()
+
+	server := setupProxyServer(time.Minute, types.ProxyConfig{StreamIdleTimeout: time.Second}, serverEndpoint(function))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", serverEndpoint(server).Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /function/echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
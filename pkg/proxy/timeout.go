@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	timeoutAnnotation = "com.openfaas.timeout"
+	execTimeoutEnv    = "exec_timeout"
+)
+
+// functionTimeout returns the deadline of an invocation, from the `com.openfaas.timeout` annotation or the
+// `exec_timeout` environment variable of the function, capped by the configured maximum. Zero means the
+// function has no timeout of its own, and the timeout of the proxy client applies.
+func functionTimeout(config types.ProxyConfig, fn *ftypes.FunctionStatus) time.Duration {
+	if fn == nil {
+		return 0
+	}
+
+	timeout := types.ParseIntOrDurationValueFromMap(fn.Annotations, timeoutAnnotation, 0)
+	if timeout <= 0 {
+		timeout = ftypes.ParseIntOrDurationValue(fn.EnvVars[execTimeoutEnv], 0)
+	}
+
+	if timeout <= 0 {
+		return 0
+	}
+
+	if config.MaxTimeout > 0 && timeout > config.MaxTimeout {
+		return config.MaxTimeout
+	}
+
+	return timeout
+}
+
+// isTimeout reports whether the invocation failed because a deadline was exceeded.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticFunctions struct {
+	function ftypes.FunctionStatus
+}
+
+func (s *staticFunctions) Get(functionName string) (*ftypes.FunctionStatus, error) {
+	return &s.function, nil
+}
+
+func (s *staticFunctions) Invalidate(functionName string) {
+}
+
+func setupProxyWithFunction(fn ftypes.FunctionStatus, readTimeout time.Duration, config types.ProxyConfig, candidates ...url.URL) http.HandlerFunc {
+	providerConfig, _ := types.DefaultConfig()
+	providerConfig.FaaS.ReadTimeout = readTimeout
+	config.Strategy = StrategyRoundRobin
+	providerConfig.Proxy = config
+
+	return NewHandlerFunc(providerConfig, &staticResolver{candidates: candidates}, &staticFunctions{function: fn}, nil, nil, nil, nil, hclog.NewNullLogger())
+}
+
+func slowFunction(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func TestFunctionTimeout(t *testing.T) {
+	config := types.ProxyConfig{MaxTimeout: time.Minute}
+
+	annotations := map[string]string{timeoutAnnotation: "10s"}
+	assert.Equal(t, 10*time.Second, functionTimeout(config, &ftypes.FunctionStatus{Annotations: &annotations}))
+
+	assert.Equal(t, 20*time.Second, functionTimeout(config, &ftypes.FunctionStatus{EnvVars: map[string]string{execTimeoutEnv: "20"}}))
+
+	capped := map[string]string{timeoutAnnotation: "1h"}
+	assert.Equal(t, time.Minute, functionTimeout(config, &ftypes.FunctionStatus{Annotations: &capped}))
+
+	assert.Equal(t, time.Duration(0), functionTimeout(config, &ftypes.FunctionStatus{}))
+	assert.Equal(t, time.Duration(0), functionTimeout(config, nil))
+}
+
+func TestProxyReturnsGatewayTimeoutWhenFunctionTimesOut(t *testing.T) {
+	function := slowFunction(time.Second)
+	defer function.Close()
+
+	annotations := map[string]string{timeoutAnnotation: "50ms"}
+	handler := setupProxyWithFunction(ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}, time.Minute, types.ProxyConfig{MaxTimeout: time.Minute}, serverEndpoint(function))
+
+	start := time.Now()
+	recorder := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestProxyAllowsFunctionTimeoutLongerThanClientTimeout(t *testing.T) {
+	function := slowFunction(100 * time.Millisecond)
+	defer function.Close()
+
+	annotations := map[string]string{timeoutAnnotation: "1s"}
+	handler := setupProxyWithFunction(ftypes.FunctionStatus{Name: "echo", Annotations: &annotations}, 50*time.Millisecond, types.ProxyConfig{MaxTimeout: time.Minute}, serverEndpoint(function))
+
+	recorder := invokeProxy(handler, http.MethodGet, "")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "done", recorder.Body.String())
+}
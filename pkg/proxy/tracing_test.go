@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func setupTracing(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	return recorder
+}
+
+func TestProxyPropagatesTraceContext(t *testing.T) {
+	spans := setupTracing(t)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	handler := setupProxy(types.ProxyConfig{MaxRetries: 1}, closedEndpoint(t), serverEndpoint(server))
+
+	request := httptest.NewRequest(http.MethodGet, "/function/echo", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	handler(recorder, mux.SetURLVars(request, map[string]string{"name": "echo"}))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, traceparent, traceID)
+	assert.NotContains(t, traceparent, "00f067aa0ba902b7")
+
+	var names []string
+	for _, span := range spans.Ended() {
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String())
+		names = append(names, span.Name())
+	}
+	assert.ElementsMatch(t, []string{"resolve", "upstream", "upstream", "proxy echo"}, names)
+}
+
+func TestProxyRecordsFunctionAttributes(t *testing.T) {
+	spans := setupTracing(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	handler := setupProxy(types.ProxyConfig{}, serverEndpoint(server))
+	invokeProxy(handler, http.MethodGet, "")
+
+	for _, span := range spans.Ended() {
+		if span.Name() != "upstream" {
+			continue
+		}
+
+		attributes := map[string]string{}
+		for _, a := range span.Attributes() {
+			attributes[string(a.Key)] = a.Value.Emit()
+		}
+
+		assert.Equal(t, "echo", attributes["faas.name"])
+		assert.Equal(t, "default", attributes["faas.namespace"])
+		assert.Equal(t, serverEndpoint(server).Host, attributes["faas.endpoint"])
+		assert.Equal(t, "200", attributes["http.status_code"])
+		return
+	}
+
+	t.Fatal("no upstream span recorded")
+}
@@ -0,0 +1,143 @@
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul/api"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+// failover resolves the instances of a function in other datacenters when none is available in the local one,
+// either with health queries in an ordered list of datacenters or with a prepared query.
+//
+// Unlike the local instances, the remote instances are not watched: they are only needed during an outage of
+// the local datacenter, and are kept for a short TTL so an outage doesn't result in a query for every request.
+type failover struct {
+	datacenters   []string
+	preparedQuery bool
+	ttl           time.Duration
+
+	// the resolved instances, by service and health filter
+	cache sync.Map
+}
+
+type failoverItem struct {
+	service   string
+	endpoints []Endpoint
+	expires   time.Time
+}
+
+func newFailover(config types.ConsulConfig) *failover {
+	return &failover{
+		datacenters:   config.FailoverDatacenters,
+		preparedQuery: config.FailoverPreparedQuery,
+		ttl:           config.FailoverTTL,
+	}
+}
+
+func (f *failover) enabled() bool {
+	return f.preparedQuery || len(f.datacenters) != 0
+}
+
+// forget removes the instances of a service, e.g. when the function is deleted.
+func (f *failover) forget(service string) {
+	f.cache.Range(func(key, value interface{}) bool {
+		if value.(*failoverItem).service == service {
+			f.cache.Delete(key)
+		}
+		return true
+	})
+}
+
+// resolveFailover resolves the instances of a service in the first failover datacenter having any.
+func (cr *ConsulServiceResolver) resolveFailover(service string, filter healthFilter) ([]Endpoint, error) {
+	key := service + "|" + filter.String()
+	now := cr.now()
+
+	if value, ok := cr.failover.cache.Load(key); ok {
+		if item := value.(*failoverItem); now.Before(item.expires) {
+			return item.endpoints, nil
+		}
+	}
+
+	var endpoints []Endpoint
+	var err error
+	if cr.failover.preparedQuery {
+		endpoints, err = cr.executePreparedQuery(service, filter)
+	} else {
+		endpoints, err = cr.queryDatacenters(service, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(endpoints) != 0 {
+		cr.logger.Debug("Resolved function service in failover datacenter", "service", service, "datacenter", endpoints[0].ConsulDatacenter)
+	}
+
+	cr.failover.cache.Store(key, &failoverItem{service: service, endpoints: endpoints, expires: now.Add(cr.failover.ttl)})
+
+	return endpoints, nil
+}
+
+// queryDatacenters queries the failover datacenters in order, until one has instances of the service.
+// An unreachable datacenter is skipped.
+func (cr *ConsulServiceResolver) queryDatacenters(service string, filter healthFilter) ([]Endpoint, error) {
+	var lastErr error
+
+	for _, dc := range cr.failover.datacenters {
+		query, err := filter.query(service, dc)
+		if err != nil {
+			return nil, err
+		}
+
+		fetch, _, err := query.Fetch(cr.clientSet, &dependency.QueryOptions{AllowStale: true})
+		if err != nil {
+			cr.logger.Warn("Unable to query failover datacenter", "service", service, "datacenter", dc, "error", err.Error())
+			lastErr = err
+			continue
+		}
+
+		all := instances(fetch.([]*dependency.HealthService), dc)
+		if found := filter.apply(all, endpoints(all)); len(found) != 0 {
+			return found, nil
+		}
+	}
+
+	return []Endpoint{}, lastErr
+}
+
+// executePreparedQuery executes the prepared query named after the service, the failover being done by Consul.
+func (cr *ConsulServiceResolver) executePreparedQuery(service string, filter healthFilter) ([]Endpoint, error) {
+	response, _, err := cr.clientSet.Consul().PreparedQuery().Execute(service, &api.QueryOptions{AllowStale: true})
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]instance, 0, len(response.Nodes))
+	for _, entry := range response.Nodes {
+		if entry.Node == nil || entry.Service == nil || !filter.acceptsStatus(entry.Checks.AggregatedStatus()) {
+			continue
+		}
+
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		all = append(all, instance{
+			endpoint: Endpoint{
+				URL:              toUrl(address, entry.Service.Port),
+				Node:             entry.Node.Node,
+				Datacenter:       datacenterOf(entry.Service.Meta, response.Datacenter),
+				ConsulDatacenter: response.Datacenter,
+				NodeMeta:         entry.Node.Meta,
+			},
+			tags: entry.Service.Tags,
+		})
+	}
+
+	return filter.apply(all, endpoints(all)), nil
+}
@@ -0,0 +1,196 @@
+package resolver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"gopkg.in/yaml.v2"
+)
+
+// FileServiceResolver resolves the instances of the functions from a YAML or JSON file, mapping the function
+// names to their endpoints, e.g.
+//
+//	echo:
+//	  - http://127.0.0.1:8081
+//	figlet:
+//	  - url: http://10.0.0.1:8080
+//	    datacenter: dc2
+//	    meta:
+//	      zone: b
+//
+// The file is reloaded when it changes, so functions can be added or moved without restarting the provider.
+// It lets the proxy run without Consul or Nomad, e.g. for local development and tests.
+type FileServiceResolver struct {
+	path      string
+	namespace string
+	logger    hclog.Logger
+
+	mu        sync.RWMutex
+	functions map[string][]Endpoint
+
+	watcher  *fsnotify.Watcher
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// fileEndpoint is an endpoint of the file, either a URL or an object with the URL and the location of the node.
+type fileEndpoint struct {
+	URL        string            `yaml:"url"`
+	Node       string            `yaml:"node"`
+	Datacenter string            `yaml:"datacenter"`
+	Meta       map[string]string `yaml:"meta"`
+}
+
+func (e *fileEndpoint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.URL); err == nil {
+		return nil
+	}
+
+	type plain fileEndpoint
+	return unmarshal((*plain)(e))
+}
+
+func NewFileResolver(config *types.ProviderConfig, logger hclog.Logger) (*FileServiceResolver, error) {
+	if config.Discovery.File == "" {
+		return nil, fmt.Errorf("no service discovery file configured")
+	}
+
+	path, err := filepath.Abs(config.Discovery.File)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &FileServiceResolver{
+		path:      path,
+		namespace: config.Scheduling.Namespace,
+		logger:    logger.Named("file_resolver"),
+		stop:      make(chan struct{}),
+	}
+
+	if err := resolver.load(); err != nil {
+		return nil, err
+	}
+
+	// the directory is watched, as editors and config management usually replace the file instead of writing it
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	resolver.watcher = watcher
+
+	go resolver.watch()
+
+	return resolver, nil
+}
+
+// Close stops watching the file.
+func (fr *FileServiceResolver) Close() {
+	fr.stopOnce.Do(func() {
+		close(fr.stop)
+		fr.watcher.Close()
+	})
+}
+
+func (fr *FileServiceResolver) Resolve(function string) (url.URL, error) {
+	candidates, err := fr.ResolveAll(function)
+	if err != nil {
+		return url.URL{}, err
+	}
+	return balance(candidates)
+}
+
+func (fr *FileServiceResolver) ResolveAll(function string) ([]url.URL, error) {
+	endpoints, err := fr.ResolveEndpoints(function)
+	if err != nil {
+		return nil, err
+	}
+	return urls(endpoints), nil
+}
+
+func (fr *FileServiceResolver) ResolveEndpoints(function string) ([]Endpoint, error) {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+
+	if endpoints, ok := fr.functions[function]; ok {
+		return endpoints, nil
+	}
+	return fr.functions[strings.TrimSuffix(function, "."+fr.namespace)], nil
+}
+
+// Watch does nothing, the endpoints of all the functions are read from the file.
+func (fr *FileServiceResolver) Watch(function string) {
+}
+
+// Unwatch does nothing, the endpoints of all the functions are read from the file.
+func (fr *FileServiceResolver) Unwatch(function string) {
+}
+
+func (fr *FileServiceResolver) watch() {
+	for {
+		select {
+		case <-fr.stop:
+			return
+		case err, ok := <-fr.watcher.Errors:
+			if !ok {
+				return
+			}
+			fr.logger.Warn("Error watching service discovery file", "file", fr.path, "error", err.Error())
+		case event, ok := <-fr.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != fr.path || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			// a file being written can be incomplete, the previous endpoints are kept until it is valid again
+			if err := fr.load(); err != nil {
+				fr.logger.Warn("Unable to reload service discovery file", "file", fr.path, "error", err.Error())
+				continue
+			}
+			fr.logger.Debug("Reloaded service discovery file", "file", fr.path)
+		}
+	}
+}
+
+// load reads the endpoints of the functions from the file, JSON being read as YAML.
+func (fr *FileServiceResolver) load() error {
+	data, err := ioutil.ReadFile(fr.path)
+	if err != nil {
+		return err
+	}
+
+	var file map[string][]fileEndpoint
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", fr.path, err)
+	}
+
+	functions := make(map[string][]Endpoint, len(file))
+	for name, entries := range file {
+		endpoints := make([]Endpoint, 0, len(entries))
+		for _, e := range entries {
+			u, err := url.Parse(e.URL)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid endpoint %q of function %s", e.URL, name)
+			}
+			endpoints = append(endpoints, Endpoint{URL: *u, Node: e.Node, Datacenter: e.Datacenter, NodeMeta: e.Meta})
+		}
+		functions[name] = endpoints
+	}
+
+	fr.mu.Lock()
+	fr.functions = functions
+	fr.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package resolver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupFileResolver(t *testing.T, name string, content string) (*FileServiceResolver, string) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, _ := types.DefaultConfig()
+	config.Discovery.Provider = types.DiscoveryFile
+	config.Discovery.File = path
+
+	resolver, err := NewFileResolver(config, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(resolver.Close)
+
+	return resolver, path
+}
+
+func fileHosts(t *testing.T, resolver *FileServiceResolver, function string) []string {
+	candidates, err := resolver.ResolveAll(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		result = append(result, c.Host)
+	}
+	return result
+}
+
+func TestFileResolverReadsYaml(t *testing.T) {
+	resolver, _ := setupFileResolver(t, "functions.yaml", `
+echo:
+  - http://127.0.0.1:8081
+  - url: http://10.0.0.1:8080
+    node: node-1
+    datacenter: dc2
+    meta:
+      zone: b
+`)
+
+	assert.Equal(t, []string{"127.0.0.1:8081", "10.0.0.1:8080"}, fileHosts(t, resolver, "echo"))
+	assert.Equal(t, []string{"127.0.0.1:8081", "10.0.0.1:8080"}, fileHosts(t, resolver, "echo.default"))
+	assert.Empty(t, fileHosts(t, resolver, "figlet"))
+
+	endpoints, _ := resolver.ResolveEndpoints("echo")
+	assert.Equal(t, "node-1", endpoints[1].Node)
+	assert.Equal(t, "dc2", endpoints[1].Datacenter)
+	assert.Equal(t, "b", endpoints[1].NodeMeta["zone"])
+
+	_, err := resolver.Resolve("figlet")
+	assert.Error(t, err)
+}
+
+func TestFileResolverReadsJson(t *testing.T) {
+	resolver, _ := setupFileResolver(t, "functions.json", `{"echo": ["http://127.0.0.1:8081"], "env": [{"url": "http://127.0.0.1:8082"}]}`)
+
+	assert.Equal(t, []string{"127.0.0.1:8081"}, fileHosts(t, resolver, "echo"))
+	assert.Equal(t, []string{"127.0.0.1:8082"}, fileHosts(t, resolver, "env"))
+}
+
+func TestFileResolverReportsInvalidFile(t *testing.T) {
+	config, _ := types.DefaultConfig()
+
+	config.Discovery.File = filepath.Join(t.TempDir(), "missing.yaml")
+	_, err := NewFileResolver(config, hclog.NewNullLogger())
+	assert.Error(t, err)
+
+	config.Discovery.File = filepath.Join(t.TempDir(), "functions.yaml")
+	ioutil.WriteFile(config.Discovery.File, []byte("echo:\n  - 127.0.0.1:8081\n"), 0600)
+	_, err = NewFileResolver(config, hclog.NewNullLogger())
+	assert.Error(t, err)
+}
+
+func TestFileResolverReloadsChangedFile(t *testing.T) {
+	resolver, path := setupFileResolver(t, "functions.yaml", "echo:\n  - http://127.0.0.1:8081\n")
+
+	ioutil.WriteFile(path, []byte("echo:\n  - http://127.0.0.1:8082\n"), 0600)
+
+	assert.Eventually(t, func() bool {
+		hosts := fileHosts(t, resolver, "echo")
+		return len(hosts) == 1 && hosts[0] == "127.0.0.1:8082"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the file is replaced, as done by most editors
+	tmp := path + ".tmp"
+	ioutil.WriteFile(tmp, []byte("echo:\n  - http://127.0.0.1:8083\nenv:\n  - http://127.0.0.1:8084\n"), 0600)
+	os.Rename(tmp, path)
+
+	assert.Eventually(t, func() bool {
+		return len(fileHosts(t, resolver, "env")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"127.0.0.1:8083"}, fileHosts(t, resolver, "echo"))
+}
+
+func TestFileResolverKeepsEndpointsOfInvalidFile(t *testing.T) {
+	resolver, path := setupFileResolver(t, "functions.yaml", "echo:\n  - http://127.0.0.1:8081\n")
+
+	ioutil.WriteFile(path, []byte("echo: [\n"), 0600)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, []string{"127.0.0.1:8081"}, fileHosts(t, resolver, "echo"))
+}
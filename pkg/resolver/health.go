@@ -0,0 +1,136 @@
+package resolver
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/dependency"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	healthStatusAnnotation   = "com.openfaas.consul.health.status"
+	healthTagsAnnotation     = "com.openfaas.consul.health.tags"
+	healthNodeMetaAnnotation = "com.openfaas.consul.health.node_meta"
+)
+
+// Annotations returns the annotations of a function, used for its health filter.
+type Annotations func(functionName string) (map[string]string, error)
+
+// healthFilter selects the instances of a function by the status of their checks, and optionally by their
+// tags and node metadata.
+type healthFilter struct {
+	status   string
+	tags     []string
+	nodeMeta map[string]string
+}
+
+func newHealthFilter(config types.ConsulConfig) healthFilter {
+	return healthFilter{
+		status:   config.HealthStatus,
+		tags:     config.HealthTags,
+		nodeMeta: config.HealthNodeMeta,
+	}
+}
+
+// withAnnotations returns the filter overridden by the annotations of a function. An unsupported status is
+// ignored, the error being returned with the filter.
+func (h healthFilter) withAnnotations(annotations map[string]string) (healthFilter, error) {
+	var err error
+	if value, ok := annotations[healthStatusAnnotation]; ok {
+		if err = types.ValidateHealthStatus(value); err == nil {
+			h.status = value
+		}
+	}
+	if value, ok := annotations[healthTagsAnnotation]; ok {
+		h.tags = types.ParseListValue(value)
+	}
+	if value, ok := annotations[healthNodeMetaAnnotation]; ok {
+		h.nodeMeta = types.ParseMapValue(value)
+	}
+	return h, err
+}
+
+// query creates the health query of a service in the given datacenter, or the local one when empty.
+// The status is filtered by Consul.
+func (h healthFilter) query(service string, datacenter string) (*dependency.HealthServiceQuery, error) {
+	if datacenter != "" {
+		service = service + "@" + datacenter
+	}
+
+	switch h.status {
+	case types.HealthIgnore:
+		return dependency.NewHealthServiceQuery(service + "|" + dependency.HealthAny)
+	case types.HealthWarning:
+		return dependency.NewHealthServiceQuery(service + "|" + dependency.HealthPassing + "," + dependency.HealthWarning)
+	default:
+		return dependency.NewHealthServiceQuery(service + "|" + dependency.HealthPassing)
+	}
+}
+
+// acceptsStatus reports whether the aggregated status of the checks of an instance is accepted, for the
+// results not filtered by Consul.
+func (h healthFilter) acceptsStatus(status string) bool {
+	switch h.status {
+	case types.HealthIgnore:
+		return true
+	case types.HealthWarning:
+		return status == dependency.HealthPassing || status == dependency.HealthWarning
+	default:
+		return status == dependency.HealthPassing
+	}
+}
+
+// String identifies the filter, e.g. to cache the instances selected by the filter.
+func (h healthFilter) String() string {
+	return fmt.Sprintf("%s|%v|%v", h.status, h.tags, h.nodeMeta)
+}
+
+// selective reports whether the filter restricts the instances beyond their status.
+func (h healthFilter) selective() bool {
+	return len(h.tags) != 0 || len(h.nodeMeta) != 0
+}
+
+func (h healthFilter) accepts(i instance) bool {
+	for _, tag := range h.tags {
+		if !contains(i.tags, tag) {
+			return false
+		}
+	}
+	for k, v := range h.nodeMeta {
+		if value, ok := i.endpoint.NodeMeta[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the endpoints of the accepted instances, or all of them without a copy when the filter
+// doesn't restrict them beyond their status.
+func (h healthFilter) apply(instances []instance, all []Endpoint) []Endpoint {
+	if !h.selective() {
+		return all
+	}
+
+	endpoints := make([]Endpoint, 0, len(instances))
+	for _, i := range instances {
+		if h.accepts(i) {
+			endpoints = append(endpoints, i.endpoint)
+		}
+	}
+	return endpoints
+}
+
+// instance is a healthy instance of a service, with its tags.
+type instance struct {
+	endpoint Endpoint
+	tags     []string
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,379 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+// nomadServiceRegistration is a service instance registered with the Nomad native service discovery.
+// The vendored Nomad API predates the service registration endpoints, which are queried with the raw API.
+type nomadServiceRegistration struct {
+	ID          string
+	ServiceName string
+	Namespace   string
+	NodeID      string
+	Datacenter  string
+	JobID       string
+	AllocID     string
+	Tags        []string
+	Address     string
+	Port        int
+}
+
+// NomadServiceResolver resolves the instances of the functions registered with the Nomad native service
+// discovery, i.e. with services using `provider = "nomad"`.
+//
+// Like the ConsulServiceResolver, every service is watched with a blocking query once it is resolved or
+// deployed, and the watch is removed when the function is deleted or hasn't been resolved during the watch TTL.
+type NomadServiceResolver struct {
+	client     *api.Client
+	prefix     string
+	namespace  string
+	ttl        time.Duration
+	maxBackoff time.Duration
+	waitTime   time.Duration
+	now        func() time.Time
+	local      Endpoint
+	logger     hclog.Logger
+
+	// the metadata of the nodes, by node ID
+	nodes sync.Map
+
+	// the watched services, by name
+	mu       sync.RWMutex
+	services map[string]*nomadService
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type nomadService struct {
+	usage
+	name      string
+	endpoints []Endpoint
+	ready     bool
+	stop      chan struct{}
+}
+
+func NewNomadResolver(config *types.ProviderConfig, logger hclog.Logger) (*NomadServiceResolver, error) {
+	c := api.DefaultConfig()
+	c.Address = config.Nomad.Addr
+	c.SecretID = config.Nomad.ACLToken
+	c.TLSConfig.CACert = config.Nomad.CACert
+	c.TLSConfig.ClientCert = config.Nomad.ClientCert
+	c.TLSConfig.ClientKey = config.Nomad.ClientKey
+	c.TLSConfig.Insecure = config.Nomad.TLSSkipVerify
+
+	client, err := api.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &NomadServiceResolver{
+		client:     client,
+		prefix:     config.Scheduling.JobPrefix,
+		namespace:  config.Scheduling.Namespace,
+		ttl:        config.Discovery.WatchTTL,
+		maxBackoff: config.Discovery.WatchMaxBackoff,
+		waitTime:   5 * time.Minute,
+		now:        time.Now,
+		logger:     logger.Named("nomad_resolver"),
+		services:   map[string]*nomadService{},
+		stop:       make(chan struct{}),
+	}
+
+	resolver.local, err = resolver.localNode()
+	if err != nil {
+		logger.Warn("Unable to read the datacenter and metadata of the local Nomad agent", "error", err.Error())
+	}
+
+	go expireEvery(resolver.ttl, resolver.stop, resolver.expireIdle)
+
+	return resolver, nil
+}
+
+// Close stops all the watches.
+func (nr *NomadServiceResolver) Close() {
+	nr.stopOnce.Do(func() {
+		close(nr.stop)
+
+		nr.mu.Lock()
+		defer nr.mu.Unlock()
+		for name := range nr.services {
+			nr.remove(name)
+		}
+	})
+}
+
+func (nr *NomadServiceResolver) Resolve(function string) (url.URL, error) {
+	candidates, err := nr.ResolveAll(function)
+	if err != nil {
+		return url.URL{}, err
+	}
+	return balance(candidates)
+}
+
+func (nr *NomadServiceResolver) ResolveAll(function string) ([]url.URL, error) {
+	endpoints, err := nr.ResolveEndpoints(function)
+	if err != nil {
+		return nil, err
+	}
+	return urls(endpoints), nil
+}
+
+func (nr *NomadServiceResolver) ResolveEndpoints(function string) ([]Endpoint, error) {
+	name := nr.serviceName(function)
+
+	nr.mu.RLock()
+	svc, ok := nr.services[name]
+	if ok && svc.ready {
+		svc.touch(nr.now())
+		endpoints := svc.endpoints
+		nr.mu.RUnlock()
+		return endpoints, nil
+	}
+	nr.mu.RUnlock()
+
+	// the first resolution doesn't wait for the watch, the service is fetched once
+	registrations, meta, err := nr.fetch(name, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := nr.endpoints(registrations)
+
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+
+	svc = nr.add(name, meta.LastIndex)
+	if !svc.ready {
+		svc.endpoints = endpoints
+		svc.ready = true
+	}
+	svc.touch(nr.now())
+
+	return svc.endpoints, nil
+}
+
+// Local returns the node, datacenter and metadata of the Nomad agent used by the provider.
+func (nr *NomadServiceResolver) Local() Endpoint {
+	return nr.local
+}
+
+// Watch starts watching the service of a function, so its instances are known before it is first resolved.
+func (nr *NomadServiceResolver) Watch(function string) {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+
+	nr.add(nr.serviceName(function), 0).touch(nr.now())
+}
+
+// Unwatch stops watching the service of a function and forgets its instances.
+func (nr *NomadServiceResolver) Unwatch(function string) {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+
+	nr.remove(nr.serviceName(function))
+}
+
+// Watching returns the names of the watched services.
+func (nr *NomadServiceResolver) Watching() []string {
+	nr.mu.RLock()
+	defer nr.mu.RUnlock()
+
+	names := make([]string, 0, len(nr.services))
+	for name := range nr.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (nr *NomadServiceResolver) serviceName(function string) string {
+	return fmt.Sprintf("%s%s", nr.prefix, strings.TrimSuffix(function, "."+nr.namespace))
+}
+
+// add starts watching a service from the given index, if it isn't watched yet. The lock must be held.
+func (nr *NomadServiceResolver) add(name string, index uint64) *nomadService {
+	if svc, ok := nr.services[name]; ok {
+		return svc
+	}
+
+	svc := &nomadService{name: name, stop: make(chan struct{})}
+	nr.services[name] = svc
+
+	go nr.watch(svc, index)
+
+	return svc
+}
+
+// remove stops watching a service. The lock must be held.
+func (nr *NomadServiceResolver) remove(name string) {
+	if svc, ok := nr.services[name]; ok {
+		close(svc.stop)
+		delete(nr.services, name)
+	}
+}
+
+// watch follows the registrations of a service with blocking queries, until the watch is removed.
+func (nr *NomadServiceResolver) watch(svc *nomadService, index uint64) {
+	retries := 0
+
+	for {
+		select {
+		case <-svc.stop:
+			return
+		default:
+		}
+
+		registrations, meta, err := nr.fetch(svc.name, index, svc.stop)
+		if err != nil {
+			select {
+			case <-svc.stop:
+				return
+			default:
+			}
+
+			nr.logger.Warn("Error watching function service", "service", svc.name, "error", err.Error())
+
+			select {
+			case <-time.After(backoff(retries, nr.maxBackoff)):
+				retries++
+				continue
+			case <-svc.stop:
+				return
+			}
+		}
+		retries = 0
+
+		// the index can go backwards, e.g. after a snapshot restore, the watch continues from the new index then
+		changed := meta.LastIndex != index
+		index = meta.LastIndex
+		if index < 1 {
+			index = 1
+		}
+		if !changed {
+			continue
+		}
+
+		endpoints := nr.endpoints(registrations)
+
+		nr.mu.Lock()
+		// data of removed watches is ignored, so a deleted function isn't resolved again from a late response
+		if nr.services[svc.name] == svc {
+			svc.endpoints = endpoints
+			svc.ready = true
+		}
+		nr.mu.Unlock()
+	}
+}
+
+// fetch reads the registrations of a service, blocking until they change when an index is given.
+// The query is cancelled when stop is closed.
+func (nr *NomadServiceResolver) fetch(name string, index uint64, stop <-chan struct{}) ([]*nomadServiceRegistration, *api.QueryMeta, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	q := (&api.QueryOptions{
+		Namespace:  nr.namespace,
+		AllowStale: true,
+		WaitIndex:  index,
+		WaitTime:   nr.waitTime,
+	}).WithContext(ctx)
+
+	var registrations []*nomadServiceRegistration
+	meta, err := nr.client.Raw().Query("/v1/service/"+url.PathEscape(name), &registrations, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return registrations, meta, nil
+}
+
+func (nr *NomadServiceResolver) endpoints(registrations []*nomadServiceRegistration) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(registrations))
+
+	for _, r := range registrations {
+		endpoints = append(endpoints, Endpoint{
+			URL:        toUrl(r.Address, r.Port),
+			Node:       r.NodeID,
+			Datacenter: r.Datacenter,
+			NodeMeta:   nr.nodeMeta(r.NodeID),
+		})
+	}
+
+	return endpoints
+}
+
+// nodeMeta returns the metadata of a node, which is read once per node.
+func (nr *NomadServiceResolver) nodeMeta(nodeID string) map[string]string {
+	if meta, ok := nr.nodes.Load(nodeID); ok {
+		return meta.(map[string]string)
+	}
+
+	node, _, err := nr.client.Nodes().Info(nodeID, &api.QueryOptions{AllowStale: true})
+	if err != nil {
+		nr.logger.Debug("Unable to read the metadata of node", "node", nodeID, "error", err.Error())
+		return nil
+	}
+
+	meta := node.Meta
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	nr.nodes.Store(nodeID, meta)
+	return meta
+}
+
+// localNode reads the name, datacenter and metadata of the Nomad agent.
+func (nr *NomadServiceResolver) localNode() (Endpoint, error) {
+	self, err := nr.client.Agent().Self()
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	local := Endpoint{Node: self.Member.Name, NodeMeta: map[string]string{}}
+	local.Datacenter, _ = self.Config["Datacenter"].(string)
+
+	if client, ok := self.Config["Client"].(map[string]interface{}); ok {
+		if meta, ok := client["Meta"].(map[string]interface{}); ok {
+			for k, v := range meta {
+				if value, ok := v.(string); ok {
+					local.NodeMeta[k] = value
+				}
+			}
+		}
+	}
+
+	return local, nil
+}
+
+func (nr *NomadServiceResolver) expireIdle() {
+	now := nr.now()
+
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+
+	for name, svc := range nr.services {
+		if svc.idle(now, nr.ttl) {
+			nr.logger.Debug("Removing idle watch", "service", name)
+			nr.remove(name)
+		}
+	}
+}
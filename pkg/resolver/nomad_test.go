@@ -0,0 +1,284 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNomad serves the agent, node and service registration endpoints used by the resolver, with support
+// for blocking queries.
+type fakeNomad struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	index     uint64
+	instances map[string][]string
+	queries   map[string]int
+	changed   chan struct{}
+	done      chan struct{}
+}
+
+func newFakeNomad() *fakeNomad {
+	f := &fakeNomad{
+		index:     1,
+		instances: map[string][]string{},
+		queries:   map[string]int{},
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeNomad) Close() {
+	close(f.done)
+	f.server.Close()
+}
+
+// set replaces the addresses of the instances of a service, and wakes up the blocking queries.
+func (f *fakeNomad) set(service string, addresses ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.instances[service] = addresses
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeNomad) queriesFor(service string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[service]
+}
+
+func (f *fakeNomad) write(w http.ResponseWriter, index uint64, body interface{}) {
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Nomad-LastContact", "0")
+	w.Header().Set("X-Nomad-KnownLeader", "true")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeNomad) handle(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/agent/self":
+		f.write(w, 1, map[string]interface{}{
+			"config": map[string]interface{}{
+				"Datacenter": "dc1",
+				"Client":     map[string]interface{}{"Meta": map[string]interface{}{"zone": "a"}},
+			},
+			"member": map[string]interface{}{"Name": "server-1"},
+		})
+		return
+	case strings.HasPrefix(r.URL.Path, "/v1/node/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/node/")
+		f.write(w, 1, map[string]interface{}{"ID": id, "Meta": map[string]string{"zone": "zone-" + id}})
+		return
+	case !strings.HasPrefix(r.URL.Path, "/v1/service/"):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	service := strings.TrimPrefix(r.URL.Path, "/v1/service/")
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	f.mu.Lock()
+	f.queries[service]++
+	current, changed := f.index, f.changed
+	f.mu.Unlock()
+
+	if index >= current {
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+			return
+		case <-f.done:
+			return
+		}
+	}
+
+	f.mu.Lock()
+	current = f.index
+	addresses := f.instances[service]
+	f.mu.Unlock()
+
+	registrations := make([]interface{}, 0, len(addresses))
+	for i, address := range addresses {
+		registrations = append(registrations, map[string]interface{}{
+			"ID":          fmt.Sprintf("_nomad-task-%s-%d", service, i),
+			"ServiceName": service,
+			"Namespace":   r.URL.Query().Get("namespace"),
+			"NodeID":      fmt.Sprintf("node-%d", i),
+			"Datacenter":  "dc1",
+			"Address":     address,
+			"Port":        8080,
+		})
+	}
+
+	f.write(w, current, registrations)
+}
+
+func setupNomadResolver(t *testing.T) (*NomadServiceResolver, *fakeNomad, *clock) {
+	nomad := newFakeNomad()
+
+	config, _ := types.DefaultConfig()
+	config.Nomad.Addr = nomad.server.URL
+	config.Discovery.Provider = types.DiscoveryNomad
+	config.Discovery.WatchTTL = time.Hour
+	config.Discovery.WatchMaxBackoff = 100 * time.Millisecond
+
+	resolver, err := NewNomadResolver(config, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &clock{now: time.Now()}
+	resolver.now = c.Now
+
+	t.Cleanup(func() {
+		resolver.Close()
+		nomad.Close()
+	})
+
+	return resolver, nomad, c
+}
+
+func nomadHosts(t *testing.T, resolver *NomadServiceResolver, function string) []string {
+	candidates, err := resolver.ResolveAll(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		result = append(result, c.Host)
+	}
+	return result
+}
+
+func TestNomadResolverReadsLocalAgent(t *testing.T) {
+	resolver, _, _ := setupNomadResolver(t)
+
+	assert.Equal(t, "dc1", resolver.Local().Datacenter)
+	assert.Equal(t, "server-1", resolver.Local().Node)
+	assert.Equal(t, "a", resolver.Local().NodeMeta["zone"])
+}
+
+func TestNomadResolverUpdatesResolvedServicesFromWatch(t *testing.T) {
+	resolver, nomad, _ := setupNomadResolver(t)
+	nomad.set("faas-fn-echo", "10.0.0.1")
+
+	assert.Equal(t, []string{"10.0.0.1:8080"}, nomadHosts(t, resolver, "echo.default"))
+	assert.Equal(t, []string{"faas-fn-echo"}, resolver.Watching())
+
+	endpoints, _ := resolver.ResolveEndpoints("echo")
+	assert.Equal(t, "dc1", endpoints[0].Datacenter)
+	assert.Equal(t, "node-0", endpoints[0].Node)
+	assert.Equal(t, "zone-node-0", endpoints[0].NodeMeta["zone"])
+
+	nomad.set("faas-fn-echo", "10.0.0.1", "10.0.0.2")
+
+	assert.Eventually(t, func() bool {
+		return len(nomadHosts(t, resolver, "echo")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNomadResolverWatchesDeployedFunctions(t *testing.T) {
+	resolver, nomad, _ := setupNomadResolver(t)
+	nomad.set("faas-fn-echo", "10.0.0.1")
+
+	resolver.Watch("echo")
+
+	assert.Eventually(t, func() bool {
+		resolver.mu.RLock()
+		defer resolver.mu.RUnlock()
+		return resolver.services["faas-fn-echo"].ready
+	}, 5*time.Second, 10*time.Millisecond)
+
+	queries := nomad.queriesFor("faas-fn-echo")
+	assert.Equal(t, []string{"10.0.0.1:8080"}, nomadHosts(t, resolver, "echo"))
+	assert.Equal(t, queries, nomad.queriesFor("faas-fn-echo"))
+}
+
+func TestNomadResolverUnwatchesDeletedFunctions(t *testing.T) {
+	resolver, nomad, _ := setupNomadResolver(t)
+	nomad.set("faas-fn-echo", "10.0.0.1")
+
+	assert.Equal(t, []string{"10.0.0.1:8080"}, nomadHosts(t, resolver, "echo"))
+
+	resolver.Unwatch("echo")
+	assert.Empty(t, resolver.Watching())
+
+	nomad.set("faas-fn-echo")
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, resolver.Watching())
+}
+
+func TestNomadResolverExpiresIdleWatches(t *testing.T) {
+	resolver, nomad, c := setupNomadResolver(t)
+	nomad.set("faas-fn-echo", "10.0.0.1")
+
+	nomadHosts(t, resolver, "echo")
+	resolver.Watch("env")
+
+	c.Advance(40 * time.Minute)
+	nomadHosts(t, resolver, "echo")
+
+	c.Advance(40 * time.Minute)
+	resolver.expireIdle()
+
+	assert.Equal(t, []string{"faas-fn-echo"}, resolver.Watching())
+}
+
+func TestNomadResolverIsSafeForConcurrentUse(t *testing.T) {
+	resolver, nomad, c := setupNomadResolver(t)
+
+	functions := []string{"fn-a", "fn-b", "fn-c"}
+	for _, fn := range functions {
+		nomad.set("faas-fn-"+fn, "10.0.0.1")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				fn := functions[(i+j)%len(functions)]
+				switch j % 5 {
+				case 0:
+					resolver.Watch(fn)
+				case 1:
+					resolver.Unwatch(fn)
+				case 2:
+					nomad.set("faas-fn-"+fn, "10.0.0.1", fmt.Sprintf("10.0.1.%d", j))
+				case 3:
+					c.Advance(time.Minute)
+					resolver.expireIdle()
+				default:
+					if _, err := resolver.ResolveEndpoints(fn); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, fn := range functions {
+		assert.NotEmpty(t, nomadHosts(t, resolver, fn))
+	}
+	assert.Len(t, resolver.Watching(), len(functions))
+}
@@ -2,37 +2,96 @@ package resolver
 
 import (
 	"fmt"
-	"github.com/hashicorp/consul-template/dependency"
-	"github.com/hashicorp/consul-template/watch"
-	"github.com/hashicorp/go-hclog"
-	"github.com/jsiebens/faas-nomad/pkg/types"
 	"math/rand"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/watch"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
 )
 
 type ServiceResolver interface {
 	Resolve(functionName string) (url.URL, error)
 	ResolveAll(functionName string) ([]url.URL, error)
+	ResolveEndpoints(functionName string) ([]Endpoint, error)
+
+	// Watch starts watching the instances of a function, e.g. when it is deployed.
+	Watch(functionName string)
+	// Unwatch stops watching the instances of a function, e.g. when it is deleted.
+	Unwatch(functionName string)
+}
+
+// Endpoint is an instance of a function, with the location of the node running it.
+type Endpoint struct {
+	URL  url.URL
+	Node string
+	// Datacenter is the datacenter of the instance, its Nomad datacenter when it is known
+	Datacenter string
+	// ConsulDatacenter is the Consul datacenter the instance was resolved in, e.g. a failover datacenter
+	ConsulDatacenter string
+	NodeMeta         map[string]string
 }
 
+// ConsulServiceResolver resolves the instances of the functions with the health of their Consul services.
+//
+// Every service is watched with a blocking query once it is resolved or deployed, and the watch is removed
+// when the function is deleted or hasn't been resolved during the watch TTL.
+//
+// The instances are filtered by the health filter of the provider, which can be overridden by the annotations
+// of the functions.
 type ConsulServiceResolver struct {
-	clientSet *dependency.ClientSet
-	watcher   *watch.Watcher
-	cache     sync.Map
-	prefix    string
-	namespace string
-	logger    hclog.Logger
+	clientSet   *dependency.ClientSet
+	watcher     *watch.Watcher
+	prefix      string
+	namespace   string
+	ttl         time.Duration
+	now         func() time.Time
+	local       Endpoint
+	health      healthFilter
+	annotations Annotations
+	failover    *failover
+	logger      hclog.Logger
+
+	// the watched services, by health query
+	mu       sync.RWMutex
+	services map[string]*serviceItem
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type serviceItem struct {
+	usage
+	service      string
 	serviceQuery dependency.Dependency
-	addresses    []url.URL
+	instances    []instance
+	endpoints    []Endpoint
+	ready        bool
+}
+
+// usage records when a watched service was last resolved.
+type usage struct {
+	// unix time in nanoseconds, updated atomically
+	lastUsed int64
 }
 
-func NewConsulResolver(config *types.ProviderConfig, logger hclog.Logger) (ServiceResolver, error) {
+func (u *usage) touch(now time.Time) {
+	atomic.StoreInt64(&u.lastUsed, now.UnixNano())
+}
+
+func (u *usage) idle(now time.Time, ttl time.Duration) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&u.lastUsed))) > ttl
+}
+
+// NewConsulResolver creates a resolver using the Consul health API. The annotations of the functions are
+// used for their health filter, when given.
+func NewConsulResolver(config *types.ProviderConfig, annotations Annotations, logger hclog.Logger) (*ConsulServiceResolver, error) {
 	clientSet := dependency.NewClientSet()
 	err := clientSet.CreateConsulClient(&dependency.CreateConsulClientInput{
 		Address:    config.Consul.Addr,
@@ -48,43 +107,72 @@ func NewConsulResolver(config *types.ProviderConfig, logger hclog.Logger) (Servi
 		return nil, err
 	}
 
-	watcher, _ := watch.NewWatcher(&watch.NewWatcherInput{
-		Clients:  clientSet,
-		MaxStale: 10000 * time.Millisecond,
+	watcher, err := watch.NewWatcher(&watch.NewWatcherInput{
+		Clients:         clientSet,
+		MaxStale:        10000 * time.Millisecond,
+		RetryFuncConsul: retryWithBackoff(config.Discovery.WatchMaxBackoff),
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	resolver := &ConsulServiceResolver{
-		clientSet: clientSet,
-		watcher:   watcher,
-		prefix:    config.Scheduling.JobPrefix,
-		namespace: config.Scheduling.Namespace,
-		logger:    logger,
+		clientSet:   clientSet,
+		watcher:     watcher,
+		prefix:      config.Scheduling.JobPrefix,
+		namespace:   config.Scheduling.Namespace,
+		ttl:         config.Discovery.WatchTTL,
+		now:         time.Now,
+		health:      newHealthFilter(config.Consul),
+		annotations: annotations,
+		failover:    newFailover(config.Consul),
+		logger:      logger.Named("consul_resolver"),
+		services:    map[string]*serviceItem{},
+		stop:        make(chan struct{}),
+	}
+
+	resolver.local, err = localNode(clientSet)
+	if err != nil {
+		logger.Warn("Unable to read the datacenter and metadata of the local Consul agent", "error", err.Error())
 	}
 
 	go resolver.watch()
-	go resolver.reset()
+	go resolver.expire()
 
 	return resolver, nil
 }
 
-func (cr *ConsulServiceResolver) reset() {
-	ticker := time.NewTicker(time.Duration(30) * time.Minute)
-
-	for range ticker.C {
+// Close stops all the watches.
+func (cr *ConsulServiceResolver) Close() {
+	cr.stopOnce.Do(func() {
+		close(cr.stop)
 		cr.watcher.Stop()
+	})
+}
 
-		watcher, _ := watch.NewWatcher(&watch.NewWatcherInput{
-			Clients:  cr.clientSet,
-			MaxStale: 10000 * time.Millisecond,
-		})
+func (cr *ConsulServiceResolver) ResolveAll(function string) ([]url.URL, error) {
+	endpoints, err := cr.ResolveEndpoints(function)
+	if err != nil {
+		return nil, err
+	}
+	return urls(endpoints), nil
+}
 
-		cr.cache = sync.Map{}
-		cr.watcher = watcher
+// ResolveEndpoints resolves the instances of a function in the local datacenter, or in the failover datacenters
+// when none is available locally. The datacenter of the instances is reported in their endpoints.
+func (cr *ConsulServiceResolver) ResolveEndpoints(function string) ([]Endpoint, error) {
+	service, filter := cr.serviceName(function), cr.filterOf(function)
+
+	endpoints, err := cr.resolveInternal(service, filter)
+	if err != nil || len(endpoints) != 0 || !cr.failover.enabled() {
+		return endpoints, err
 	}
+	return cr.resolveFailover(service, filter)
 }
 
-func (cr *ConsulServiceResolver) ResolveAll(function string) ([]url.URL, error) {
-	return cr.resolveInternal(fmt.Sprintf("%s%s", cr.prefix, strings.TrimSuffix(function, "."+cr.namespace)))
+// Local returns the node, datacenter and metadata of the Consul agent used by the provider.
+func (cr *ConsulServiceResolver) Local() Endpoint {
+	return cr.local
 }
 
 func (cr *ConsulServiceResolver) Resolve(function string) (url.URL, error) {
@@ -95,52 +183,291 @@ func (cr *ConsulServiceResolver) Resolve(function string) (url.URL, error) {
 	return balance(candidates)
 }
 
-func (cr *ConsulServiceResolver) resolveInternal(service string) ([]url.URL, error) {
-	query, err := dependency.NewHealthServiceQuery(service)
+// Watch starts watching the service of a function, so its instances are known before it is first resolved.
+func (cr *ConsulServiceResolver) Watch(function string) {
+	service := cr.serviceName(function)
+
+	query, err := cr.filterOf(function).query(service, "")
+	if err != nil {
+		cr.logger.Warn("Unable to watch function service", "service", service, "error", err.Error())
+		return
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.add(service, query).touch(cr.now())
+}
+
+// Unwatch stops watching the service of a function and forgets its instances, whatever their health filter.
+func (cr *ConsulServiceResolver) Unwatch(function string) {
+	service := cr.serviceName(function)
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for key, item := range cr.services {
+		if item.service == service {
+			cr.remove(key)
+		}
+	}
+	cr.failover.forget(service)
+}
+
+// Watching returns the names of the watched services.
+func (cr *ConsulServiceResolver) Watching() []string {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	names := make([]string, 0, len(cr.services))
+	for _, item := range cr.services {
+		names = append(names, item.service)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (cr *ConsulServiceResolver) serviceName(function string) string {
+	return fmt.Sprintf("%s%s", cr.prefix, strings.TrimSuffix(function, "."+cr.namespace))
+}
+
+// filterOf returns the health filter of a function, i.e. the one of the provider overridden by the
+// annotations of the function.
+func (cr *ConsulServiceResolver) filterOf(function string) healthFilter {
+	if cr.annotations == nil {
+		return cr.health
+	}
+
+	annotations, err := cr.annotations(function)
+	if err != nil {
+		cr.logger.Debug("Unable to read the health filter of function", "function", function, "error", err.Error())
+		return cr.health
+	}
+
+	filter, err := cr.health.withAnnotations(annotations)
+	if err != nil {
+		cr.logger.Warn("Ignoring the health status of function", "function", function, "error", err.Error())
+	}
+	return filter
+}
+
+// resolveInternal resolves the instances of a service with the given status, which are watched by status,
+// the tags and node metadata being filtered for every resolution.
+func (cr *ConsulServiceResolver) resolveInternal(service string, filter healthFilter) ([]Endpoint, error) {
+	query, err := filter.query(service, "")
 	if err != nil {
 		return nil, err
 	}
 
-	if val, ok := cr.cache.Load(query.String()); ok {
-		return val.(*serviceItem).addresses, nil
+	cr.mu.RLock()
+	item, ok := cr.services[query.String()]
+	if ok && item.ready {
+		item.touch(cr.now())
+		instances, endpoints := item.instances, item.endpoints
+		cr.mu.RUnlock()
+		return filter.apply(instances, endpoints), nil
 	}
+	cr.mu.RUnlock()
 
+	// the first resolution doesn't wait for the watch, the service is fetched once
 	fetch, _, err := query.Fetch(cr.clientSet, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	services := fetch.([]*dependency.HealthService)
-	item := cr.updateCatalog(query, services)
+	instances := instances(fetch.([]*dependency.HealthService), cr.local.Datacenter)
 
-	_, _ = cr.watcher.Add(query)
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
 
-	return item.addresses, nil
+	item = cr.add(service, query)
+	if !item.ready {
+		item.instances = instances
+		item.endpoints = endpoints(instances)
+		item.ready = true
+	}
+	item.touch(cr.now())
+
+	return filter.apply(item.instances, item.endpoints), nil
 }
 
-func (cr *ConsulServiceResolver) updateCatalog(dep dependency.Dependency, services []*dependency.HealthService) *serviceItem {
-	addresses := make([]url.URL, 0)
+// instances converts the services returned by Consul for a datacenter, which are already filtered by status.
+// The datacenter of an instance is its Nomad datacenter, or the Consul datacenter when it isn't registered.
+func instances(services []*dependency.HealthService, datacenter string) []instance {
+	instances := make([]instance, 0, len(services))
 
 	for _, s := range services {
-		if len(s.Checks) > 1 {
-			addresses = append(addresses, toUrl(s.Address, s.Port))
-		}
+		instances = append(instances, instance{
+			endpoint: Endpoint{
+				URL:              toUrl(s.Address, s.Port),
+				Node:             s.Node,
+				Datacenter:       datacenterOf(s.ServiceMeta, datacenter),
+				ConsulDatacenter: datacenter,
+				NodeMeta:         s.NodeMeta,
+			},
+			tags: s.Tags,
+		})
+	}
+
+	return instances
+}
+
+// datacenterOf returns the Nomad datacenter registered in the meta of a service, or the given datacenter.
+func datacenterOf(serviceMeta map[string]string, datacenter string) string {
+	if dc := serviceMeta[types.DatacenterMeta]; dc != "" {
+		return dc
+	}
+	return datacenter
+}
+
+func endpoints(instances []instance) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(instances))
+	for _, i := range instances {
+		endpoints = append(endpoints, i.endpoint)
 	}
+	return endpoints
+}
+
+// update stores the instances received by a watch. Data of removed watches is ignored, so a deleted
+// function isn't resolved again from a late response.
+func (cr *ConsulServiceResolver) update(dep dependency.Dependency, services []*dependency.HealthService) {
+	instances := instances(services, cr.local.Datacenter)
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if item, ok := cr.services[dep.String()]; ok {
+		item.instances = instances
+		item.endpoints = endpoints(instances)
+		item.ready = true
+	}
+}
 
-	item := &serviceItem{
-		serviceQuery: dep,
-		addresses:    addresses,
+// add starts watching a service, if it isn't watched yet. The lock must be held.
+func (cr *ConsulServiceResolver) add(service string, query dependency.Dependency) *serviceItem {
+	if item, ok := cr.services[query.String()]; ok {
+		return item
 	}
 
-	cr.cache.Store(dep.String(), item)
+	item := &serviceItem{service: service, serviceQuery: query}
+	cr.services[query.String()] = item
 
+	if _, err := cr.watcher.Add(query); err != nil {
+		cr.logger.Warn("Unable to watch function service", "service", service, "error", err.Error())
+	}
 	return item
 }
 
+// remove stops watching a service. The lock must be held.
+func (cr *ConsulServiceResolver) remove(key string) {
+	if item, ok := cr.services[key]; ok {
+		cr.watcher.Remove(item.serviceQuery)
+		delete(cr.services, key)
+	}
+}
+
 func (cr *ConsulServiceResolver) watch() {
-	for d := range cr.watcher.DataCh() {
-		cr.updateCatalog(d.Dependency(), d.Data().([]*dependency.HealthService))
+	for {
+		select {
+		case v := <-cr.watcher.DataCh():
+			if services, ok := v.Data().([]*dependency.HealthService); ok {
+				cr.update(v.Dependency(), services)
+			}
+		case err := <-cr.watcher.ErrCh():
+			cr.logger.Warn("Error watching function services", "error", err.Error())
+		case <-cr.stop:
+			return
+		}
+	}
+}
+
+// expire removes the watches of the services which haven't been resolved during the watch TTL.
+func (cr *ConsulServiceResolver) expire() {
+	expireEvery(cr.ttl, cr.stop, cr.expireIdle)
+}
+
+func (cr *ConsulServiceResolver) expireIdle() {
+	now := cr.now()
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for key, item := range cr.services {
+		if item.idle(now, cr.ttl) {
+			cr.logger.Debug("Removing idle watch", "service", item.service)
+			cr.remove(key)
+		}
+	}
+}
+
+// expireEvery runs the expiry of the idle watches periodically, until stopped.
+func expireEvery(ttl time.Duration, stop <-chan struct{}, expireIdle func()) {
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expireIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt, doubling from 250ms up to max.
+func backoff(retry int, max time.Duration) time.Duration {
+	sleep := 250 * time.Millisecond
+	for i := 0; i < retry && sleep < max; i++ {
+		sleep *= 2
+	}
+	if sleep > max {
+		sleep = max
+	}
+	return sleep
+}
+
+// retryWithBackoff retries failed watches forever, doubling the delay up to max.
+func retryWithBackoff(max time.Duration) watch.RetryFunc {
+	return func(retry int) (bool, time.Duration) {
+		return true, backoff(retry, max)
+	}
+}
+
+// localNode reads the node name, datacenter and metadata of the Consul agent.
+func localNode(clientSet *dependency.ClientSet) (Endpoint, error) {
+	self, err := clientSet.Consul().Agent().Self()
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	local := Endpoint{NodeMeta: map[string]string{}}
+	if config, ok := self["Config"]; ok {
+		local.Datacenter, _ = config["Datacenter"].(string)
+		local.Node, _ = config["NodeName"].(string)
+	}
+	if meta, ok := self["Meta"]; ok {
+		for k, v := range meta {
+			if value, ok := v.(string); ok {
+				local.NodeMeta[k] = value
+			}
+		}
+	}
+
+	return local, nil
+}
+
+func urls(endpoints []Endpoint) []url.URL {
+	result := make([]url.URL, 0, len(endpoints))
+	for _, e := range endpoints {
+		result = append(result, e.URL)
 	}
+	return result
 }
 
 func balance(candidates []url.URL) (url.URL, error) {
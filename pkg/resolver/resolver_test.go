@@ -0,0 +1,583 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul serves the agent and health endpoints used by the resolver, with support for blocking queries.
+type fakeConsul struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	index     uint64
+	instances map[string][]consulInstance
+	queries   map[string]int
+	changed   chan struct{}
+	done      chan struct{}
+}
+
+// consulInstance is an instance of a service, with the status of its service check.
+type consulInstance struct {
+	address     string
+	status      string
+	tags        []string
+	nodeMeta    map[string]string
+	serviceMeta map[string]string
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		index:     1,
+		instances: map[string][]consulInstance{},
+		queries:   map[string]int{},
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeConsul) Close() {
+	close(f.done)
+	f.server.Close()
+}
+
+// set replaces the addresses of the healthy instances of a service, and wakes up the blocking queries.
+func (f *fakeConsul) set(service string, addresses ...string) {
+	instances := make([]consulInstance, 0, len(addresses))
+	for _, address := range addresses {
+		instances = append(instances, consulInstance{address: address, status: "passing"})
+	}
+	f.setInstances(service, instances...)
+}
+
+// setInstances replaces the instances of a service, and wakes up the blocking queries.
+func (f *fakeConsul) setInstances(service string, instances ...consulInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.instances[service] = instances
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) queriesFor(service string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[service]
+}
+
+func (f *fakeConsul) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/agent/self" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Config": map[string]interface{}{"Datacenter": "dc1", "NodeName": "node-1"},
+			"Meta":   map[string]interface{}{"zone": "a"},
+		})
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v1/query/") {
+		f.executeQuery(w, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/query/"), "/execute"))
+		return
+	}
+
+	service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	if service == r.URL.Path {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the instances of the other datacenters are set with the service@dc key
+	if dc := r.URL.Query().Get("dc"); dc != "" {
+		if dc == "unreachable" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		service = service + "@" + dc
+	}
+
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	f.mu.Lock()
+	f.queries[service]++
+	current, changed := f.index, f.changed
+	f.mu.Unlock()
+
+	if index >= current {
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+			return
+		case <-f.done:
+			return
+		}
+	}
+
+	f.mu.Lock()
+	current = f.index
+	instances := f.instances[service]
+	f.mu.Unlock()
+
+	_, passingOnly := r.URL.Query()["passing"]
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.entries(strings.Split(service, "@")[0], instances, passingOnly))
+}
+
+// executeQuery executes a prepared query, returning the instances set with the service@query:dc key.
+func (f *fakeConsul) executeQuery(w http.ResponseWriter, service string) {
+	f.mu.Lock()
+	f.queries[service+"@query"]++
+	var dc string
+	var instances []consulInstance
+	for key, value := range f.instances {
+		if strings.HasPrefix(key, service+"@query:") {
+			dc, instances = strings.TrimPrefix(key, service+"@query:"), value
+		}
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", "1")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Service":    service,
+		"Datacenter": dc,
+		"Nodes":      f.entries(service, instances, false),
+		"Failovers":  1,
+	})
+}
+
+func (f *fakeConsul) entries(service string, instances []consulInstance, passingOnly bool) []interface{} {
+	entries := make([]interface{}, 0, len(instances))
+	for i, instance := range instances {
+		if passingOnly && instance.status != "passing" && instance.status != "" {
+			continue
+		}
+
+		checks := []interface{}{map[string]interface{}{"CheckID": "serfHealth", "Status": "passing"}}
+		if instance.status != "" {
+			checks = append(checks, map[string]interface{}{"CheckID": "service:" + service, "ServiceName": service, "Status": instance.status})
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"Node": map[string]interface{}{
+				"Node":       fmt.Sprintf("node-%d", i),
+				"Address":    instance.address,
+				"Datacenter": "dc1",
+				"Meta":       instance.nodeMeta,
+			},
+			"Service": map[string]interface{}{
+				"ID":      fmt.Sprintf("%s-%d", service, i),
+				"Service": service,
+				"Address": instance.address,
+				"Port":    8080,
+				"Tags":    instance.tags,
+				"Meta":    instance.serviceMeta,
+			},
+			"Checks": checks,
+		})
+	}
+	return entries
+}
+
+// clock is a manual clock, safe for concurrent use.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func setupConsulResolver(t *testing.T) (*ConsulServiceResolver, *fakeConsul, *clock) {
+	return setupConsulResolverWithConfig(t, nil, func(*types.ProviderConfig) {})
+}
+
+func setupConsulResolverWithConfig(t *testing.T, annotations Annotations, configure func(*types.ProviderConfig)) (*ConsulServiceResolver, *fakeConsul, *clock) {
+	consul := newFakeConsul()
+
+	config, _ := types.DefaultConfig()
+	config.Consul.Addr = consul.server.URL
+	config.Discovery.WatchTTL = time.Hour
+	config.Discovery.WatchMaxBackoff = 100 * time.Millisecond
+	configure(config)
+
+	resolver, err := NewConsulResolver(config, annotations, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &clock{now: time.Now()}
+	resolver.now = c.Now
+
+	t.Cleanup(func() {
+		resolver.Close()
+		consul.Close()
+	})
+
+	return resolver, consul, c
+}
+
+func hosts(t *testing.T, resolver *ConsulServiceResolver, function string) []string {
+	candidates, err := resolver.ResolveAll(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		result = append(result, c.Host)
+	}
+	return result
+}
+
+func TestConsulResolverReadsLocalAgent(t *testing.T) {
+	resolver, _, _ := setupConsulResolver(t)
+
+	assert.Equal(t, "dc1", resolver.Local().Datacenter)
+	assert.Equal(t, "node-1", resolver.Local().Node)
+	assert.Equal(t, "a", resolver.Local().NodeMeta["zone"])
+}
+
+func TestConsulResolverUpdatesResolvedServicesFromWatch(t *testing.T) {
+	resolver, consul, _ := setupConsulResolver(t)
+	consul.set("faas-fn-echo", "10.0.0.1")
+
+	assert.Equal(t, []string{"10.0.0.1:8080"}, hosts(t, resolver, "echo"))
+	assert.Equal(t, []string{"faas-fn-echo"}, resolver.Watching())
+
+	consul.set("faas-fn-echo", "10.0.0.1", "10.0.0.2")
+
+	assert.Eventually(t, func() bool {
+		return len(hosts(t, resolver, "echo")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	endpoints, _ := resolver.ResolveEndpoints("echo")
+	assert.Equal(t, "dc1", endpoints[0].Datacenter)
+}
+
+func TestConsulResolverWatchesDeployedFunctions(t *testing.T) {
+	resolver, consul, _ := setupConsulResolver(t)
+	consul.set("faas-fn-echo", "10.0.0.1")
+
+	resolver.Watch("echo")
+	assert.Equal(t, []string{"faas-fn-echo"}, resolver.Watching())
+
+	// the watch fetches the instances before the function is resolved
+	assert.Eventually(t, func() bool {
+		resolver.mu.RLock()
+		defer resolver.mu.RUnlock()
+		for _, item := range resolver.services {
+			if item.ready {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	queries := consul.queriesFor("faas-fn-echo")
+	assert.Equal(t, []string{"10.0.0.1:8080"}, hosts(t, resolver, "echo"))
+	assert.Equal(t, queries, consul.queriesFor("faas-fn-echo"))
+}
+
+func TestConsulResolverUnwatchesDeletedFunctions(t *testing.T) {
+	resolver, consul, _ := setupConsulResolver(t)
+	consul.set("faas-fn-echo", "10.0.0.1")
+
+	assert.Equal(t, []string{"10.0.0.1:8080"}, hosts(t, resolver, "echo.default"))
+
+	resolver.Unwatch("echo")
+	assert.Empty(t, resolver.Watching())
+
+	// late responses of the removed watch are ignored
+	consul.set("faas-fn-echo")
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, resolver.Watching())
+}
+
+func TestConsulResolverExpiresIdleWatches(t *testing.T) {
+	resolver, consul, c := setupConsulResolver(t)
+	consul.set("faas-fn-echo", "10.0.0.1")
+	consul.set("faas-fn-env", "10.0.0.2")
+
+	hosts(t, resolver, "echo")
+	resolver.Watch("env")
+
+	c.Advance(40 * time.Minute)
+	hosts(t, resolver, "echo")
+
+	c.Advance(40 * time.Minute)
+	resolver.expireIdle()
+
+	assert.Equal(t, []string{"faas-fn-echo"}, resolver.Watching())
+
+	c.Advance(2 * time.Hour)
+	resolver.expireIdle()
+
+	assert.Empty(t, resolver.Watching())
+}
+
+func TestConsulResolverIsSafeForConcurrentUse(t *testing.T) {
+	resolver, consul, c := setupConsulResolver(t)
+
+	functions := []string{"fn-a", "fn-b", "fn-c"}
+	for _, fn := range functions {
+		consul.set("faas-fn-"+fn, "10.0.0.1")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				fn := functions[(i+j)%len(functions)]
+				switch j % 5 {
+				case 0:
+					resolver.Watch(fn)
+				case 1:
+					resolver.Unwatch(fn)
+				case 2:
+					consul.set("faas-fn-"+fn, "10.0.0.1", fmt.Sprintf("10.0.1.%d", j))
+				case 3:
+					c.Advance(time.Minute)
+					resolver.expireIdle()
+				default:
+					if _, err := resolver.ResolveEndpoints(fn); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, fn := range functions {
+		assert.NotEmpty(t, hosts(t, resolver, fn))
+	}
+	assert.Len(t, resolver.Watching(), len(functions))
+}
+
+func setHealthInstances(consul *fakeConsul) {
+	consul.setInstances("faas-fn-echo",
+		consulInstance{address: "10.0.0.1", status: "passing", tags: []string{"blue", "v1"}, nodeMeta: map[string]string{"zone": "a"}},
+		consulInstance{address: "10.0.0.2", status: "warning", tags: []string{"green"}, nodeMeta: map[string]string{"zone": "b"}},
+		consulInstance{address: "10.0.0.3", status: "critical", tags: []string{"blue"}, nodeMeta: map[string]string{"zone": "a"}},
+		// an instance without service check, e.g. when the HTTP check is disabled
+		consulInstance{address: "10.0.0.4", tags: []string{"blue"}, nodeMeta: map[string]string{"zone": "b"}},
+	)
+}
+
+func TestConsulResolverFiltersInstancesByHealthStatus(t *testing.T) {
+	tests := []struct {
+		status   string
+		expected []string
+	}{
+		{types.HealthPassing, []string{"10.0.0.1:8080", "10.0.0.4:8080"}},
+		{types.HealthWarning, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.4:8080"}},
+		{types.HealthIgnore, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			resolver, consul, _ := setupConsulResolverWithConfig(t, nil, func(config *types.ProviderConfig) {
+				config.Consul.HealthStatus = tt.status
+			})
+			setHealthInstances(consul)
+
+			assert.ElementsMatch(t, tt.expected, hosts(t, resolver, "echo"))
+		})
+	}
+}
+
+func TestConsulResolverFiltersInstancesByTagsAndNodeMeta(t *testing.T) {
+	resolver, consul, _ := setupConsulResolverWithConfig(t, nil, func(config *types.ProviderConfig) {
+		config.Consul.HealthStatus = types.HealthIgnore
+		config.Consul.HealthTags = []string{"blue"}
+		config.Consul.HealthNodeMeta = map[string]string{"zone": "a"}
+	})
+	setHealthInstances(consul)
+
+	assert.ElementsMatch(t, []string{"10.0.0.1:8080", "10.0.0.3:8080"}, hosts(t, resolver, "echo"))
+
+	consul.setInstances("faas-fn-echo",
+		consulInstance{address: "10.0.0.1", status: "passing", tags: []string{"green"}, nodeMeta: map[string]string{"zone": "a"}},
+		consulInstance{address: "10.0.0.3", status: "passing", tags: []string{"blue"}, nodeMeta: map[string]string{"zone": "a"}},
+	)
+
+	assert.Eventually(t, func() bool {
+		hosts := hosts(t, resolver, "echo")
+		return len(hosts) == 1 && hosts[0] == "10.0.0.3:8080"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsulResolverOverridesHealthFilterWithAnnotations(t *testing.T) {
+	annotations := func(function string) (map[string]string, error) {
+		switch function {
+		case "echo":
+			return map[string]string{
+				"com.openfaas.consul.health.status":    "warning",
+				"com.openfaas.consul.health.node_meta": "zone=b",
+			}, nil
+		case "env":
+			return map[string]string{"com.openfaas.consul.health.tags": "blue,v1"}, nil
+		default:
+			return nil, fmt.Errorf("not found")
+		}
+	}
+
+	resolver, consul, _ := setupConsulResolverWithConfig(t, annotations, func(config *types.ProviderConfig) {
+		config.Consul.HealthTags = []string{"blue"}
+	})
+	setHealthInstances(consul)
+	consul.setInstances("faas-fn-env",
+		consulInstance{address: "10.0.1.1", status: "passing", tags: []string{"blue", "v1"}},
+		consulInstance{address: "10.0.1.2", status: "passing", tags: []string{"blue"}},
+	)
+	consul.setInstances("faas-fn-figlet",
+		consulInstance{address: "10.0.2.1", status: "passing", tags: []string{"blue"}},
+		consulInstance{address: "10.0.2.2", status: "passing"},
+	)
+
+	// the tags of the provider are cleared by the empty annotation, the status and node metadata are overridden
+	assert.ElementsMatch(t, []string{"10.0.0.4:8080"}, hosts(t, resolver, "echo"))
+	assert.Equal(t, []string{"10.0.1.1:8080"}, hosts(t, resolver, "env"))
+	// the filter of the provider is used when the annotations can't be read
+	assert.Equal(t, []string{"10.0.2.1:8080"}, hosts(t, resolver, "figlet"))
+
+	resolver.Unwatch("echo")
+	assert.Equal(t, []string{"faas-fn-env", "faas-fn-figlet"}, resolver.Watching())
+}
+
+func TestConsulResolverIgnoresUnsupportedHealthStatusAnnotation(t *testing.T) {
+	annotations := func(function string) (map[string]string, error) {
+		return map[string]string{"com.openfaas.consul.health.status": "critical"}, nil
+	}
+
+	resolver, consul, _ := setupConsulResolverWithConfig(t, annotations, func(config *types.ProviderConfig) {
+		config.Consul.HealthStatus = types.HealthWarning
+	})
+	setHealthInstances(consul)
+
+	// the status of the provider applies
+	assert.ElementsMatch(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.4:8080"}, hosts(t, resolver, "echo"))
+}
+
+func TestConsulResolverFailsOverToOtherDatacenters(t *testing.T) {
+	resolver, consul, c := setupConsulResolverWithConfig(t, nil, func(config *types.ProviderConfig) {
+		config.Consul.FailoverDatacenters = []string{"unreachable", "dc2", "dc3"}
+		config.Consul.FailoverTTL = 5 * time.Second
+	})
+	consul.setInstances("faas-fn-echo", consulInstance{address: "10.0.0.1", status: "critical"})
+	consul.set("faas-fn-echo@dc2")
+	consul.set("faas-fn-echo@dc3", "10.0.3.1", "10.0.3.2")
+
+	endpoints, err := resolver.ResolveEndpoints("echo")
+	assert.NoError(t, err)
+	assert.Len(t, endpoints, 2)
+	assert.Equal(t, "dc3", endpoints[0].ConsulDatacenter)
+
+	// the failover instances are kept for the TTL
+	consul.set("faas-fn-echo@dc2", "10.0.2.1")
+	queries := consul.queriesFor("faas-fn-echo@dc2")
+	assert.ElementsMatch(t, []string{"10.0.3.1:8080", "10.0.3.2:8080"}, hosts(t, resolver, "echo"))
+	assert.Equal(t, queries, consul.queriesFor("faas-fn-echo@dc2"))
+
+	c.Advance(10 * time.Second)
+	assert.Equal(t, []string{"10.0.2.1:8080"}, hosts(t, resolver, "echo"))
+
+	// the local instances are preferred again once available
+	consul.set("faas-fn-echo", "10.0.0.1")
+	assert.Eventually(t, func() bool {
+		endpoints, _ := resolver.ResolveEndpoints("echo")
+		return len(endpoints) == 1 && endpoints[0].ConsulDatacenter == "dc1"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsulResolverFailsOverWithPreparedQuery(t *testing.T) {
+	resolver, consul, _ := setupConsulResolverWithConfig(t, nil, func(config *types.ProviderConfig) {
+		config.Consul.FailoverPreparedQuery = true
+		config.Consul.HealthTags = []string{"blue"}
+	})
+	consul.set("faas-fn-echo")
+	consul.setInstances("faas-fn-echo@query:dc2",
+		consulInstance{address: "10.0.2.1", status: "passing", tags: []string{"blue"}},
+		consulInstance{address: "10.0.2.2", status: "passing", tags: []string{"green"}},
+		consulInstance{address: "10.0.2.3", status: "critical", tags: []string{"blue"}},
+	)
+
+	endpoints, err := resolver.ResolveEndpoints("echo")
+	assert.NoError(t, err)
+	assert.Len(t, endpoints, 1)
+	assert.Equal(t, "10.0.2.1:8080", endpoints[0].URL.Host)
+	assert.Equal(t, "dc2", endpoints[0].ConsulDatacenter)
+}
+
+func TestConsulResolverDoesNotFailOverWithLocalInstances(t *testing.T) {
+	resolver, consul, _ := setupConsulResolverWithConfig(t, nil, func(config *types.ProviderConfig) {
+		config.Consul.FailoverDatacenters = []string{"dc2"}
+	})
+	consul.set("faas-fn-echo", "10.0.0.1")
+	consul.set("faas-fn-echo@dc2", "10.0.2.1")
+
+	assert.Equal(t, []string{"10.0.0.1:8080"}, hosts(t, resolver, "echo"))
+	assert.Equal(t, 0, consul.queriesFor("faas-fn-echo@dc2"))
+}
+
+func TestConsulResolverReportsNomadDatacenterOfInstances(t *testing.T) {
+	resolver, consul, _ := setupConsulResolver(t)
+	consul.setInstances("faas-fn-echo",
+		consulInstance{address: "10.0.1.1", status: "passing", serviceMeta: map[string]string{types.DatacenterMeta: "east"}},
+		consulInstance{address: "10.0.2.1", status: "passing", serviceMeta: map[string]string{types.DatacenterMeta: "west"}},
+		consulInstance{address: "10.0.3.1", status: "passing"},
+	)
+
+	endpoints, err := resolver.ResolveEndpoints("echo")
+	assert.NoError(t, err)
+
+	datacenters := map[string]string{}
+	for _, e := range endpoints {
+		datacenters[e.URL.Host] = e.Datacenter
+		assert.Equal(t, "dc1", e.ConsulDatacenter)
+	}
+	assert.Equal(t, map[string]string{"10.0.1.1:8080": "east", "10.0.2.1:8080": "west", "10.0.3.1:8080": "dc1"}, datacenters)
+}
+
+func TestConsulResolverReportsBothDatacentersOfFailoverInstances(t *testing.T) {
+	resolver, consul, _ := setupConsulResolverWithConfig(t, nil, func(config *types.ProviderConfig) {
+		config.Consul.FailoverPreparedQuery = true
+	})
+	consul.set("faas-fn-echo")
+	consul.setInstances("faas-fn-echo@query:dc2",
+		consulInstance{address: "10.0.2.1", status: "passing", serviceMeta: map[string]string{types.DatacenterMeta: "west"}},
+	)
+
+	endpoints, err := resolver.ResolveEndpoints("echo")
+	assert.NoError(t, err)
+	assert.Len(t, endpoints, 1)
+	assert.Equal(t, "west", endpoints[0].Datacenter)
+	assert.Equal(t, "dc2", endpoints[0].ConsulDatacenter)
+}
@@ -0,0 +1,31 @@
+package routing
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/openfaas/faas-provider/httputil"
+)
+
+// NewHandler dispatches the requests to the function of the matching route, through the function proxy.
+// Requests without a matching route are rejected with a 404.
+func NewHandler(routes *Routes, functionProxy http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, ok := routes.Match(r.Host, r.URL.Path)
+		if !ok {
+			httputil.Errorf(w, http.StatusNotFound, "No function found for: %s%s.", normalizeHost(r.Host), r.URL.Path)
+			return
+		}
+
+		path := r.URL.Path
+		if route.StripPrefix {
+			path = strings.TrimPrefix(path, strings.TrimSuffix(route.PathPrefix, "/"))
+		}
+
+		functionProxy(w, mux.SetURLVars(r, map[string]string{
+			"name":   route.Function,
+			"params": strings.TrimPrefix(path, "/"),
+		}))
+	}
+}
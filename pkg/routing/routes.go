@@ -0,0 +1,231 @@
+// Package routing exposes functions on custom hostnames and path prefixes, declared with annotations.
+//
+// A function annotated with `com.openfaas.route.host` (a comma separated list of hostnames, optionally
+// with a leading wildcard label such as `*.api.example.com`) and/or `com.openfaas.route.path_prefix`
+// (e.g. `/v1/orders`) receives the matching requests arriving on the routing listener. The path prefix
+// is removed before the request is sent to the function, unless `com.openfaas.route.strip_prefix=false`.
+package routing
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	hostAnnotation        = "com.openfaas.route.host"
+	pathPrefixAnnotation  = "com.openfaas.route.path_prefix"
+	stripPrefixAnnotation = "com.openfaas.route.strip_prefix"
+)
+
+// Route maps the requests for a host and path prefix to a function.
+type Route struct {
+	Function    string `json:"function"`
+	Host        string `json:"host,omitempty"`
+	PathPrefix  string `json:"pathPrefix,omitempty"`
+	StripPrefix bool   `json:"stripPrefix"`
+}
+
+// wildcard reports whether the route matches all the subdomains of a domain.
+func (r Route) wildcard() bool {
+	return strings.HasPrefix(r.Host, "*.")
+}
+
+// matchesHost compares the route host with the host of a request, without port. Wildcards match a single label.
+func (r Route) matchesHost(host string) bool {
+	if r.Host == "" {
+		return true
+	}
+	if r.wildcard() {
+		i := strings.Index(host, ".")
+		return i > 0 && host[i:] == r.Host[1:]
+	}
+	return host == r.Host
+}
+
+// matchesPath reports whether the path starts with the route prefix, on a segment boundary.
+func (r Route) matchesPath(path string) bool {
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// precedence orders the routes from the most to the least specific: exact hosts before wildcard hosts before
+// routes without host, and longer path prefixes first.
+func (r Route) precedence() int {
+	switch {
+	case r.Host == "":
+		return 2
+	case r.wildcard():
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Routes indexes the routing annotations of the deployed functions. The index is refreshed periodically,
+// so new routes take effect within the refresh interval.
+type Routes struct {
+	jobs      services.Jobs
+	prefix    string
+	namespace string
+	interval  time.Duration
+	log       hclog.Logger
+
+	mu     sync.RWMutex
+	routes []Route
+}
+
+func NewRoutes(config *types.ProviderConfig, jobs services.Jobs, logger hclog.Logger) *Routes {
+	return &Routes{
+		jobs:      jobs,
+		prefix:    config.Scheduling.JobPrefix,
+		namespace: config.Scheduling.Namespace,
+		interval:  config.Routing.RefreshInterval,
+		log:       logger.Named("routing"),
+	}
+}
+
+// Start builds the index and refreshes it in the background.
+func (rs *Routes) Start() {
+	if err := rs.Refresh(); err != nil {
+		rs.log.Error("Error indexing function routes", "error", err.Error())
+	}
+
+	go func() {
+		ticker := time.NewTicker(rs.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := rs.Refresh(); err != nil {
+				rs.log.Error("Error indexing function routes", "error", err.Error())
+			}
+		}
+	}()
+}
+
+// Refresh reads the routing annotations of all the functions. A function which can't be read is skipped until
+// the next refresh, so it doesn't prevent the other functions from being routed.
+func (rs *Routes) Refresh() error {
+	options := &api.QueryOptions{
+		Namespace: rs.namespace,
+		Prefix:    rs.prefix,
+	}
+
+	list, _, err := rs.jobs.List(options)
+	if err != nil {
+		return err
+	}
+
+	var functions []ftypes.FunctionStatus
+	for _, j := range list {
+		job, _, err := rs.jobs.Info(j.ID, options)
+		if err != nil {
+			rs.log.Warn("Error reading function routes", "job", j.ID, "error", err.Error())
+			continue
+		}
+		functions = append(functions, services.CreateFunctionStatus(job, rs.prefix))
+	}
+
+	rs.Set(functions)
+	return nil
+}
+
+// Set replaces the index with the routes of the given functions.
+func (rs *Routes) Set(functions []ftypes.FunctionStatus) {
+	var routes []Route
+	for _, fn := range functions {
+		routes = append(routes, functionRoutes(fn)...)
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.precedence() != b.precedence() {
+			return a.precedence() < b.precedence()
+		}
+		if len(a.PathPrefix) != len(b.PathPrefix) {
+			return len(a.PathPrefix) > len(b.PathPrefix)
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Function < b.Function
+	})
+
+	for i := 1; i < len(routes); i++ {
+		prev, r := routes[i-1], routes[i]
+		if prev.Host == r.Host && strings.TrimSuffix(prev.PathPrefix, "/") == strings.TrimSuffix(r.PathPrefix, "/") {
+			rs.log.Warn("Conflicting function routes, using the first one", "host", r.Host, "path_prefix", r.PathPrefix, "function", prev.Function, "ignored", r.Function)
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.routes = routes
+}
+
+// List returns the indexed routes, in matching order.
+func (rs *Routes) List() []Route {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return append([]Route{}, rs.routes...)
+}
+
+// Match returns the route for the host and path of a request.
+func (rs *Routes) Match(host string, path string) (Route, bool) {
+	host = normalizeHost(host)
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, r := range rs.routes {
+		if r.matchesHost(host) && r.matchesPath(path) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// functionRoutes returns the routes declared by the annotations of a function.
+func functionRoutes(fn ftypes.FunctionStatus) []Route {
+	hosts := types.ParseStringValueFromMap(fn.Annotations, hostAnnotation, "")
+	prefix := types.ParseStringValueFromMap(fn.Annotations, pathPrefixAnnotation, "")
+	if hosts == "" && prefix == "" {
+		return nil
+	}
+
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	strip := types.ParseBoolValueFromMap(fn.Annotations, stripPrefixAnnotation, true)
+
+	var routes []Route
+	for _, host := range strings.Split(hosts, ",") {
+		host = normalizeHost(host)
+		if host == "" && hosts != "" {
+			continue
+		}
+		routes = append(routes, Route{Function: fn.Name, Host: host, PathPrefix: prefix, StripPrefix: strip})
+	}
+	return routes
+}
+
+// normalizeHost lowercases a host and removes its port, if any.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func routedFunction(name string, annotations map[string]string) ftypes.FunctionStatus {
+	return ftypes.FunctionStatus{Name: name, Annotations: &annotations}
+}
+
+func setupRoutes() *Routes {
+	config, _ := types.DefaultConfig()
+	routes := NewRoutes(config, nil, hclog.NewNullLogger())
+	routes.Set([]ftypes.FunctionStatus{
+		routedFunction("orders", map[string]string{hostAnnotation: "orders.api.example.com"}),
+		routedFunction("orders-v1", map[string]string{hostAnnotation: "orders.api.example.com", pathPrefixAnnotation: "/v1"}),
+		routedFunction("tenants", map[string]string{hostAnnotation: "*.tenants.example.com, tenants.example.com"}),
+		routedFunction("users", map[string]string{pathPrefixAnnotation: "/v1/users"}),
+		routedFunction("raw", map[string]string{pathPrefixAnnotation: "/raw", stripPrefixAnnotation: "false"}),
+		routedFunction("plain", map[string]string{}),
+	})
+	return routes
+}
+
+func TestRoutesMatchHostsAndPathPrefixes(t *testing.T) {
+	routes := setupRoutes()
+
+	tests := []struct {
+		host     string
+		path     string
+		function string
+	}{
+		{"orders.api.example.com", "/", "orders"},
+		{"ORDERS.api.example.com:8081", "/list", "orders"},
+		{"orders.api.example.com", "/v1/items", "orders-v1"},
+		{"orders.api.example.com", "/v1", "orders-v1"},
+		{"orders.api.example.com", "/v10", "orders"},
+		{"acme.tenants.example.com", "/", "tenants"},
+		{"tenants.example.com", "/", "tenants"},
+		{"localhost", "/v1/users/42", "users"},
+		{"localhost", "/raw/data", "raw"},
+	}
+
+	for _, test := range tests {
+		route, ok := routes.Match(test.host, test.path)
+		if assert.True(t, ok, test.host+test.path) {
+			assert.Equal(t, test.function, route.Function, test.host+test.path)
+		}
+	}
+
+	_, ok := routes.Match("unknown.example.com", "/")
+	assert.False(t, ok)
+
+	_, ok = routes.Match("a.b.tenants.example.com", "/")
+	assert.False(t, ok)
+
+	_, ok = routes.Match("localhost", "/v1/usersettings")
+	assert.False(t, ok)
+}
+
+func TestHandlerDispatchesRequestsToFunctions(t *testing.T) {
+	routes := setupRoutes()
+
+	var vars map[string]string
+	handler := NewHandler(routes, func(w http.ResponseWriter, r *http.Request) {
+		vars = mux.Vars(r)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		host     string
+		path     string
+		function string
+		params   string
+	}{
+		{"orders.api.example.com", "/list", "orders", "list"},
+		{"orders.api.example.com", "/v1/items/1", "orders-v1", "items/1"},
+		{"localhost", "/v1/users", "users", ""},
+		{"localhost", "/raw/data", "raw", "raw/data"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		request.Host = test.host
+		recorder := httptest.NewRecorder()
+
+		handler(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, map[string]string{"name": test.function, "params": test.params}, vars)
+	}
+}
+
+func TestHandlerRejectsUnmappedHosts(t *testing.T) {
+	handler := NewHandler(setupRoutes(), func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request should not be proxied")
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Host = "unknown.example.com"
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestRoutesSkipFunctionsWhichCantBeRead(t *testing.T) {
+	jobs := &services.MockJobs{}
+	jobs.On("List", mock.Anything).Return([]*api.JobListStub{{ID: "faas-fn-broken"}, {ID: "faas-fn-orders"}}, nil, nil)
+	jobs.On("Info", "faas-fn-broken", mock.Anything).Return(nil, nil, fmt.Errorf("failure"))
+
+	id, name, namespace, count, submitTime := "faas-fn-orders", "orders", "default", 1, time.Now().UnixNano()
+	jobs.On("Info", "faas-fn-orders", mock.Anything).Return(&api.Job{
+		ID:         &id,
+		Name:       &id,
+		Namespace:  &namespace,
+		SubmitTime: &submitTime,
+		Meta:       map[string]string{hostAnnotation: "orders.api.example.com"},
+		TaskGroups: []*api.TaskGroup{{Name: &name, Count: &count, Tasks: []*api.Task{{Name: name, Config: map[string]interface{}{"image": "orders"}}}}},
+	}, nil, nil)
+
+	config, _ := types.DefaultConfig()
+	routes := NewRoutes(config, jobs, hclog.NewNullLogger())
+
+	assert.NoError(t, routes.Refresh())
+
+	route, ok := routes.Match("orders.api.example.com", "/")
+	assert.True(t, ok)
+	assert.Equal(t, "orders", route.Function)
+}
@@ -0,0 +1,345 @@
+package scaling
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	scaleTargetLabel = "com.openfaas.scale.target"
+	scaleMinLabel    = "com.openfaas.scale.min"
+	scaleMaxLabel    = "com.openfaas.scale.max"
+
+	defaultMinReplicas = 1
+	defaultMaxReplicas = 20
+)
+
+// Autoscaler adjusts the replicas of the functions labelled with `com.openfaas.scale.target`, based on
+// the average number of in-flight requests measured by observing the function proxy. Requests waiting in the
+// queue of a function with a `com.openfaas.concurrency` limit are in flight as well, so they drive a scale-up.
+//
+// The desired replicas are ceil(concurrency / target), bounded by `com.openfaas.scale.min` and
+// `com.openfaas.scale.max`. To avoid flapping, a scale-up uses the lowest recommendation of the
+// scale-up window and a scale-down the highest recommendation of the scale-down window, and no
+// scaling happens during the cooldown following a previous scaling action.
+type Autoscaler struct {
+	jobs              services.Jobs
+	prefix            string
+	namespace         string
+	interval          time.Duration
+	scaleUpWindow     time.Duration
+	scaleDownWindow   time.Duration
+	scaleUpCooldown   time.Duration
+	scaleDownCooldown time.Duration
+	now               func() time.Time
+	log               hclog.Logger
+
+	mu        sync.Mutex
+	functions map[string]*functionLoad
+}
+
+// Decision is the latest evaluation of the Autoscaler for a function.
+type Decision struct {
+	Function    string
+	Concurrency float64
+	QueueDepth  int
+	Current     int
+	Desired     int
+	Reason      string
+	EvaluatedAt time.Time
+	LastScaleAt time.Time
+}
+
+type functionLoad struct {
+	inflight        int
+	queued          int
+	integral        float64
+	lastChange      time.Time
+	lastEvaluation  time.Time
+	recommendations []recommendation
+	decision        *Decision
+	lastScale       time.Time
+}
+
+type recommendation struct {
+	replicas int
+	time     time.Time
+}
+
+func NewAutoscaler(config *types.ProviderConfig, jobs services.Jobs, logger hclog.Logger) *Autoscaler {
+	return &Autoscaler{
+		jobs:              jobs,
+		prefix:            config.Scheduling.JobPrefix,
+		namespace:         config.Scheduling.Namespace,
+		interval:          config.Scaling.Interval,
+		scaleUpWindow:     config.Scaling.ScaleUpWindow,
+		scaleDownWindow:   config.Scaling.ScaleDownWindow,
+		scaleUpCooldown:   config.Scaling.ScaleUpCooldown,
+		scaleDownCooldown: config.Scaling.ScaleDownCooldown,
+		now:               time.Now,
+		log:               logger.Named("autoscaler"),
+		functions:         map[string]*functionLoad{},
+	}
+}
+
+func (a *Autoscaler) InvocationStarted(function string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	l := a.load(function)
+	l.inflight++
+}
+
+func (a *Autoscaler) InvocationFinished(function string, statusCode int, duration time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	l := a.load(function)
+	if l.inflight > 0 {
+		l.inflight--
+	}
+}
+
+func (a *Autoscaler) QueueDepthChanged(function string, depth int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.load(function).queued = depth
+}
+
+// load returns the load of a function, after accumulating the in-flight requests up to now.
+// The caller must hold the lock.
+func (a *Autoscaler) load(function string) *functionLoad {
+	now := a.now()
+
+	l, ok := a.functions[function]
+	if !ok {
+		l = &functionLoad{lastChange: now, lastEvaluation: now}
+		a.functions[function] = l
+	}
+
+	l.integral += float64(l.inflight) * now.Sub(l.lastChange).Seconds()
+	l.lastChange = now
+
+	return l
+}
+
+// LastDecision returns the latest evaluation of the function, if any.
+func (a *Autoscaler) LastDecision(function string) (Decision, bool) {
+	if a == nil {
+		return Decision{}, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if l, ok := a.functions[function]; ok && l.decision != nil {
+		return *l.decision, true
+	}
+	return Decision{}, false
+}
+
+// Start evaluates the functions at the configured interval.
+func (a *Autoscaler) Start() {
+	go func() {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := a.evaluate(); err != nil {
+				a.log.Error("Error evaluating functions", "error", err.Error())
+			}
+		}
+	}()
+}
+
+func (a *Autoscaler) evaluate() error {
+	options := &api.QueryOptions{
+		Namespace: a.namespace,
+		Prefix:    a.prefix,
+	}
+
+	list, _, err := a.jobs.List(options)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range list {
+		if j.Status == "dead" {
+			continue
+		}
+
+		job, _, err := a.jobs.Info(j.ID, options)
+		if err != nil {
+			a.log.Error("Error reading function", "job", j.ID, "error", err.Error())
+			continue
+		}
+
+		if len(job.TaskGroups) == 0 || job.TaskGroups[0].Count == nil {
+			continue
+		}
+
+		status := services.CreateFunctionStatus(job, a.prefix)
+
+		target := types.ParseIntValueFromMap(status.Labels, scaleTargetLabel, 0)
+		if target <= 0 {
+			continue
+		}
+
+		min := types.ParseIntValueFromMap(status.Labels, scaleMinLabel, defaultMinReplicas)
+		max := types.ParseIntValueFromMap(status.Labels, scaleMaxLabel, defaultMaxReplicas)
+
+		a.evaluateFunction(status.Name, *job.TaskGroups[0].Count, target, min, max)
+	}
+
+	return nil
+}
+
+func (a *Autoscaler) evaluateFunction(function string, current, target, min, max int) {
+	a.mu.Lock()
+
+	now := a.now()
+	l := a.load(function)
+
+	concurrency := 0.0
+	if elapsed := now.Sub(l.lastEvaluation).Seconds(); elapsed > 0 {
+		concurrency = l.integral / elapsed
+	}
+	l.integral = 0
+	l.lastEvaluation = now
+
+	decision := &Decision{
+		Function:    function,
+		Concurrency: concurrency,
+		QueueDepth:  l.queued,
+		Current:     current,
+		Desired:     current,
+		EvaluatedAt: now,
+		LastScaleAt: l.lastScale,
+	}
+	l.decision = decision
+
+	// functions scaled to zero are brought back by the proxy on the next invocation
+	if current == 0 {
+		decision.Reason = "scaled to zero"
+		a.mu.Unlock()
+		return
+	}
+
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	recommended := int(math.Ceil(concurrency / float64(target)))
+	if recommended < min {
+		recommended = min
+	}
+	if recommended > max {
+		recommended = max
+	}
+
+	l.recommendations = append(l.recommendations, recommendation{replicas: recommended, time: now})
+	l.recommendations = prune(l.recommendations, now, maxDuration(a.scaleUpWindow, a.scaleDownWindow))
+
+	desired := current
+	reason := "stable"
+
+	if up := lowest(l.recommendations, now, a.scaleUpWindow); up > current {
+		desired = up
+		reason = "scale up"
+		if now.Sub(l.lastScale) < a.scaleUpCooldown {
+			desired = current
+			reason = "scale up cooldown"
+		}
+	} else if down := highest(l.recommendations, now, a.scaleDownWindow); down < current {
+		desired = down
+		reason = "scale down"
+		if now.Sub(l.lastScale) < a.scaleDownCooldown {
+			desired = current
+			reason = "scale down cooldown"
+		}
+	}
+
+	decision.Desired = desired
+	decision.Reason = reason
+
+	a.mu.Unlock()
+
+	if desired == current {
+		return
+	}
+
+	if err := a.scale(function, desired, concurrency); err != nil {
+		a.log.Error("Error scaling function", "function", function, "namespace", a.namespace, "replicas", desired, "error", err.Error())
+		a.mu.Lock()
+		decision.Reason = fmt.Sprintf("%s failed: %s", reason, err.Error())
+		a.mu.Unlock()
+		return
+	}
+
+	a.mu.Lock()
+	l.lastScale = now
+	decision.LastScaleAt = now
+	a.mu.Unlock()
+
+	a.log.Info("Function scaled", "function", function, "namespace", a.namespace, "from", current, "to", desired, "concurrency", concurrency)
+}
+
+func (a *Autoscaler) scale(function string, replicas int, concurrency float64) error {
+	jobID := fmt.Sprintf("%s%s", a.prefix, function)
+	msg := fmt.Sprintf("scaled by the faas-nomad autoscaler with a concurrency of %.2f", concurrency)
+	meta := map[string]interface{}{
+		"reason":      "autoscaler",
+		"concurrency": fmt.Sprintf("%.2f", concurrency),
+	}
+
+	_, _, err := a.jobs.Scale(jobID, function, &replicas, msg, false, meta, &api.WriteOptions{Namespace: a.namespace})
+	return err
+}
+
+func prune(recommendations []recommendation, now time.Time, window time.Duration) []recommendation {
+	idx := 0
+	for idx < len(recommendations)-1 && now.Sub(recommendations[idx].time) > window {
+		idx++
+	}
+	return recommendations[idx:]
+}
+
+// lowest returns the lowest recommendation within the window, the latest recommendation is always included.
+func lowest(recommendations []recommendation, now time.Time, window time.Duration) int {
+	result := recommendations[len(recommendations)-1].replicas
+	for _, r := range recommendations {
+		if now.Sub(r.time) <= window && r.replicas < result {
+			result = r.replicas
+		}
+	}
+	return result
+}
+
+// highest returns the highest recommendation within the window, the latest recommendation is always included.
+func highest(recommendations []recommendation, now time.Time, window time.Duration) int {
+	result := recommendations[len(recommendations)-1].replicas
+	for _, r := range recommendations {
+		if now.Sub(r.time) <= window && r.replicas > result {
+			result = r.replicas
+		}
+	}
+	return result
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
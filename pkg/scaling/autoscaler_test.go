@@ -0,0 +1,149 @@
+package scaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupAutoscaler() (*services.MockJobs, *Autoscaler, *fakeClock) {
+	jobs := &services.MockJobs{}
+	clock := &fakeClock{now: time.Now()}
+
+	config, _ := types.DefaultConfig()
+	config.Scaling.ScaleUpWindow = 0
+	config.Scaling.ScaleDownWindow = time.Minute
+	config.Scaling.ScaleUpCooldown = 30 * time.Second
+	config.Scaling.ScaleDownCooldown = time.Minute
+
+	autoscaler := NewAutoscaler(config, jobs, hclog.NewNullLogger())
+	autoscaler.now = clock.Now
+
+	jobs.On("Scale", mock.Anything, mock.Anything, mock.Anything, mock.Anything, false, mock.Anything, mock.Anything).Return(nil, nil, nil)
+
+	return jobs, autoscaler, clock
+}
+
+// simulate keeps n requests in flight for the given duration.
+func simulate(a *Autoscaler, clock *fakeClock, function string, n int, d time.Duration) {
+	for i := 0; i < n; i++ {
+		a.InvocationStarted(function)
+	}
+	clock.Advance(d)
+	for i := 0; i < n; i++ {
+		a.InvocationFinished(function, 200, d)
+	}
+}
+
+func scaledReplicas(jobs *services.MockJobs) []int {
+	var result []int
+	for _, c := range jobs.Calls {
+		if c.Method == "Scale" {
+			result = append(result, *c.Arguments.Get(2).(*int))
+		}
+	}
+	return result
+}
+
+func TestAutoscalerScalesUpToConcurrencyTarget(t *testing.T) {
+	jobs, autoscaler, clock := setupAutoscaler()
+
+	simulate(autoscaler, clock, "fn", 25, 10*time.Second)
+	autoscaler.evaluateFunction("fn", 1, 10, 1, 20)
+
+	assert.Equal(t, []int{3}, scaledReplicas(jobs))
+
+	decision, ok := autoscaler.LastDecision("fn")
+	assert.True(t, ok)
+	assert.Equal(t, 3, decision.Desired)
+	assert.Equal(t, 25.0, decision.Concurrency)
+	assert.Equal(t, "scale up", decision.Reason)
+}
+
+func TestAutoscalerRespectsMaxReplicas(t *testing.T) {
+	jobs, autoscaler, clock := setupAutoscaler()
+
+	simulate(autoscaler, clock, "fn", 100, 10*time.Second)
+	autoscaler.evaluateFunction("fn", 1, 10, 1, 5)
+
+	assert.Equal(t, []int{5}, scaledReplicas(jobs))
+}
+
+func TestAutoscalerWaitsForCooldownBeforeScalingAgain(t *testing.T) {
+	jobs, autoscaler, clock := setupAutoscaler()
+
+	simulate(autoscaler, clock, "fn", 20, 10*time.Second)
+	autoscaler.evaluateFunction("fn", 1, 10, 1, 20)
+
+	simulate(autoscaler, clock, "fn", 40, 10*time.Second)
+	autoscaler.evaluateFunction("fn", 2, 10, 1, 20)
+
+	decision, _ := autoscaler.LastDecision("fn")
+	assert.Equal(t, "scale up cooldown", decision.Reason)
+	assert.Equal(t, []int{2}, scaledReplicas(jobs))
+
+	simulate(autoscaler, clock, "fn", 40, 30*time.Second)
+	autoscaler.evaluateFunction("fn", 2, 10, 1, 20)
+
+	assert.Equal(t, []int{2, 4}, scaledReplicas(jobs))
+}
+
+func TestAutoscalerStabilizesScaleDown(t *testing.T) {
+	jobs, autoscaler, clock := setupAutoscaler()
+
+	simulate(autoscaler, clock, "fn", 40, 10*time.Second)
+	autoscaler.evaluateFunction("fn", 4, 10, 1, 20)
+
+	// load drops, but the earlier recommendation is still in the scale-down window
+	clock.Advance(30 * time.Second)
+	autoscaler.evaluateFunction("fn", 4, 10, 1, 20)
+	assert.Empty(t, scaledReplicas(jobs))
+
+	clock.Advance(time.Minute)
+	autoscaler.evaluateFunction("fn", 4, 10, 1, 20)
+	assert.Equal(t, []int{1}, scaledReplicas(jobs))
+}
+
+func TestAutoscalerIgnoresFunctionsScaledToZero(t *testing.T) {
+	jobs, autoscaler, clock := setupAutoscaler()
+
+	simulate(autoscaler, clock, "fn", 40, 10*time.Second)
+	autoscaler.evaluateFunction("fn", 0, 10, 1, 20)
+
+	assert.Empty(t, scaledReplicas(jobs))
+}
+
+func TestAutoscalerEvaluatesOnlyLabelledFunctions(t *testing.T) {
+	jobs, autoscaler, clock := setupAutoscaler()
+
+	labelled := createMockJob("labelled", 1, map[string]interface{}{scaleTargetLabel: "2"})
+	unlabelled := createMockJob("unlabelled", 1, map[string]interface{}{})
+
+	jobs.On("List", mock.Anything).Return(listOf(labelled, unlabelled), nil, nil)
+	jobs.On("Info", *labelled.ID, mock.Anything).Return(labelled, nil, nil)
+	jobs.On("Info", *unlabelled.ID, mock.Anything).Return(unlabelled, nil, nil)
+
+	simulate(autoscaler, clock, "labelled", 10, 10*time.Second)
+	simulate(autoscaler, clock, "unlabelled", 10, 10*time.Second)
+
+	// 10 requests in flight during half of the 20 seconds since the first invocation
+	assert.NoError(t, autoscaler.evaluate())
+
+	assert.Equal(t, "faas-fn-labelled", findCall(jobs, "Scale").Arguments.Get(0))
+	assert.Equal(t, []int{3}, scaledReplicas(jobs))
+}
+
+func TestAutoscalerReportsQueueDepth(t *testing.T) {
+	_, autoscaler, _ := setupAutoscaler()
+
+	autoscaler.QueueDepthChanged("fn", 7)
+	autoscaler.evaluateFunction("fn", 1, 10, 1, 20)
+
+	decision, _ := autoscaler.LastDecision("fn")
+	assert.Equal(t, 7, decision.QueueDepth)
+}
@@ -0,0 +1,171 @@
+package scaling
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+)
+
+const (
+	scaleZeroLabel         = "com.openfaas.scale.zero"
+	scaleZeroDurationLabel = "com.openfaas.scale.zero-duration"
+)
+
+// IdleScaler scales functions labelled with `com.openfaas.scale.zero=true` to zero replicas
+// when they haven't been invoked for `com.openfaas.scale.zero-duration`.
+// It records the invocations by observing the function proxy.
+type IdleScaler struct {
+	jobs            services.Jobs
+	prefix          string
+	namespace       string
+	interval        time.Duration
+	defaultDuration time.Duration
+	now             func() time.Time
+	log             hclog.Logger
+
+	mu        sync.Mutex
+	startedAt time.Time
+	lastSeen  map[string]time.Time
+	inflight  map[string]int
+}
+
+func NewIdleScaler(config *types.ProviderConfig, jobs services.Jobs, logger hclog.Logger) *IdleScaler {
+	return &IdleScaler{
+		jobs:            jobs,
+		prefix:          config.Scheduling.JobPrefix,
+		namespace:       config.Scheduling.Namespace,
+		interval:        config.Scaling.IdleCheckInterval,
+		defaultDuration: config.Scaling.IdleDuration,
+		now:             time.Now,
+		log:             logger.Named("idle_scaler"),
+		startedAt:       time.Now(),
+		lastSeen:        map[string]time.Time{},
+		inflight:        map[string]int{},
+	}
+}
+
+func (s *IdleScaler) InvocationStarted(function string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSeen[function] = s.now()
+	s.inflight[function]++
+}
+
+func (s *IdleScaler) InvocationFinished(function string, statusCode int, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSeen[function] = s.now()
+	if s.inflight[function] > 0 {
+		s.inflight[function]--
+	}
+}
+
+// Start checks for idle functions at the configured interval.
+func (s *IdleScaler) Start() {
+	s.mu.Lock()
+	s.startedAt = s.now()
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := s.scaleIdleFunctions(); err != nil {
+				s.log.Error("Error scaling idle functions", "error", err.Error())
+			}
+		}
+	}()
+}
+
+func (s *IdleScaler) scaleIdleFunctions() error {
+	options := &api.QueryOptions{
+		Namespace: s.namespace,
+		Prefix:    s.prefix,
+	}
+
+	list, _, err := s.jobs.List(options)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range list {
+		if j.Status == "dead" {
+			continue
+		}
+
+		job, _, err := s.jobs.Info(j.ID, options)
+		if err != nil {
+			s.log.Error("Error reading function", "job", j.ID, "error", err.Error())
+			continue
+		}
+
+		if len(job.TaskGroups) == 0 || job.TaskGroups[0].Count == nil || *job.TaskGroups[0].Count == 0 {
+			continue
+		}
+
+		status := services.CreateFunctionStatus(job, s.prefix)
+		if !types.ParseBoolValueFromMap(status.Labels, scaleZeroLabel, false) {
+			continue
+		}
+
+		duration := types.ParseIntOrDurationValueFromMap(status.Labels, scaleZeroDurationLabel, s.defaultDuration)
+		idle, ok := s.idleFor(status.Name, duration)
+		if !ok {
+			continue
+		}
+
+		s.scaleDown(status.Name, idle)
+	}
+
+	return nil
+}
+
+// idleFor returns how long the function has been idle, and whether that exceeds the given duration.
+// Functions which were not invoked since the scaler started are idle since the start.
+func (s *IdleScaler) idleFor(function string, duration time.Duration) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inflight[function] > 0 {
+		return 0, false
+	}
+
+	lastSeen, ok := s.lastSeen[function]
+	if !ok {
+		lastSeen = s.startedAt
+	}
+
+	idle := s.now().Sub(lastSeen)
+	return idle, idle >= duration
+}
+
+func (s *IdleScaler) scaleDown(function string, idle time.Duration) {
+	replicas := 0
+	jobID := fmt.Sprintf("%s%s", s.prefix, function)
+	msg := fmt.Sprintf("scaled to zero by the faas-nomad provider after being idle for %s", idle.Round(time.Second))
+	meta := map[string]interface{}{
+		"reason":   "idle",
+		"idle_for": idle.Round(time.Second).String(),
+	}
+
+	_, _, err := s.jobs.Scale(jobID, function, &replicas, msg, false, meta, &api.WriteOptions{Namespace: s.namespace})
+	if err != nil {
+		s.log.Error("Error scaling idle function to zero", "function", function, "namespace", s.namespace, "error", err.Error())
+		return
+	}
+
+	s.log.Info("Idle function scaled to zero", "function", function, "namespace", s.namespace, "idle", idle.Round(time.Second))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSeen[function] = s.now()
+}
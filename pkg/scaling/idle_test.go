@@ -0,0 +1,164 @@
+package scaling
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/services"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func createMockJob(name string, count int, labels map[string]interface{}) *api.Job {
+	id := "faas-fn-" + name
+	namespace := "default"
+	submitTime := time.Now().UnixNano()
+	return &api.Job{
+		ID:         &id,
+		Name:       &id,
+		Namespace:  &namespace,
+		SubmitTime: &submitTime,
+		TaskGroups: []*api.TaskGroup{{
+			Name:  &name,
+			Count: &count,
+			Tasks: []*api.Task{{
+				Name:   name,
+				Config: map[string]interface{}{"image": "docker", "labels": []interface{}{labels}},
+			}},
+		}},
+	}
+}
+
+func listOf(jobs ...*api.Job) []*api.JobListStub {
+	var list []*api.JobListStub
+	for _, j := range jobs {
+		list = append(list, &api.JobListStub{ID: *j.ID, Status: "running"})
+	}
+	return list
+}
+
+func findCall(jobs *services.MockJobs, method string) *mock.Call {
+	for _, c := range jobs.Calls {
+		if c.Method == method {
+			return &c
+		}
+	}
+	return nil
+}
+
+func setupIdleScaler(jobs ...*api.Job) (*services.MockJobs, *IdleScaler, *fakeClock) {
+	mockJobs := &services.MockJobs{}
+	clock := &fakeClock{now: time.Now()}
+
+	config, _ := types.DefaultConfig()
+	config.Scaling.IdleDuration = 10 * time.Minute
+
+	scaler := NewIdleScaler(config, mockJobs, hclog.NewNullLogger())
+	scaler.now = clock.Now
+	scaler.startedAt = clock.Now()
+
+	for _, j := range jobs {
+		mockJobs.On("Info", *j.ID, mock.Anything).Return(j, nil, nil)
+	}
+	mockJobs.On("List", mock.Anything).Return(listOf(jobs...), nil, nil)
+	mockJobs.On("Scale", mock.Anything, mock.Anything, mock.Anything, mock.Anything, false, mock.Anything, mock.Anything).Return(nil, nil, nil)
+
+	return mockJobs, scaler, clock
+}
+
+func TestIdleScalerScalesLabelledIdleFunctionToZero(t *testing.T) {
+	jobs, scaler, clock := setupIdleScaler(
+		createMockJob("idle", 2, map[string]interface{}{scaleZeroLabel: "true"}),
+		createMockJob("unlabelled", 2, map[string]interface{}{}),
+	)
+
+	clock.Advance(11 * time.Minute)
+
+	assert.NoError(t, scaler.scaleIdleFunctions())
+
+	jobs.AssertNumberOfCalls(t, "Scale", 1)
+	scale := findCall(jobs, "Scale").Arguments
+	assert.Equal(t, "faas-fn-idle", scale.Get(0))
+	assert.Equal(t, "idle", scale.Get(1))
+	assert.Equal(t, 0, *scale.Get(2).(*int))
+
+	assert.Equal(t, "11m0s", scale.Get(5).(map[string]interface{})["idle_for"])
+}
+
+func TestIdleScalerKeepsRecentlyInvokedFunction(t *testing.T) {
+	jobs, scaler, clock := setupIdleScaler(
+		createMockJob("busy", 1, map[string]interface{}{scaleZeroLabel: "true"}),
+	)
+
+	clock.Advance(9 * time.Minute)
+	scaler.InvocationStarted("busy")
+	scaler.InvocationFinished("busy", 200, time.Second)
+	clock.Advance(9 * time.Minute)
+
+	assert.NoError(t, scaler.scaleIdleFunctions())
+
+	jobs.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestIdleScalerKeepsFunctionWithInflightRequests(t *testing.T) {
+	jobs, scaler, clock := setupIdleScaler(
+		createMockJob("slow", 1, map[string]interface{}{scaleZeroLabel: "true"}),
+	)
+
+	scaler.InvocationStarted("slow")
+	clock.Advance(20 * time.Minute)
+
+	assert.NoError(t, scaler.scaleIdleFunctions())
+
+	jobs.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestIdleScalerUsesZeroDurationLabel(t *testing.T) {
+	jobs, scaler, clock := setupIdleScaler(
+		createMockJob("short", 1, map[string]interface{}{scaleZeroLabel: "true", scaleZeroDurationLabel: "2m"}),
+	)
+
+	clock.Advance(3 * time.Minute)
+
+	assert.NoError(t, scaler.scaleIdleFunctions())
+
+	jobs.AssertNumberOfCalls(t, "Scale", 1)
+}
+
+func TestIdleScalerSkipsFunctionsAlreadyScaledToZero(t *testing.T) {
+	jobs, scaler, clock := setupIdleScaler(
+		createMockJob("zero", 0, map[string]interface{}{scaleZeroLabel: "true"}),
+	)
+
+	clock.Advance(time.Hour)
+
+	assert.NoError(t, scaler.scaleIdleFunctions())
+
+	jobs.AssertNotCalled(t, "Scale", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestIdleScalerReportsErrorWhenListingJobsFails(t *testing.T) {
+	jobs := &services.MockJobs{}
+	config, _ := types.DefaultConfig()
+	scaler := NewIdleScaler(config, jobs, hclog.NewNullLogger())
+
+	jobs.On("List", mock.Anything).Return(nil, nil, fmt.Errorf("failure"))
+
+	assert.Error(t, scaler.scaleIdleFunctions())
+}
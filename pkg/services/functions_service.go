@@ -0,0 +1,161 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+// Functions gives access to the deployment details (labels, annotations, env vars) of a function.
+// Invalidate must be called when a function is deployed, updated or deleted.
+type Functions interface {
+	Get(functionName string) (*ftypes.FunctionStatus, error)
+	Invalidate(functionName string)
+}
+
+// NewFunctionsCache creates a Functions implementation which reads the function details from the
+// Nomad jobs and keeps them for the given ttl, avoiding a Nomad call for every invocation.
+func NewFunctionsCache(config *types.ProviderConfig, jobs Jobs, ttl time.Duration) *FunctionsCache {
+	return &FunctionsCache{
+		jobs:      jobs,
+		prefix:    config.Scheduling.JobPrefix,
+		namespace: config.Scheduling.Namespace,
+		ttl:       ttl,
+		now:       time.Now,
+	}
+}
+
+type FunctionsCache struct {
+	jobs      Jobs
+	prefix    string
+	namespace string
+	ttl       time.Duration
+	now       func() time.Time
+	cache     sync.Map
+
+	mu        sync.Mutex
+	nextPrune time.Time
+}
+
+// notFoundTTL is how long a failed lookup is kept, so the requests for an unknown function, or while Nomad
+// is unavailable, don't result in a Nomad call for every request.
+const notFoundTTL = 2 * time.Second
+
+type functionItem struct {
+	status  *ftypes.FunctionStatus
+	err     error
+	expires time.Time
+}
+
+func (fc *FunctionsCache) Get(functionName string) (*ftypes.FunctionStatus, error) {
+	name := strings.TrimSuffix(functionName, "."+fc.namespace)
+	now := fc.now()
+	fc.prune(now)
+
+	if val, ok := fc.cache.Load(name); ok {
+		item := val.(*functionItem)
+		if now.Before(item.expires) {
+			return item.status, item.err
+		}
+	}
+
+	job, _, err := fc.jobs.Info(fmt.Sprintf("%s%s", fc.prefix, name), &api.QueryOptions{Namespace: fc.namespace})
+	if err != nil {
+		ttl := notFoundTTL
+		if fc.ttl < ttl {
+			ttl = fc.ttl
+		}
+		fc.cache.Store(name, &functionItem{err: err, expires: now.Add(ttl)})
+		return nil, err
+	}
+
+	status := CreateFunctionStatus(job, fc.prefix)
+	// the env vars are only kept for the proxy, e.g. for the exec_timeout of the function, and are not
+	// returned by the API
+	status.EnvVars = job.TaskGroups[0].Tasks[0].Env
+	fc.cache.Store(name, &functionItem{status: &status, expires: now.Add(fc.ttl)})
+
+	return &status, nil
+}
+
+// prune removes the expired functions, at most once per ttl, so the unknown and deleted functions don't
+// stay in the cache.
+func (fc *FunctionsCache) prune(now time.Time) {
+	fc.mu.Lock()
+	if now.Before(fc.nextPrune) {
+		fc.mu.Unlock()
+		return
+	}
+	fc.nextPrune = now.Add(fc.ttl)
+	fc.mu.Unlock()
+
+	fc.cache.Range(func(key, value interface{}) bool {
+		if !now.Before(value.(*functionItem).expires) {
+			fc.cache.Delete(key)
+		}
+		return true
+	})
+}
+
+// Invalidate removes the function from the cache, so the next Get reads the latest deployment details.
+func (fc *FunctionsCache) Invalidate(functionName string) {
+	fc.cache.Delete(strings.TrimSuffix(functionName, "."+fc.namespace))
+}
+
+func CreateFunctionStatus(job *api.Job, jobPrefix string) ftypes.FunctionStatus {
+	var labels = map[string]string{}
+	task := job.TaskGroups[0].Tasks[0]
+
+	if task.Config["labels"] != nil {
+		labels = parseLabels(task.Config["labels"].([]interface{}))
+	}
+
+	var annotations = map[string]string{}
+	if job.Meta != nil {
+		annotations = job.Meta
+	}
+
+	return ftypes.FunctionStatus{
+		Name:            sanitiseJobName(job, jobPrefix),
+		Namespace:       *job.Namespace,
+		Image:           task.Config["image"].(string),
+		Replicas:        uint64(*job.TaskGroups[0].Count),
+		InvocationCount: 0,
+		Labels:          &labels,
+		Annotations:     &annotations,
+		EnvProcess:      getEnvProcess(task.Env),
+		CreatedAt:       time.Unix(0, *job.SubmitTime),
+	}
+}
+
+func getEnvProcess(m map[string]string) string {
+	if m == nil {
+		return ""
+	}
+	s := m[EnvProcessName]
+	if len(s) != 0 {
+		return s
+	}
+	return ""
+}
+
+func parseLabels(labels []interface{}) map[string]string {
+	newLabels := map[string]string{}
+	if len(labels) > 0 {
+		for _, l := range labels {
+			for k, v := range l.(map[string]interface{}) {
+				newLabels[k] = v.(string)
+			}
+		}
+	}
+	return newLabels
+}
+
+func sanitiseJobName(job *api.Job, jobPrefix string) string {
+	return strings.Replace(*job.Name, jobPrefix, "", -1)
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jsiebens/faas-nomad/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFunctionsCacheKeepsFailedLookups(t *testing.T) {
+	jobs := &MockJobs{}
+	jobs.On("Info", "faas-fn-unknown", mock.Anything).Return(nil, nil, fmt.Errorf("job not found"))
+
+	config, _ := types.DefaultConfig()
+	functions := NewFunctionsCache(config, jobs, 10*time.Second)
+
+	for i := 0; i < 3; i++ {
+		fn, err := functions.Get("unknown")
+		assert.Nil(t, fn)
+		assert.EqualError(t, err, "job not found")
+	}
+	jobs.AssertNumberOfCalls(t, "Info", 1)
+
+	functions.Invalidate("unknown")
+	functions.Get("unknown")
+	jobs.AssertNumberOfCalls(t, "Info", 2)
+}
+
+func TestFunctionsCachePrunesExpiredFunctions(t *testing.T) {
+	jobs := &MockJobs{}
+	jobs.On("Info", mock.Anything, mock.Anything).Return(nil, nil, fmt.Errorf("job not found"))
+
+	config, _ := types.DefaultConfig()
+	functions := NewFunctionsCache(config, jobs, 10*time.Second)
+	now := time.Now()
+	functions.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		functions.Get(fmt.Sprintf("unknown-%d", i))
+	}
+
+	now = now.Add(11 * time.Second)
+	functions.Get("other")
+
+	entries := 0
+	functions.cache.Range(func(key, value interface{}) bool {
+		entries++
+		return true
+	})
+	assert.Equal(t, 1, entries)
+}
@@ -13,6 +13,11 @@ import (
 
 const (
 	EnvProcessName = "fprocess"
+
+	// InvocationCountAnnotationPrefix and AutoscalerAnnotationPrefix prefix the annotations reported by the
+	// provider when reading a function, they are never stored with the job.
+	InvocationCountAnnotationPrefix = "com.openfaas.invocation_count."
+	AutoscalerAnnotationPrefix      = "com.openfaas.scale.autoscaler."
 )
 
 var (
@@ -101,6 +106,9 @@ func (f *jobFactory) createAnnotations(r ftypes.FunctionDeployment) map[string]s
 	annotations := map[string]string{}
 	if r.Annotations != nil {
 		for k, v := range *r.Annotations {
+			if strings.HasPrefix(k, InvocationCountAnnotationPrefix) || strings.HasPrefix(k, AutoscalerAnnotationPrefix) {
+				continue
+			}
 			annotations[k] = v
 		}
 	}
@@ -158,10 +166,18 @@ func (f *jobFactory) createTaskGroups(fd ftypes.FunctionDeployment) []*api.TaskG
 		},
 	}
 
+	if f.config.Discovery.Provider == types.DiscoveryNomad {
+		// the initial status and the check thresholds are only supported by Consul
+		check.InitialStatus = ""
+		check.SuccessBeforePassing = 0
+		check.FailuresBeforeCritical = 0
+	}
+
 	service := &api.Service{
 		Name:      fmt.Sprintf("%s%s", f.config.Scheduling.JobPrefix, fd.Service),
 		PortLabel: "http",
 		Tags:      []string{"http", "faas"},
+		Meta:      map[string]string{types.DatacenterMeta: "${NOMAD_DC}"},
 		Checks:    []api.ServiceCheck{check},
 	}
 
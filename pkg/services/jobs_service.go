@@ -1,6 +1,8 @@
 package services
 
 import (
+	"encoding/json"
+
 	"github.com/hashicorp/nomad/api"
 	"github.com/jsiebens/faas-nomad/pkg/types"
 )
@@ -15,7 +17,97 @@ type Jobs interface {
 	Allocations(jobID string, allAllocs bool, q *api.QueryOptions) ([]*api.AllocationListStub, *api.QueryMeta, error)
 }
 
-func NewNomadJobs(config types.NomadConfig) (Jobs, error) {
+func NewNomadJobs(config types.NomadConfig, discovery types.DiscoveryConfig) (Jobs, error) {
+	nomadClient, err := newNomadClient(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.Provider == types.DiscoveryNomad {
+		return &nomadServiceJobs{Jobs: nomadClient.Jobs(), client: nomadClient}, nil
+	}
+
+	return nomadClient.Jobs(), nil
+}
+
+// nomadServiceJobs registers the services of the jobs with the Nomad native service discovery.
+//
+// The vendored Nomad API predates the `provider` attribute of the services, so the jobs are registered
+// with the raw API and the attribute is added to the encoded services.
+type nomadServiceJobs struct {
+	*api.Jobs
+	client *api.Client
+}
+
+func (j *nomadServiceJobs) RegisterOpts(job *api.Job, opts *api.RegisterOptions, q *api.WriteOptions) (*api.JobRegisterResponse, *api.WriteMeta, error) {
+	req := &api.JobRegisterRequest{
+		Job: job,
+	}
+	if opts != nil {
+		if opts.EnforceIndex {
+			req.EnforceIndex = true
+			req.JobModifyIndex = opts.ModifyIndex
+		}
+		req.PolicyOverride = opts.PolicyOverride
+		req.PreserveCounts = opts.PreserveCounts
+	}
+
+	payload, err := withServiceProvider(req, types.DiscoveryNomad)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var resp api.JobRegisterResponse
+	wm, err := j.client.Raw().Write("/v1/jobs", payload, &resp, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resp, wm, nil
+}
+
+// withServiceProvider encodes a job registration request, setting the provider of all the group and task services.
+func withServiceProvider(req *api.JobRegisterRequest, provider string) (map[string]interface{}, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+
+	setProvider := func(parent map[string]interface{}) {
+		services, _ := parent["Services"].([]interface{})
+		for _, s := range services {
+			if service, ok := s.(map[string]interface{}); ok {
+				service["Provider"] = provider
+			}
+		}
+	}
+
+	job, _ := payload["Job"].(map[string]interface{})
+	groups, _ := job["TaskGroups"].([]interface{})
+	for _, g := range groups {
+		group, ok := g.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		setProvider(group)
+
+		tasks, _ := group["Tasks"].([]interface{})
+		for _, t := range tasks {
+			if task, ok := t.(map[string]interface{}); ok {
+				setProvider(task)
+			}
+		}
+	}
+
+	return payload, nil
+}
+
+func newNomadClient(config types.NomadConfig) (*api.Client, error) {
 	c := api.DefaultConfig()
 
 	c.Address = config.Addr
@@ -25,11 +117,5 @@ func NewNomadJobs(config types.NomadConfig) (Jobs, error) {
 	c.TLSConfig.ClientKey = config.ClientKey
 	c.TLSConfig.Insecure = config.TLSSkipVerify
 
-	nomadClient, err := api.NewClient(c)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return nomadClient.Jobs(), nil
+	return api.NewClient(c)
 }
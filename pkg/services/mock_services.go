@@ -4,6 +4,7 @@ import (
 	"net/url"
 
 	"github.com/hashicorp/nomad/api"
+	"github.com/jsiebens/faas-nomad/pkg/resolver"
 	ftypes "github.com/openfaas/faas-provider/types"
 	"github.com/stretchr/testify/mock"
 )
@@ -28,6 +29,11 @@ func (ms *MockSecrets) Set(key, value string) error {
 	return args.Error(0)
 }
 
+func (ms *MockSecrets) Get(key string) (string, error) {
+	args := ms.Called(key)
+	return args.String(0), args.Error(1)
+}
+
 func (ms *MockSecrets) Exists(key string) bool {
 	args := ms.Called(key)
 	return args.Bool(0)
@@ -148,6 +154,26 @@ func (m *MockJobs) Allocations(jobID string, allAllocs bool, q *api.QueryOptions
 	return allocs, meta, args.Error(2)
 }
 
+type MockLogs struct {
+	mock.Mock
+}
+
+func (ml *MockLogs) Logs(alloc *api.Allocation, follow bool, task, logType, origin string, offset int64, cancel <-chan struct{}, q *api.QueryOptions) (<-chan *api.StreamFrame, <-chan error) {
+	args := ml.Called(alloc, follow, task, logType, origin, offset, q)
+
+	var frames <-chan *api.StreamFrame
+	if f := args.Get(0); f != nil {
+		frames = f.(chan *api.StreamFrame)
+	}
+
+	var errors <-chan error
+	if e := args.Get(1); e != nil {
+		errors = e.(chan error)
+	}
+
+	return frames, errors
+}
+
 type MockResolver struct {
 	mock.Mock
 }
@@ -160,9 +186,54 @@ func (mr *MockResolver) Resolve(functionName string) (url.URL, error) {
 		resp = r.(url.URL)
 	}
 
-	return resp, args.Error(2)
+	return resp, args.Error(1)
 }
 
-func (mr *MockResolver) RemoveCacheItem(functionName string) {
+func (mr *MockResolver) ResolveAll(functionName string) ([]url.URL, error) {
+	args := mr.Called(functionName)
+
+	var resp []url.URL
+	if r := args.Get(0); r != nil {
+		resp = r.([]url.URL)
+	}
+
+	return resp, args.Error(1)
+}
+
+func (mr *MockResolver) ResolveEndpoints(functionName string) ([]resolver.Endpoint, error) {
+	args := mr.Called(functionName)
+
+	var resp []resolver.Endpoint
+	if r := args.Get(0); r != nil {
+		resp = r.([]resolver.Endpoint)
+	}
+
+	return resp, args.Error(1)
+}
+
+func (mr *MockResolver) Watch(functionName string) {
 	mr.Called(functionName)
 }
+
+func (mr *MockResolver) Unwatch(functionName string) {
+	mr.Called(functionName)
+}
+
+type MockFunctions struct {
+	mock.Mock
+}
+
+func (mf *MockFunctions) Get(functionName string) (*ftypes.FunctionStatus, error) {
+	args := mf.Called(functionName)
+
+	var resp *ftypes.FunctionStatus
+	if r := args.Get(0); r != nil {
+		resp = r.(*ftypes.FunctionStatus)
+	}
+
+	return resp, args.Error(1)
+}
+
+func (mf *MockFunctions) Invalidate(functionName string) {
+	mf.Called(functionName)
+}
@@ -15,6 +15,7 @@ import (
 type Secrets interface {
 	List() ([]ftypes.Secret, error)
 	Set(key, value string) error
+	Get(key string) (string, error)
 	Exists(key string) bool
 	Delete(key string) error
 }
@@ -80,6 +81,23 @@ func (vs *VaultSecrets) Exists(key string) bool {
 	return s != nil && err == nil
 }
 
+// Get reads the value of a secret, an error is returned when the secret doesn't exist.
+func (vs *VaultSecrets) Get(key string) (string, error) {
+	s, err := vs.client.Logical().Read(fmt.Sprintf("%s/%s", vs.prefix, key))
+	if err != nil {
+		return "", err
+	}
+	if s == nil || s.Data == nil {
+		return "", fmt.Errorf("secret %s not found", key)
+	}
+
+	value, ok := s.Data["value"].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no value", key)
+	}
+	return value, nil
+}
+
 func (vs *VaultSecrets) Set(key, value string) error {
 	_, err := vs.client.Logical().Write(fmt.Sprintf("%s/%s", vs.prefix, key), map[string]interface{}{"value": value})
 	return err
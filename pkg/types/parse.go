@@ -1,8 +1,10 @@
 package types
 
 import (
-	"github.com/openfaas/faas-provider/types"
+	"strings"
 	"time"
+
+	"github.com/openfaas/faas-provider/types"
 )
 
 func ParseStringValueFromMap(values *map[string]string, key string, fallback string) string {
@@ -36,3 +38,32 @@ func ParseIntOrDurationValueFromMap(values *map[string]string, key string, fallb
 	m := *values
 	return types.ParseIntOrDurationValue(m[key], fallback)
 }
+
+// ParseListValue parses a comma separated list, ignoring the empty items.
+func ParseListValue(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ParseMapValue parses a comma separated list of key=value pairs, ignoring the items without a key.
+func ParseMapValue(value string) map[string]string {
+	result := map[string]string{}
+	for _, item := range ParseListValue(value) {
+		parts := strings.SplitN(item, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			continue
+		}
+		if len(parts) == 2 {
+			result[key] = strings.TrimSpace(parts[1])
+		} else {
+			result[key] = ""
+		}
+	}
+	return result
+}
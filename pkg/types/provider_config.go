@@ -1,14 +1,22 @@
 package types
 
 import (
+	"fmt"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 	"os"
 	"strings"
+	"time"
 
 	ftypes "github.com/openfaas/faas-provider/types"
 )
 
+const (
+	HealthPassing = "passing"
+	HealthWarning = "warning"
+	HealthIgnore  = "ignore"
+)
+
 type ConsulConfig struct {
 	Addr          string
 	ACLToken      string
@@ -16,6 +24,20 @@ type ConsulConfig struct {
 	ClientCert    string
 	ClientKey     string
 	TLSSkipVerify bool
+
+	// HealthStatus selects the instances resolved by their health: HealthPassing only, HealthWarning
+	// for passing or warning, or HealthIgnore to ignore the checks
+	HealthStatus string
+	// HealthTags and HealthNodeMeta restrict the resolved instances to the ones having all the tags and node metadata
+	HealthTags     []string
+	HealthNodeMeta map[string]string
+
+	// FailoverDatacenters are queried in order when no instance of a function is available in the local datacenter
+	FailoverDatacenters []string
+	// FailoverPreparedQuery executes the prepared query named after the service of a function instead, usually
+	// a template matching the job prefix, which defines the failover datacenters
+	FailoverPreparedQuery bool
+	FailoverTTL           time.Duration
 }
 
 type NomadConfig struct {
@@ -47,6 +69,67 @@ type SchedulingConfig struct {
 	HttpCheck      bool
 }
 
+type ScalingConfig struct {
+	IdleCheckInterval time.Duration
+	IdleDuration      time.Duration
+
+	Interval          time.Duration
+	ScaleUpWindow     time.Duration
+	ScaleDownWindow   time.Duration
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+}
+
+type MetricsConfig struct {
+	Enabled bool
+
+	InvocationCountFile          string
+	InvocationCountFlushInterval time.Duration
+}
+
+type TracingConfig struct {
+	Exporter    string
+	Endpoint    string
+	Insecure    bool
+	ServiceName string
+}
+
+type AsyncConfig struct {
+	Enabled         bool
+	File            string
+	Workers         int
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	MaxBodySize     int64
+	CallbackTimeout time.Duration
+}
+
+type RoutingConfig struct {
+	Port            int
+	RefreshInterval time.Duration
+}
+
+const (
+	DiscoveryConsul = "consul"
+	DiscoveryNomad  = "nomad"
+	DiscoveryFile   = "file"
+)
+
+// DatacenterMeta is the key of the service meta holding the Nomad datacenter of a function instance. Several
+// Nomad datacenters can register their services in the same Consul datacenter.
+const DatacenterMeta = "nomad_datacenter"
+
+// DiscoveryConfig selects where the instances of the functions are registered and resolved.
+type DiscoveryConfig struct {
+	// Provider is either DiscoveryConsul, DiscoveryNomad for the Nomad native service discovery,
+	// or DiscoveryFile for static endpoints read from File, e.g. for local development
+	Provider        string
+	File            string
+	WatchTTL        time.Duration
+	WatchMaxBackoff time.Duration
+}
+
 type LogConfig struct {
 	Level  string
 	Format string
@@ -59,13 +142,58 @@ type ProviderConfig struct {
 	Vault      VaultConfig
 	Consul     ConsulConfig
 	Nomad      NomadConfig
+	Discovery  DiscoveryConfig
 	Scheduling SchedulingConfig
+	Scaling    ScalingConfig
 	Proxy      ProxyConfig
+	Metrics    MetricsConfig
+	Tracing    TracingConfig
+	Async      AsyncConfig
+	Routing    RoutingConfig
 	Log        LogConfig
 }
 
+// The load balancing strategies of the proxy.
+const (
+	StrategyRoundRobin    = "roundrobin"
+	StrategyRandom        = "random"
+	StrategyLeastRequests = "leastrequests"
+	StrategyP2C           = "p2c"
+	StrategyHash          = "hash"
+)
+
 type ProxyConfig struct {
-	Strategy string
+	Strategy       string
+	HashHeader     string
+	MaxRetries     int
+	RetryBackoff   time.Duration
+	RetryBodyLimit int64
+
+	OutlierConsecutiveFailures int
+	OutlierMaxLatency          time.Duration
+	OutlierEjectionTime        time.Duration
+	OutlierMaxEjectionTime     time.Duration
+
+	ScaleFromZero        bool
+	ScaleFromZeroTimeout time.Duration
+
+	StreamIdleTimeout time.Duration
+	MaxTimeout        time.Duration
+
+	QueueSize    int
+	QueueTimeout time.Duration
+
+	MirrorBodyLimit   int64
+	MirrorMaxInflight int
+
+	LocalityDatacenter string
+	LocalityZone       string
+	LocalityZoneKey    string
+	LocalityMaxLoad    int
+
+	AuthSecretTTL           time.Duration
+	AuthJWKS                string
+	AuthJWKSRefreshInterval time.Duration
 }
 
 func DefaultConfig() (*ProviderConfig, error) {
@@ -109,6 +237,14 @@ func doLoadConfig(env ftypes.HasEnv) (*ProviderConfig, error) {
 			ClientCert:    ftypes.ParseString(env.Getenv("consul_tls_cert"), ""),
 			ClientKey:     ftypes.ParseString(env.Getenv("consul_tls_key"), ""),
 			TLSSkipVerify: ftypes.ParseBoolValue(env.Getenv("consul_tls_skip_verify"), false),
+
+			HealthStatus:   ftypes.ParseString(env.Getenv("consul_health_status"), HealthPassing),
+			HealthTags:     ParseListValue(env.Getenv("consul_health_tags")),
+			HealthNodeMeta: ParseMapValue(env.Getenv("consul_health_node_meta")),
+
+			FailoverDatacenters:   ParseListValue(env.Getenv("consul_failover_datacenters")),
+			FailoverPreparedQuery: ftypes.ParseBoolValue(env.Getenv("consul_failover_prepared_query"), false),
+			FailoverTTL:           ftypes.ParseIntOrDurationValue(env.Getenv("consul_failover_ttl"), 5*time.Second),
 		},
 
 		Nomad: NomadConfig{
@@ -120,6 +256,13 @@ func doLoadConfig(env ftypes.HasEnv) (*ProviderConfig, error) {
 			TLSSkipVerify: ftypes.ParseBoolValue(env.Getenv("nomad_tls_skip_verify"), false),
 		},
 
+		Discovery: DiscoveryConfig{
+			Provider:        ftypes.ParseString(env.Getenv("discovery_provider"), "consul"),
+			File:            ftypes.ParseString(env.Getenv("discovery_file"), ""),
+			WatchTTL:        ftypes.ParseIntOrDurationValue(env.Getenv("discovery_watch_ttl"), 30*time.Minute),
+			WatchMaxBackoff: ftypes.ParseIntOrDurationValue(env.Getenv("discovery_watch_max_backoff"), 30*time.Second),
+		},
+
 		Scheduling: SchedulingConfig{
 			Region:         ftypes.ParseString(env.Getenv("job_region"), "global"),
 			Datacenters:    strings.Split(ftypes.ParseString(env.Getenv("job_datacenters"), "dc1"), ","),
@@ -129,8 +272,79 @@ func doLoadConfig(env ftypes.HasEnv) (*ProviderConfig, error) {
 			HttpCheck:      ftypes.ParseBoolValue(env.Getenv("job_http_check"), true),
 		},
 
+		Scaling: ScalingConfig{
+			IdleCheckInterval: ftypes.ParseIntOrDurationValue(env.Getenv("scale_zero_interval"), 1*time.Minute),
+			IdleDuration:      ftypes.ParseIntOrDurationValue(env.Getenv("scale_zero_duration"), 15*time.Minute),
+
+			Interval:          ftypes.ParseIntOrDurationValue(env.Getenv("scale_interval"), 10*time.Second),
+			ScaleUpWindow:     ftypes.ParseIntOrDurationValue(env.Getenv("scale_up_window"), 0),
+			ScaleDownWindow:   ftypes.ParseIntOrDurationValue(env.Getenv("scale_down_window"), 5*time.Minute),
+			ScaleUpCooldown:   ftypes.ParseIntOrDurationValue(env.Getenv("scale_up_cooldown"), 30*time.Second),
+			ScaleDownCooldown: ftypes.ParseIntOrDurationValue(env.Getenv("scale_down_cooldown"), 2*time.Minute),
+		},
+
 		Proxy: ProxyConfig{
-			Strategy: ftypes.ParseString(env.Getenv("proxy_strategy"), "roundrobin"),
+			Strategy:       ftypes.ParseString(env.Getenv("proxy_strategy"), "roundrobin"),
+			HashHeader:     ftypes.ParseString(env.Getenv("proxy_hash_header"), ""),
+			MaxRetries:     ftypes.ParseIntValue(env.Getenv("proxy_max_retries"), 2),
+			RetryBackoff:   ftypes.ParseIntOrDurationValue(env.Getenv("proxy_retry_backoff"), 50*time.Millisecond),
+			RetryBodyLimit: int64(ftypes.ParseIntValue(env.Getenv("proxy_retry_body_limit"), 1024*1024)),
+
+			OutlierConsecutiveFailures: ftypes.ParseIntValue(env.Getenv("proxy_outlier_consecutive_failures"), 5),
+			OutlierMaxLatency:          ftypes.ParseIntOrDurationValue(env.Getenv("proxy_outlier_max_latency"), 0),
+			OutlierEjectionTime:        ftypes.ParseIntOrDurationValue(env.Getenv("proxy_outlier_ejection_time"), 30*time.Second),
+			OutlierMaxEjectionTime:     ftypes.ParseIntOrDurationValue(env.Getenv("proxy_outlier_max_ejection_time"), 5*time.Minute),
+
+			ScaleFromZero:        ftypes.ParseBoolValue(env.Getenv("proxy_scale_from_zero"), true),
+			ScaleFromZeroTimeout: ftypes.ParseIntOrDurationValue(env.Getenv("proxy_scale_from_zero_timeout"), 30*time.Second),
+
+			StreamIdleTimeout: ftypes.ParseIntOrDurationValue(env.Getenv("proxy_stream_idle_timeout"), 60*time.Second),
+			MaxTimeout:        ftypes.ParseIntOrDurationValue(env.Getenv("proxy_max_timeout"), 5*time.Minute),
+
+			QueueSize:    ftypes.ParseIntValue(env.Getenv("proxy_queue_size"), 100),
+			QueueTimeout: ftypes.ParseIntOrDurationValue(env.Getenv("proxy_queue_timeout"), 30*time.Second),
+
+			MirrorBodyLimit:   int64(ftypes.ParseIntValue(env.Getenv("proxy_mirror_body_limit"), 1024*1024)),
+			MirrorMaxInflight: ftypes.ParseIntValue(env.Getenv("proxy_mirror_max_inflight"), 100),
+
+			LocalityDatacenter: ftypes.ParseString(env.Getenv("proxy_locality_datacenter"), ""),
+			LocalityZone:       ftypes.ParseString(env.Getenv("proxy_locality_zone"), ""),
+			LocalityZoneKey:    ftypes.ParseString(env.Getenv("proxy_locality_zone_key"), "zone"),
+			LocalityMaxLoad:    ftypes.ParseIntValue(env.Getenv("proxy_locality_max_load"), 0),
+
+			AuthSecretTTL:           ftypes.ParseIntOrDurationValue(env.Getenv("proxy_auth_secret_ttl"), 30*time.Second),
+			AuthJWKS:                ftypes.ParseString(env.Getenv("proxy_auth_jwks"), ""),
+			AuthJWKSRefreshInterval: ftypes.ParseIntOrDurationValue(env.Getenv("proxy_auth_jwks_refresh_interval"), 5*time.Minute),
+		},
+
+		Metrics: MetricsConfig{
+			Enabled: ftypes.ParseBoolValue(env.Getenv("metrics_enabled"), true),
+
+			InvocationCountFile:          ftypes.ParseString(env.Getenv("invocation_count_file"), ""),
+			InvocationCountFlushInterval: ftypes.ParseIntOrDurationValue(env.Getenv("invocation_count_flush_interval"), 30*time.Second),
+		},
+
+		Tracing: TracingConfig{
+			Exporter:    ftypes.ParseString(env.Getenv("tracing_exporter"), "none"),
+			Endpoint:    ftypes.ParseString(env.Getenv("tracing_otlp_endpoint"), "localhost:4318"),
+			Insecure:    ftypes.ParseBoolValue(env.Getenv("tracing_otlp_insecure"), false),
+			ServiceName: ftypes.ParseString(env.Getenv("tracing_service_name"), "faas-nomad"),
+		},
+
+		Async: AsyncConfig{
+			Enabled:         ftypes.ParseBoolValue(env.Getenv("async_enabled"), false),
+			File:            ftypes.ParseString(env.Getenv("async_queue_file"), "async-queue.db"),
+			Workers:         ftypes.ParseIntValue(env.Getenv("async_workers"), 1),
+			MaxAttempts:     ftypes.ParseIntValue(env.Getenv("async_max_attempts"), 5),
+			RetryBackoff:    ftypes.ParseIntOrDurationValue(env.Getenv("async_retry_backoff"), 1*time.Second),
+			MaxRetryBackoff: ftypes.ParseIntOrDurationValue(env.Getenv("async_max_retry_backoff"), 5*time.Minute),
+			MaxBodySize:     int64(ftypes.ParseIntValue(env.Getenv("async_max_body_size"), 1024*1024)),
+			CallbackTimeout: ftypes.ParseIntOrDurationValue(env.Getenv("async_callback_timeout"), 30*time.Second),
+		},
+
+		Routing: RoutingConfig{
+			Port:            ftypes.ParseIntValue(env.Getenv("routing_port"), 0),
+			RefreshInterval: ftypes.ParseIntOrDurationValue(env.Getenv("routing_refresh_interval"), 30*time.Second),
 		},
 
 		Log: LogConfig{
@@ -140,9 +354,36 @@ func doLoadConfig(env ftypes.HasEnv) (*ProviderConfig, error) {
 		},
 	}
 
+	if err := validateStrategy(providerConfig.Proxy.Strategy); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateHealthStatus(providerConfig.Consul.HealthStatus); err != nil {
+		return nil, err
+	}
+
 	return providerConfig, err
 }
 
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case StrategyRoundRobin, StrategyRandom, StrategyLeastRequests, StrategyP2C, StrategyHash:
+		return nil
+	default:
+		return fmt.Errorf("unsupported proxy strategy '%s'", strategy)
+	}
+}
+
+// ValidateHealthStatus returns an error when the health status isn't HealthPassing, HealthWarning or HealthIgnore.
+func ValidateHealthStatus(status string) error {
+	switch status {
+	case HealthPassing, HealthWarning, HealthIgnore:
+		return nil
+	default:
+		return fmt.Errorf("unsupported consul health status '%s'", status)
+	}
+}
+
 type emptyEnv struct {
 }
 
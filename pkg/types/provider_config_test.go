@@ -0,0 +1,33 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mapEnv map[string]string
+
+func (m mapEnv) Getenv(key string) string {
+	return m[key]
+}
+
+func TestLoadConfigWithProxyStrategy(t *testing.T) {
+	config, err := doLoadConfig(mapEnv{"proxy_strategy": StrategyLeastRequests})
+	assert.NoError(t, err)
+	assert.Equal(t, StrategyLeastRequests, config.Proxy.Strategy)
+}
+
+func TestLoadConfigReportsUnsupportedProxyStrategy(t *testing.T) {
+	_, err := doLoadConfig(mapEnv{"proxy_strategy": "round-robin"})
+	assert.EqualError(t, err, "unsupported proxy strategy 'round-robin'")
+}
+
+func TestLoadConfigReportsUnsupportedHealthStatus(t *testing.T) {
+	config, err := doLoadConfig(mapEnv{"consul_health_status": HealthWarning})
+	assert.NoError(t, err)
+	assert.Equal(t, HealthWarning, config.Consul.HealthStatus)
+
+	_, err = doLoadConfig(mapEnv{"consul_health_status": "critical"})
+	assert.EqualError(t, err, "unsupported consul health status 'critical'")
+}